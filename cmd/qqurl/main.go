@@ -1,24 +1,78 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/kubernetes-csi/csi-driver-qumulo/pkg/qumulo"
+	"golang.org/x/term"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
-func main() {
-	hostPtr := flag.String("host", "localhost", "Host to connect to")
-	portPtr := flag.Int("port", 8000, "Port to connect to")
-	username := flag.String("username", "admin", "Username to connect as")
-	password := flag.String("password", "", "Password to use")
-	logging := flag.Bool("logging", false, "Enable logging")
+const usage = `Usage: qqurl [flags] VERB URI
+
+Sends one request to the Qumulo REST API and prints the response, e.g.
+
+  qqurl -host qumulo GET /v1/version
+  echo '{"limit": "1000"}' | qqurl -host qumulo PUT /v1/files/quotas/3
+
+The password is read from $QUMULO_PASSWORD, -password-file or a prompt. Sessions are saved and
+reused between runs, so the password is only needed when the saved session has expired.
+
+Exit status: 1 if the cluster returned an error, 2 on usage errors, 3 if the cluster couldn't
+be reached or logged in to.
+
+Flags:
+`
+
+const (
+	exitRestError  = 1
+	exitUsage      = 2
+	exitConnection = 3
+)
+
+var verbs = map[string]bool{"GET": true, "PUT": true, "POST": true, "PATCH": true, "DELETE": true}
 
+// Read from stdin unless -data says otherwise.
+var bodyVerbs = map[string]bool{"PUT": true, "POST": true, "PATCH": true}
+
+var (
+	host         = flag.String("host", "localhost", "Host to connect to")
+	port         = flag.Int("port", 8000, "Port to connect to")
+	username     = flag.String("username", "admin", "Username to connect as")
+	password     = flag.String("password", "", "Deprecated, leaks into shell history")
+	passwordFile = flag.String("password-file", "", "File with the password of -username")
+	data         = flag.String(
+		"data",
+		"",
+		"Request body, @FILE to read it from a file or - for stdin. "+
+			"Read from stdin for PUT, POST and PATCH if not given",
+	)
+	paginate   = flag.Bool("paginate", true, "Follow paging.next of GET results and merge the pages")
+	compact    = flag.Bool("compact", false, "Print JSON responses compactly instead of indented")
+	saveTokens = flag.Bool("save-session", true, "Save the session token and reuse it next time")
+	logging    = flag.Bool("logging", false, "Enable logging")
+	caCertPath = flag.String("cacert", "", "PEM file of CA certificates to verify the cluster with")
+	serverName = flag.String("servername", "", "Name the cluster's certificate must be valid for")
+	insecure   = flag.Bool("insecure", false, "Skip verification of the cluster's certificate")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if !*logging {
@@ -34,25 +88,330 @@ func main() {
 		vlogFlags.Set("v", "3")
 	}
 
-	verb := strings.ToUpper(flag.Args()[0])
-	uri := flag.Args()[1]
+	os.Exit(run())
+}
+
+func fail(code int, format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "qqurl: "+format+"\n", args...)
+	return code
+}
+
+func run() int {
+	if flag.NArg() != 2 {
+		flag.Usage()
+		return exitUsage
+	}
+
+	verb := strings.ToUpper(flag.Arg(0))
+	uri := flag.Arg(1)
+
+	if !verbs[verb] {
+		return fail(exitUsage, "unknown verb %q", flag.Arg(0))
+	}
+	if !strings.HasPrefix(uri, "/") {
+		return fail(exitUsage, "URI %q must start with a '/'", uri)
+	}
+
+	requestBody, err := readBody(verb)
+	if err != nil {
+		return fail(exitUsage, "%v", err)
+	}
+
+	connection, err := connect()
+	if err != nil {
+		return fail(exitConnection, "%v", err)
+	}
 
-	connection := qumulo.MakeConnection(*hostPtr, *portPtr, *username, *password, new(http.Client))
+	ctx := context.Background()
 
-	requestBody := []byte{}
+	responseData, err := do(ctx, connection, verb, uri, requestBody)
 
-	if verb == "PUT" || verb == "POST" {
+	// Saved sessions outlive their token, so the password may not have been needed until now.
+	if isLoginFailure(err) && connection.Password == "" {
+		connection.Password, err = promptPassword()
+		if err != nil {
+			return fail(exitConnection, "%v", err)
+		}
+		responseData, err = do(ctx, connection, verb, uri, requestBody)
+	}
+
+	// An error from the cluster still means the session is good.
+	var restErr qumulo.RestError
+	isRestErr := errors.As(err, &restErr)
+	if err == nil || isRestErr {
+		saveSession(connection)
+	}
+
+	if isRestErr {
+		return fail(
+			exitRestError,
+			"%d %s: %s",
+			restErr.StatusCode,
+			restErr.ErrorClass,
+			restErr.Description,
+		)
+	}
+	if err != nil {
+		return fail(exitConnection, "%v", err)
+	}
+
+	fmt.Println(formatResponse(responseData))
+
+	return 0
+}
+
+func readBody(verb string) ([]byte, error) {
+	switch {
+	case *data == "-" || (*data == "" && bodyVerbs[verb]):
+		return ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(*data, "@"):
+		return ioutil.ReadFile(strings.TrimPrefix(*data, "@"))
+	}
+	return []byte(*data), nil
+}
+
+func isLoginFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return status.Code(err) == codes.Unauthenticated
+}
+
+/*                    _
+ *  ___  ___  ___ ___(_) ___  _ __  ___
+ * / __|/ _ \/ __/ __| |/ _ \| '_ \/ __|
+ * \__ \  __/\__ \__ \ | (_) | | | \__ \
+ * |___/\___||___/___/_|\___/|_| |_|___/
+ *  FIGLET: sessions
+ */
+
+func connect() (*qumulo.Connection, error) {
+	tlsOptions := qumulo.TLSOptions{ServerName: *serverName, Insecure: *insecure}
+
+	if *caCertPath != "" {
 		var err error
-		requestBody, err = ioutil.ReadAll(os.Stdin)
+		tlsOptions.CACert, err = ioutil.ReadFile(*caCertPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := qumulo.NewHTTPClient(tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	pass, err := getPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	connection := qumulo.MakeConnection(*host, *port, *username, pass, client)
+
+	token := loadSession()
+	if token != "" {
+		connection.SetBearerToken(token)
+	} else if pass == "" {
+		connection.Password, err = promptPassword()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &connection, nil
+}
+
+// The password from the flags or environment, empty if none was given.
+func getPassword() (string, error) {
+	if *password != "" {
+		return *password, nil
+	}
+	if pass, ok := os.LookupEnv("QUMULO_PASSWORD"); ok {
+		return pass, nil
+	}
+	if *passwordFile != "" {
+		contents, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	}
+	return "", nil
+}
+
+// Prompt on the terminal, which works even when stdin carries the request body.
+func promptPassword() (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.New("no password, set QUMULO_PASSWORD or -password-file")
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "Password for %s@%s: ", *username, *host)
+	pass, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pass), nil
+}
+
+var unsafeFileCharacters = regexp.MustCompile("[^A-Za-z0-9@._-]")
+
+// One file per user and cluster, readable only by its owner.
+func sessionPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s@%s_%d", *username, *host, *port)
+	name = unsafeFileCharacters.ReplaceAllString(name, "_")
+
+	return filepath.Join(dir, "qqurl", name), nil
+}
+
+func loadSession() string {
+	if !*saveTokens {
+		return ""
+	}
+
+	path, err := sessionPath()
+	if err != nil {
+		return ""
+	}
+
+	token, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(token))
+}
+
+func saveSession(connection *qumulo.Connection) {
+	token := connection.BearerToken()
+	if !*saveTokens || token == "" {
+		return
+	}
+
+	path, err := sessionPath()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(token), 0600)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "qqurl: failed to save session: %v\n", err)
+	}
+}
+
+/*                    _
+ *  _ __   __ _  __ _(_)_ __   __ _
+ * | '_ \ / _` |/ _` | | '_ \ / _` |
+ * | |_) | (_| | (_| | | | | | (_| |
+ * | .__/ \__,_|\__, |_|_| |_|\__, |
+ * |_|          |___/         |___/
+ *  FIGLET: paging
+ */
+
+type pagingResponse struct {
+	Paging struct {
+		Next string `json:"next"`
+	} `json:"paging"`
+}
+
+func do(
+	ctx context.Context,
+	connection *qumulo.Connection,
+	verb string,
+	uri string,
+	body []byte,
+) ([]byte, error) {
+	responseData, err := connection.Do(ctx, verb, uri, body)
+	if err != nil || verb != "GET" || !*paginate {
+		return responseData, err
+	}
+
+	var page pagingResponse
+	if json.Unmarshal(responseData, &page) != nil || page.Paging.Next == "" {
+		return responseData, nil
+	}
+
+	merged, err := decodeObject(responseData)
+	if err != nil {
+		return nil, err
+	}
+
+	for next := page.Paging.Next; next != ""; next = page.Paging.Next {
+		responseData, err = connection.Get(ctx, next)
 		if err != nil {
-			klog.Fatal(err)
+			return nil, err
 		}
+
+		page = pagingResponse{}
+		err = json.Unmarshal(responseData, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		err = mergePage(merged, responseData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The merged result is a single page.
+	delete(merged, "paging")
+
+	return json.Marshal(merged)
+}
+
+func decodeObject(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	err := decoder.Decode(&object)
+
+	return object, err
+}
+
+// Append the lists in page to those in merged, such as the "files" of directory entries.
+func mergePage(merged map[string]interface{}, page []byte) error {
+	object, err := decodeObject(page)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range object {
+		items, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		previous, _ := merged[key].([]interface{})
+		merged[key] = append(previous, items...)
+	}
+
+	return nil
+}
+
+func formatResponse(data []byte) string {
+	var out bytes.Buffer
+	var err error
+
+	if *compact {
+		err = json.Compact(&out, data)
+	} else {
+		err = json.Indent(&out, data, "", "  ")
 	}
 
-	responseData, err := connection.Do(verb, uri, requestBody)
+	// Not everything the cluster returns is JSON.
 	if err != nil {
-		klog.Fatal(err)
+		return string(data)
 	}
 
-	fmt.Println(string(responseData))
+	return out.String()
 }
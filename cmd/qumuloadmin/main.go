@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kubernetes-csi/csi-driver-qumulo/pkg/qumulo"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const usage = `Usage: qumuloadmin [flags] COMMAND [ARGS]
+
+Commands:
+  decode-id ID                      show the parts of a volume ID
+  encode-id -server S -store-real-path P -store-mount-path P -name N [flags]
+                                    build a volume ID, e.g. for a static PV
+  show ID                           show a volume's directory, quota limit and usage
+  list -server S -path P [flags]    list the volumes under a storeRealPath
+  resize ID SIZE                    set a volume's quota limit, e.g. 10Gi
+  check-storageclass NAME | -f FILE check a StorageClass's parameters against its cluster
+
+The cluster password is read from $QUMULO_PASSWORD or -password-file.
+
+Flags:
+`
+
+var (
+	username     = flag.String("username", "admin", "user to log in to the cluster as")
+	passwordFile = flag.String("password-file", "", "file with the password of -username")
+	caCertPath   = flag.String("cacert", "", "PEM file of CA certificates to verify the cluster with")
+	serverName   = flag.String("servername", "", "name the cluster's certificate must be valid for")
+	insecure     = flag.Bool("insecure", false, "skip verification of the cluster's certificate")
+	output       = flag.String("output", "table", "output format, table or json")
+	kubeconfig   = flag.String("kubeconfig", defaultKubeconfig(), "kubeconfig file")
+	logging      = flag.Bool("logging", false, "log REST requests")
+	timeout      = flag.Duration("timeout", 5*time.Minute, "time limit on the command")
+)
+
+// Usage errors exit with 2, failures with 1.
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	vlogFlags := &flag.FlagSet{}
+	klog.InitFlags(vlogFlags)
+	if *logging {
+		vlogFlags.Set("v", "3")
+	} else {
+		klog.SetOutput(ioutil.Discard)
+		vlogFlags.Set("logtostderr", "false")
+	}
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "-output must be table or json\n")
+		os.Exit(2)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	err := run(ctx, flag.Arg(0), flag.Args()[1:])
+	cancel()
+
+	var usageErr usageError
+	if errors.As(err, &usageErr) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "decode-id":
+		return decodeID(args)
+	case "encode-id":
+		return encodeID(args)
+	case "show":
+		return show(ctx, args)
+	case "list":
+		return list(ctx, args)
+	case "resize":
+		return resize(ctx, args)
+	case "check-storageclass":
+		return checkStorageClass(ctx, args)
+	}
+	return usageError{fmt.Sprintf("unknown command %q, run with -help for usage", command)}
+}
+
+func defaultKubeconfig() string {
+	if path := os.Getenv("KUBECONFIG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kube", "config")
+}
+
+func getPassword() (string, error) {
+	if password, ok := os.LookupEnv("QUMULO_PASSWORD"); ok {
+		return password, nil
+	}
+	if *passwordFile == "" {
+		return "", usageError{"set QUMULO_PASSWORD or -password-file"}
+	}
+	data, err := ioutil.ReadFile(*passwordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func connect(server string, restPort int) (*qumulo.Connection, error) {
+	password, err := getPassword()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsOptions := qumulo.TLSOptions{ServerName: *serverName, Insecure: *insecure}
+	if *caCertPath != "" {
+		tlsOptions.CACert, err = ioutil.ReadFile(*caCertPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := qumulo.NewHTTPClient(tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	connection := qumulo.MakeConnection(server, restPort, *username, password, client)
+	return &connection, nil
+}
+
+func printJSON(value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// Prints rows under a header, each cell separated by tabs.
+func printTable(header string, rows []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		fmt.Fprintln(w, row)
+	}
+	return w.Flush()
+}
+
+func formatBytes(bytes uint64) string {
+	return resource.NewQuantity(int64(bytes), resource.BinarySI).String()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+/*      _                    _
+ *   __| | ___  ___ ___   __| | ___
+ *  / _` |/ _ \/ __/ _ \ / _` |/ _ \
+ * | (_| |  __/ (_| (_) | (_| |  __/
+ *  \__,_|\___|\___\___/ \__,_|\___|
+ *  FIGLET: decode
+ */
+
+func printVolumeInfo(info qumulo.VolumeInfo) error {
+	if *output == "json" {
+		return printJSON(info)
+	}
+
+	rows := []string{
+		"id\t" + info.ID,
+		fmt.Sprintf("cluster\t%s:%d", info.Server, info.RestPort),
+		"storeRealPath\t" + info.StoreRealPath,
+		"storeMountPath\t" + info.StoreMountPath,
+		"name\t" + info.Name,
+		"realPath\t" + info.RealPath,
+		"sharePath\t" + info.SharePath,
+	}
+	if info.SnapshotPolicy != "" {
+		rows = append(rows, "snapshotPolicy\t"+info.SnapshotPolicy)
+	}
+	if info.Adopted {
+		rows = append(rows, "adopted\ttrue")
+	}
+	if info.NamespaceDirectory {
+		rows = append(rows, "namespaceDirectory\ttrue")
+	}
+	if info.Replicated {
+		rows = append(rows, "replicated\ttrue")
+	}
+
+	return printTable("FIELD\tVALUE", rows)
+}
+
+func decodeID(args []string) error {
+	if len(args) != 1 {
+		return usageError{"usage: decode-id ID"}
+	}
+
+	info, err := qumulo.DecodeVolumeID(args[0])
+	if err != nil {
+		return err
+	}
+
+	return printVolumeInfo(info)
+}
+
+func encodeID(args []string) error {
+	var info qumulo.VolumeInfo
+
+	flags := flag.NewFlagSet("encode-id", flag.ContinueOnError)
+	flags.StringVar(&info.Server, "server", "", "address of the cluster")
+	flags.IntVar(&info.RestPort, "rest-port", 8000, "REST API port of the cluster")
+	flags.StringVar(&info.StoreRealPath, "store-real-path", "", "directory the volume is in")
+	flags.StringVar(&info.StoreMountPath, "store-mount-path", "", "that directory via the export")
+	flags.StringVar(&info.Name, "name", "", "name of the volume's directory")
+	flags.StringVar(&info.SnapshotPolicy, "snapshot-policy", "", "id of the snapshot policy")
+	flags.BoolVar(&info.Adopted, "adopted", false, "the driver must never delete the directory")
+	flags.BoolVar(&info.NamespaceDirectory, "namespace-directory", false, "in a namespace directory")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+
+	id, err := qumulo.EncodeVolumeID(info)
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		return printJSON(map[string]string{"id": id})
+	}
+	fmt.Println(id)
+	return nil
+}
+
+/*      _
+ *  ___| |__   _____      __
+ * / __| '_ \ / _ \ \ /\ / /
+ * \__ \ | | | (_) \ V  V /
+ * |___/_| |_|\___/ \_/\_/
+ *  FIGLET: show
+ */
+
+func printVolumeDirectories(directories []qumulo.VolumeDirectory) error {
+	if *output == "json" {
+		return printJSON(directories)
+	}
+
+	rows := []string{}
+	for _, directory := range directories {
+		limit := "-"
+		if directory.QuotaLimit != 0 {
+			limit = formatBytes(directory.QuotaLimit)
+		}
+		rows = append(rows, fmt.Sprintf(
+			"%s\t%s\t%s\t%s\t%s",
+			directory.Path,
+			directory.Id,
+			limit,
+			formatBytes(directory.CapacityUsage),
+			formatTime(directory.Created),
+		))
+	}
+
+	return printTable("PATH\tID\tLIMIT\tUSED\tCREATED", rows)
+}
+
+func show(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageError{"usage: show ID"}
+	}
+
+	info, err := qumulo.DecodeVolumeID(args[0])
+	if err != nil {
+		return err
+	}
+
+	connection, err := connect(info.Server, info.RestPort)
+	if err != nil {
+		return err
+	}
+
+	directory, err := qumulo.GetVolumeDirectory(ctx, connection, info.RealPath)
+	if err != nil {
+		return err
+	}
+
+	return printVolumeDirectories([]qumulo.VolumeDirectory{directory})
+}
+
+func list(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	server := flags.String("server", "", "address of the cluster")
+	restPort := flags.Int("rest-port", 8000, "REST API port of the cluster")
+	path := flags.String("path", "", "storeRealPath of the StorageClass")
+	namespaceDirectories := flags.Bool(
+		"namespace-directories",
+		false,
+		"also list volumes in namespace directories",
+	)
+	if err := flags.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+	if *server == "" || *path == "" {
+		return usageError{"usage: list -server S -path P [-rest-port N] [-namespace-directories]"}
+	}
+
+	connection, err := connect(*server, *restPort)
+	if err != nil {
+		return err
+	}
+
+	directories, err := qumulo.ListVolumeDirectories(ctx, connection, *path, *namespaceDirectories)
+	if err != nil {
+		return err
+	}
+
+	return printVolumeDirectories(directories)
+}
+
+/*                _
+ *  _ __ ___  ___(_)_______
+ * | '__/ _ \/ __| |_  / _ \
+ * | | |  __/\__ \ |/ /  __/
+ * |_|  \___||___/_/___\___|
+ *  FIGLET: resize
+ */
+
+func resize(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return usageError{"usage: resize ID SIZE"}
+	}
+
+	info, err := qumulo.DecodeVolumeID(args[0])
+	if err != nil {
+		return err
+	}
+
+	size, err := resource.ParseQuantity(args[1])
+	if err != nil || size.Sign() <= 0 {
+		return usageError{fmt.Sprintf("invalid size %q", args[1])}
+	}
+
+	connection, err := connect(info.Server, info.RestPort)
+	if err != nil {
+		return err
+	}
+
+	attributes, err := connection.LookUp(ctx, info.RealPath)
+	if err != nil {
+		return err
+	}
+
+	err = connection.EnsureQuota(ctx, attributes.Id, uint64(size.Value()))
+	if err != nil {
+		return err
+	}
+
+	directory, err := qumulo.GetVolumeDirectory(ctx, connection, info.RealPath)
+	if err != nil {
+		return err
+	}
+
+	return printVolumeDirectories([]qumulo.VolumeDirectory{directory})
+}
+
+/*       _               _
+ *   ___| |__   ___  ___| | __
+ *  / __| '_ \ / _ \/ __| |/ /
+ * | (__| | | |  __/ (__|   <
+ *  \___|_| |_|\___|\___|_|\_\
+ *  FIGLET: check
+ */
+
+func readStorageClass(
+	ctx context.Context,
+	name string,
+	file string,
+) (*storagev1.StorageClass, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var class storagev1.StorageClass
+		err = yaml.UnmarshalStrict(data, &class)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		return &class, nil
+	}
+
+	kubeClient, err := qumulo.GetKubeClient(*kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubeClient.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+}
+
+func checkStorageClass(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("check-storageclass", flag.ContinueOnError)
+	file := flags.String("f", "", "YAML or JSON file with the StorageClass")
+	if err := flags.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+	if (*file == "" && flags.NArg() != 1) || (*file != "" && flags.NArg() != 0) {
+		return usageError{"usage: check-storageclass NAME | -f FILE"}
+	}
+
+	class, err := readStorageClass(ctx, flags.Arg(0), *file)
+	if err != nil {
+		return err
+	}
+
+	checks := qumulo.CheckStorageClass(ctx, class.Parameters, connect)
+
+	if *output == "json" {
+		err = printJSON(checks)
+	} else {
+		rows := []string{}
+		for _, check := range checks {
+			result := "ok"
+			if !check.Passed {
+				result = "FAILED: " + check.Error
+			}
+			rows = append(rows, check.Name+"\t"+result)
+		}
+		err = printTable("CHECK\tRESULT", rows)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, check := range checks {
+		if !check.Passed {
+			return fmt.Errorf("StorageClass %q failed %s check", class.Name, check.Name)
+		}
+	}
+
+	return nil
+}
@@ -17,10 +17,12 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/kubernetes-csi/csi-driver-qumulo/pkg/qumulo"
 
@@ -32,6 +34,77 @@ var (
 	nodeID     = flag.String("nodeid", "", "node id")
 	perm       = flag.String("mount-permissions", "", "mounted folder permissions")
 	driverName = flag.String("drivername", qumulo.DefaultDriverName, "name of the driver")
+	kubeconfig = flag.String("kubeconfig", "", "kubeconfig file, in-cluster config is used if empty")
+
+	metricsAddress = flag.String(
+		"metrics-address",
+		"",
+		"address to serve Prometheus metrics on, e.g. :9090, disabled if empty",
+	)
+
+	otlpEndpoint = flag.String(
+		"otlp-endpoint",
+		"",
+		"OTLP/gRPC collector (host:port) to export traces to, disabled if empty",
+	)
+	otlpInsecure = flag.Bool("otlp-insecure", false, "connect to the OTLP collector without TLS")
+
+	healthAddress = flag.String(
+		"health-address",
+		"",
+		"address to serve health check detail on at /healthz, disabled if empty",
+	)
+	mountHelpers = flag.String(
+		"mount-helpers",
+		"",
+		"comma separated mount helpers, e.g. mount.nfs, which must be installed for Probe to "+
+			"report ready; set on nodes only, the controller never mounts",
+	)
+	probeClusters = flag.Bool(
+		"probe-clusters",
+		false,
+		"only report healthy on /healthz when the clusters of this driver's StorageClasses are "+
+			"reachable, for use as a readiness check; Probe never checks clusters",
+	)
+	nodeOnly = flag.Bool(
+		"node-only",
+		false,
+		"only serve the node side, without Kubernetes API access; set in the node DaemonSet",
+	)
+
+	quotaUsageInterval = flag.Duration(
+		"quota-usage-interval",
+		0,
+		"how often the controller exports volume quota usage as metrics, disabled if 0",
+	)
+
+	orphanScanInterval = flag.Duration(
+		"orphan-scan-interval",
+		0,
+		"how often the controller reports volume directories no PV references, disabled if 0",
+	)
+	orphanDeleteAfter = flag.Duration(
+		"orphan-delete-after",
+		0,
+		"tree delete volume directories orphaned for this long whose PVs this controller saw "+
+			"provisioned, only report them if 0",
+	)
+
+	restCorrelationHeader = flag.String(
+		"rest-correlation-header",
+		"",
+		"header to send each CSI call's correlation ID to Qumulo in, e.g. X-Request-ID",
+	)
+	restRetryAttempts = flag.Int(
+		"rest-retry-attempts",
+		qumulo.DefaultRetryPolicy.MaxAttempts,
+		"attempts at a Qumulo REST request on transient failures, 1 disables retries",
+	)
+	restRetryBudget = flag.Duration(
+		"rest-retry-budget",
+		qumulo.DefaultRetryPolicy.Budget,
+		"time after which a failing Qumulo REST request is no longer retried",
+	)
 )
 
 func init() {
@@ -62,6 +135,54 @@ func handle() {
 		parsedPerm = &permu32
 	}
 
+	if *metricsAddress != "" {
+		qumulo.ServeMetrics(*metricsAddress)
+	}
+
+	if *otlpEndpoint != "" {
+		shutdown, err := qumulo.SetupTracing(
+			context.Background(),
+			*otlpEndpoint,
+			*otlpInsecure,
+			*driverName,
+		)
+		if err != nil {
+			klog.Fatalf("Failed to set up tracing: %v", err)
+		}
+		defer shutdown(context.Background())
+	}
+
 	d := qumulo.NewDriver(*nodeID, *driverName, *endpoint, parsedPerm)
+
+	retryPolicy := qumulo.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = *restRetryAttempts
+	retryPolicy.Budget = *restRetryBudget
+	d.SetRetryPolicy(retryPolicy)
+	d.SetCorrelationHeader(*restCorrelationHeader)
+	d.SetQuotaUsageInterval(*quotaUsageInterval)
+	d.SetOrphanCollection(*orphanScanInterval, *orphanDeleteAfter)
+	d.SetProbeClusters(*probeClusters)
+	if *mountHelpers != "" {
+		d.SetMountHelpers(strings.Split(*mountHelpers, ","))
+	}
+
+	// Only the controller talks to the Kubernetes API, e.g. to post events.
+	if !*nodeOnly {
+		kubeClient, err := qumulo.GetKubeClient(*kubeconfig)
+		if err != nil {
+			klog.Warningf("Kubernetes API access not available: %v", err)
+		} else {
+			d.SetKubeClient(kubeClient)
+		}
+	}
+
+	if *probeClusters && *healthAddress == "" {
+		klog.Warning("--probe-clusters only affects /healthz, which needs --health-address")
+	}
+
+	if *healthAddress != "" {
+		d.ServeHealth(*healthAddress)
+	}
+
 	d.Run(false)
 }
@@ -0,0 +1,298 @@
+package qumulo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The parts of a volume ID, for tools which inspect and manage volumes outside of the driver.
+type VolumeInfo struct {
+	ID                 string `json:"id"`
+	Server             string `json:"server"`
+	RestPort           int    `json:"restPort"`
+	StoreRealPath      string `json:"storeRealPath"`
+	StoreMountPath     string `json:"storeMountPath"`
+	Name               string `json:"name"`
+	SnapshotPolicy     string `json:"snapshotPolicy,omitempty"`
+	Adopted            bool   `json:"adopted,omitempty"`
+	NamespaceDirectory bool   `json:"namespaceDirectory,omitempty"`
+	Replicated         bool   `json:"replicated,omitempty"`
+
+	// Derived from the fields above, ignored by EncodeVolumeID.
+	RealPath  string `json:"realPath"`
+	SharePath string `json:"sharePath"`
+}
+
+func DecodeVolumeID(id string) (VolumeInfo, error) {
+	vol, err := makeQumuloVolumeFromID(id)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+
+	info := VolumeInfo{
+		ID:                 vol.id,
+		Server:             vol.server,
+		RestPort:           vol.restPort,
+		StoreRealPath:      vol.storeRealPath,
+		StoreMountPath:     vol.storeMountPath,
+		Name:               vol.name,
+		SnapshotPolicy:     vol.snapshotPolicy,
+		Adopted:            vol.adopted,
+		NamespaceDirectory: vol.namespaceDirectory,
+		Replicated:         vol.replicated,
+		RealPath:           vol.getVolumeRealPath(),
+		SharePath:          vol.getVolumeSharePath(),
+	}
+
+	return info, nil
+}
+
+// The volume ID the driver would give info, e.g. for a static PV. Fails if the ID wouldn't
+// decode to the same volume.
+func EncodeVolumeID(info VolumeInfo) (string, error) {
+	if info.Server == "" || info.Name == "" {
+		return "", errors.New("server and name are required")
+	}
+	if info.RestPort == 0 {
+		info.RestPort = 8000
+	}
+	if !strings.HasPrefix(info.StoreRealPath, "/") ||
+		!strings.HasPrefix(info.StoreMountPath, "/") {
+		return "", errors.New("store paths must start with a '/'")
+	}
+
+	vol := &qumuloVolume{
+		server:             info.Server,
+		restPort:           info.RestPort,
+		storeRealPath:      info.StoreRealPath,
+		storeMountPath:     info.StoreMountPath,
+		name:               info.Name,
+		snapshotPolicy:     info.SnapshotPolicy,
+		adopted:            info.Adopted,
+		namespaceDirectory: info.NamespaceDirectory,
+		replicated:         info.Replicated,
+	}
+
+	id := vol.makeID()
+
+	decoded, err := DecodeVolumeID(id)
+	if err != nil {
+		return "", err
+	}
+	info.ID = id
+	info.RealPath = decoded.RealPath
+	info.SharePath = decoded.SharePath
+	if !reflect.DeepEqual(decoded, info) {
+		return "", fmt.Errorf("volume ID %q would not decode to the same volume", id)
+	}
+
+	return id, nil
+}
+
+// A volume directory on a cluster, with its quota.
+type VolumeDirectory struct {
+	Path string `json:"path"`
+	Id   string `json:"id"`
+
+	// Zero if the cluster didn't report it.
+	Created time.Time `json:"created"`
+
+	// Zero if the directory has no quota.
+	QuotaLimit    uint64 `json:"quotaLimit"`
+	CapacityUsage uint64 `json:"capacityUsage"`
+}
+
+func GetVolumeDirectory(
+	ctx context.Context,
+	connection *Connection,
+	path string,
+) (VolumeDirectory, error) {
+	attributes, err := connection.LookUp(ctx, path)
+	if err != nil {
+		return VolumeDirectory{}, err
+	}
+
+	directory := VolumeDirectory{
+		Path:    filepath.Clean(path),
+		Id:      attributes.Id,
+		Created: attributes.CreationTime,
+	}
+
+	quota, err := connection.QuotaStatusGet(ctx, attributes.Id)
+	if errorIsRestErrorWithStatus(err, 404) {
+		return directory, nil
+	}
+	if err != nil {
+		return VolumeDirectory{}, err
+	}
+
+	directory.QuotaLimit = quota.Limit
+	directory.CapacityUsage = quota.CapacityUsage
+
+	return directory, nil
+}
+
+// The volume directories under storeRealPath, looking one level deeper for the directories of
+// a StorageClass with namespace directories.
+func ListVolumeDirectories(
+	ctx context.Context,
+	connection *Connection,
+	storeRealPath string,
+	namespaceDirectories bool,
+) ([]VolumeDirectory, error) {
+	storeRealPath = filepath.Clean(storeRealPath)
+
+	entries, err := connection.ListDirAll(ctx, storeRealPath)
+	if err != nil {
+		return nil, err
+	}
+
+	directories := []VolumeDirectory{}
+
+	addDirectories := func(dir string, entries []FileAttributes) {
+		for _, entry := range entries {
+			if entry.Type == "FS_FILE_TYPE_DIRECTORY" &&
+				strings.HasPrefix(entry.Name, volumeNamePrefix) {
+				directories = append(directories, VolumeDirectory{
+					Path:    filepath.Join(dir, entry.Name),
+					Id:      entry.Id,
+					Created: entry.CreationTime,
+				})
+			}
+		}
+	}
+
+	addDirectories(storeRealPath, entries)
+
+	if namespaceDirectories {
+		for _, entry := range entries {
+			if entry.Type != "FS_FILE_TYPE_DIRECTORY" ||
+				strings.HasPrefix(entry.Name, volumeNamePrefix) {
+				continue
+			}
+
+			dir := filepath.Join(storeRealPath, entry.Name)
+			namespaceEntries, err := connection.ListDirAll(ctx, dir)
+			if err != nil {
+				return nil, err
+			}
+			addDirectories(dir, namespaceEntries)
+		}
+	}
+
+	if len(directories) == 0 {
+		return directories, nil
+	}
+
+	quotas, err := connection.QuotaStatusList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := map[string]QuotaStatus{}
+	for _, quota := range quotas {
+		byPath[filepath.Clean(quota.Path)] = quota
+	}
+	for i := range directories {
+		quota := byPath[directories[i].Path]
+		directories[i].QuotaLimit = quota.Limit
+		directories[i].CapacityUsage = quota.CapacityUsage
+	}
+
+	return directories, nil
+}
+
+// The result of one check of a StorageClass.
+type ParameterCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+func makeParameterCheck(name string, err error) ParameterCheck {
+	if err != nil {
+		return ParameterCheck{Name: name, Passed: false, Error: err.Error()}
+	}
+	return ParameterCheck{Name: name, Passed: true}
+}
+
+// Check the parameters of a StorageClass the way CreateVolume would, without creating
+// anything. connect is given the cluster named by the parameters. Checks after the first
+// failure which they depend on are left out.
+func CheckStorageClass(
+	ctx context.Context,
+	parameters map[string]string,
+	connect func(server string, restPort int) (*Connection, error),
+) []ParameterCheck {
+	// The provisioner strips its own parameters and, with --extra-create-metadata, adds the
+	// PVC's.
+	params := map[string]string{pvcNameKey: "check", pvcNamespaceKey: "default"}
+	for k, v := range parameters {
+		if !strings.HasPrefix(k, "csi.storage.k8s.io/") {
+			params[k] = v
+		}
+	}
+
+	createParams, err := newCreateParams(volumeNamePrefix+"check", params)
+	checks := []ParameterCheck{makeParameterCheck("parameters", err)}
+	if err != nil {
+		return checks
+	}
+
+	connection, err := connect(createParams.server, createParams.restPort)
+	if err == nil {
+		err = connection.Login(ctx)
+	}
+	checks = append(checks, makeParameterCheck("login", err))
+	if err != nil {
+		return checks
+	}
+
+	err = checkClusterVersion(ctx, connection)
+	checks = append(checks, makeParameterCheck("cluster version", err))
+	if err != nil {
+		return checks
+	}
+
+	_, err = newQumuloVolume(ctx, createParams, connection)
+	checks = append(checks, makeParameterCheck(paramStoreExportPath, err))
+
+	checks = append(
+		checks,
+		makeParameterCheck(
+			paramStoreRealPath,
+			checkDirectory(ctx, connection, createParams.storeRealPath),
+		),
+	)
+
+	if createParams.snapshotPolicy != "" {
+		_, _, err = connection.SnapshotPolicyGet(ctx, createParams.snapshotPolicy)
+		checks = append(checks, makeParameterCheck(paramSnapshotPolicy, err))
+	}
+
+	if createParams.aclTemplatePath != "" {
+		_, err = connection.AclGet(ctx, createParams.aclTemplatePath)
+		checks = append(checks, makeParameterCheck(paramAclTemplatePath, err))
+	}
+
+	return checks
+}
+
+func checkDirectory(ctx context.Context, connection *Connection, path string) error {
+	attributes, err := connection.LookUp(ctx, path)
+	if errorIsRestErrorWithStatus(err, 404) {
+		return fmt.Errorf("directory %q not found", path)
+	}
+	if err != nil {
+		return err
+	}
+	if attributes.Type != "FS_FILE_TYPE_DIRECTORY" {
+		return fmt.Errorf("%q is not a directory", path)
+	}
+	return nil
+}
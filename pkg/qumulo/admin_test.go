@@ -0,0 +1,239 @@
+package qumulo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeIDRoundTrip(t *testing.T) {
+	cases := []string{
+		"v1:1.2.3.4:8000//a//a//pvc-1",
+		"v1:qumulo:44//some/dir//export/dir//pvc-1",
+		"v2:1.2.3.4:8000//a/team-a//a/team-a//pvc-1//namespacedirectory=true",
+		"v2:1.2.3.4:8000//a//a//pvc-1//adopted=true&snapshotpolicy=2",
+		"v2:1.2.3.4:8000//a//a//pvc-1//replicated=true",
+	}
+
+	for _, id := range cases {
+		id := id //pin
+		t.Run(id, func(t *testing.T) {
+			info, err := DecodeVolumeID(id)
+			assert.NoError(t, err)
+			assert.Equal(t, info.ID, id)
+
+			encoded, err := EncodeVolumeID(info)
+			assert.NoError(t, err)
+			assert.Equal(t, encoded, id)
+		})
+	}
+}
+
+func TestDecodeVolumeID(t *testing.T) {
+	id := "v2:1.2.3.4:44//a/team-a//export/team-a//pvc-1//namespacedirectory=true"
+	info, err := DecodeVolumeID(id)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		info,
+		VolumeInfo{
+			ID:                 id,
+			Server:             "1.2.3.4",
+			RestPort:           44,
+			StoreRealPath:      "/a/team-a",
+			StoreMountPath:     "/export/team-a",
+			Name:               "pvc-1",
+			NamespaceDirectory: true,
+			RealPath:           "/a/team-a/pvc-1",
+			SharePath:          "/export/team-a/pvc-1",
+		},
+	)
+
+	_, err = DecodeVolumeID("junk")
+	assert.EqualError(t, err, "Could not decode volume ID \"junk\"")
+}
+
+func TestEncodeVolumeIDInvalid(t *testing.T) {
+	cases := []struct {
+		name     string
+		info     VolumeInfo
+		expected string
+	}{
+		{
+			name:     "no server",
+			info:     VolumeInfo{StoreRealPath: "/a", StoreMountPath: "/a", Name: "pvc-1"},
+			expected: "server and name are required",
+		},
+		{
+			name:     "relative path",
+			info:     VolumeInfo{Server: "q", StoreRealPath: "a", StoreMountPath: "/a", Name: "pvc-1"},
+			expected: "store paths must start with a '/'",
+		},
+		{
+			name:     "slash in name",
+			info:     VolumeInfo{Server: "q", StoreRealPath: "/a", StoreMountPath: "/a", Name: "x/y"},
+			expected: "Could not decode volume ID \"v1:q:8000//a//a//x/y\"",
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			_, err := EncodeVolumeID(test.info)
+			assert.EqualError(t, err, test.expected)
+		})
+	}
+}
+
+func TestGetVolumeDirectory(t *testing.T) {
+	messages := []Message{
+		{
+			"/v1/files/%2Fa%2Fpvc-1/info/attributes",
+			200,
+			"",
+			"{\"id\": \"9\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", \"mode\": \"0777\"}",
+		},
+		{
+			"/v1/files/quotas/status/9",
+			200,
+			"",
+			"{\"id\": \"9\", \"path\": \"/a/pvc-1/\", \"limit\": \"1000\", \"capacity_usage\": \"10\"}",
+		},
+		{
+			"/v1/files/%2Fa%2Fpvc-2/info/attributes",
+			200,
+			"",
+			"{\"id\": \"12\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", \"mode\": \"0777\"}",
+		},
+		{"/v1/files/quotas/status/12", 404, "", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+
+	directory, err := GetVolumeDirectory(context.TODO(), &connection, "/a/pvc-1")
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		directory,
+		VolumeDirectory{Path: "/a/pvc-1", Id: "9", QuotaLimit: 1000, CapacityUsage: 10},
+	)
+
+	directory, err = GetVolumeDirectory(context.TODO(), &connection, "/a/pvc-2")
+	assert.NoError(t, err)
+	assert.Equal(t, directory, VolumeDirectory{Path: "/a/pvc-2", Id: "12"})
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestCheckStorageClass(t *testing.T) {
+	parameters := map[string]string{
+		"server":          "1.2.3.4",
+		"restport":        "44",
+		"storerealpath":   "/a",
+		"storeexportpath": "/export",
+		"csi.storage.k8s.io/provisioner-secret-name":      "qumulo-login",
+		"csi.storage.k8s.io/provisioner-secret-namespace": "kube-system",
+	}
+
+	cases := []struct {
+		name       string
+		parameters map[string]string
+		messages   []Message
+		expected   []ParameterCheck
+	}{
+		{
+			name:       "valid",
+			parameters: parameters,
+			messages: []Message{
+				{"/v1/session/login", 200, "{\"username\":\"bob\",\"password\":\"yeruncle\"}", "{}"},
+				{"/v1/version", 200, "", "{\"revision_id\": \"Qumulo Core 4.3.0\"}"},
+				{"/v2/nfs/exports/%2Fexport", 200, "", "{\"id\": \"3\", \"fs_path\": \"/\"}"},
+				{
+					"/v1/files/%2Fa/info/attributes",
+					200,
+					"",
+					"{\"id\": \"2\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", \"mode\": \"0777\"}",
+				},
+			},
+			expected: []ParameterCheck{
+				{Name: "parameters", Passed: true},
+				{Name: "login", Passed: true},
+				{Name: "cluster version", Passed: true},
+				{Name: "storeexportpath", Passed: true},
+				{Name: "storerealpath", Passed: true},
+			},
+		},
+		{
+			name:       "invalid parameter",
+			parameters: map[string]string{"server": "1.2.3.4", "storerealpath": "/a", "x": "y"},
+			expected: []ParameterCheck{
+				{
+					Name:   "parameters",
+					Passed: false,
+					Error:  "rpc error: code = InvalidArgument desc = invalid parameter \"x\"",
+				},
+			},
+		},
+		{
+			name:       "login failed",
+			parameters: parameters,
+			messages: []Message{
+				{"/v1/session/login", 401, "{\"username\":\"bob\",\"password\":\"yeruncle\"}", ""},
+			},
+			expected: []ParameterCheck{
+				{Name: "parameters", Passed: true},
+				{
+					Name:   "login",
+					Passed: false,
+					Error:  "rpc error: code = Unauthenticated desc = Login failed: 401",
+				},
+			},
+		},
+		{
+			name:       "export mismatch and directory missing",
+			parameters: parameters,
+			messages: []Message{
+				{"/v1/session/login", 200, "{\"username\":\"bob\",\"password\":\"yeruncle\"}", "{}"},
+				{"/v1/version", 200, "", "{\"revision_id\": \"Qumulo Core 4.3.0\"}"},
+				{"/v2/nfs/exports/%2Fexport", 200, "", "{\"id\": \"3\", \"fs_path\": \"/b\"}"},
+				{"/v1/files/%2Fa/info/attributes", 404, "", ""},
+			},
+			expected: []ParameterCheck{
+				{Name: "parameters", Passed: true},
+				{Name: "login", Passed: true},
+				{Name: "cluster version", Passed: true},
+				{
+					Name:   "storeexportpath",
+					Passed: false,
+					Error: "rpc error: code = InvalidArgument desc = Volume directory \"/a\" would " +
+						"not be accessible via export \"/export\" fs_path \"/b\"",
+				},
+				{Name: "storerealpath", Passed: false, Error: "directory \"/a\" not found"},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			messages := test.messages
+			connect := func(server string, restPort int) (*Connection, error) {
+				assert.Equal(t, server, "1.2.3.4")
+				assert.Equal(t, restPort, 44)
+				connection := MakeConnection(
+					server,
+					restPort,
+					"bob",
+					"yeruncle",
+					newTestClient(t, server, restPort, &messages),
+				)
+				return &connection, nil
+			}
+
+			checks := CheckStorageClass(context.TODO(), test.parameters, connect)
+			assert.Equal(t, checks, test.expected)
+			assertMessagesConsumed(t, messages)
+		})
+	}
+}
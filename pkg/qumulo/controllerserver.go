@@ -18,7 +18,7 @@ package qumulo
 
 import (
 	"fmt"
-	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -30,14 +30,16 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
-	"k8s.io/klog/v2"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // XXX scott:
 // o use better version of semver than blang
 // o GetCapacity
 // o add copyright to all files
-// o cache connections? 1 user at a time - could use auth file too
 // o look at fsGroupPolicy
 //   - docs/examples removed circa 3/10
 //   - default is none, we probably don't want it, maybe explicit?
@@ -46,7 +48,12 @@ type ControllerServer struct {
 	Driver *Driver
 }
 
-func createConnection(server string, restPort int, secrets map[string]string) (*Connection, error) {
+func (cs *ControllerServer) createConnection(
+	ctx context.Context,
+	server string,
+	restPort int,
+	secrets map[string]string,
+) (*Connection, error) {
 	username := secrets["username"]
 	password := secrets["password"]
 
@@ -54,42 +61,80 @@ func createConnection(server string, restPort int, secrets map[string]string) (*
 		return nil, status.Error(codes.Unauthenticated, "username and password secrets missing")
 	}
 
-	c := MakeConnection(server, restPort, username, password, new(http.Client))
-
-	versionInfo, err := c.GetVersionInfo()
+	tlsOptions, err := getTLSOptions(secrets)
 	if err != nil {
 		return nil, err
 	}
 
+	return cs.Driver.sessions.Get(
+		ctx,
+		server,
+		restPort,
+		username,
+		password,
+		tlsOptions,
+		checkClusterVersion,
+	)
+}
+
+func getTLSOptions(secrets map[string]string) (TLSOptions, error) {
+	options := TLSOptions{
+		CACert:     []byte(secrets[secretCACert]),
+		ServerName: secrets[secretServerName],
+	}
+
+	if value := secrets[secretInsecure]; value != "" {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			return options, status.Errorf(
+				codes.InvalidArgument,
+				"invalid %s %q in secret",
+				secretInsecure,
+				value,
+			)
+		}
+		options.Insecure = insecure
+	}
+
+	if len(options.CACert) != 0 {
+		_, err := NewHTTPClient(options)
+		if err != nil {
+			return options, status.Errorf(
+				codes.InvalidArgument,
+				"invalid %s in secret: %v",
+				secretCACert,
+				err,
+			)
+		}
+	}
+
+	return options, nil
+}
+
+func checkClusterVersion(ctx context.Context, c *Connection) error {
+	versionInfo, err := c.GetVersionInfo(ctx)
+	if err != nil {
+		return transFormRestErrorf(err, map[int]error{}, "Failed to get version of %s", c.Host)
+	}
+
 	version, err := versionInfo.GetSemanticVersion()
 	if err != nil {
-		return nil, err
+		return transFormRestErrorf(err, map[int]error{}, "Failed to get version of %s", c.Host)
 	}
 
 	minimumVersion := semver.Version{Major: 4, Minor: 2, Patch: 4}
 
 	if version.LT(minimumVersion) {
-		return nil, status.Errorf(
-			codes.FailedPrecondition, "Cluster version %v must be >= %v", version, minimumVersion,
+		return withRemediation(
+			status.Errorf(
+				codes.FailedPrecondition, "Cluster version %v must be >= %v", version, minimumVersion,
+			),
+			eventReasonClusterVersion,
+			fmt.Sprintf("Upgrade cluster %s to Qumulo Core %v or later", c.Host, minimumVersion),
 		)
 	}
 
-	return &c, nil
-}
-
-func transFormRestError(err error, transforms map[int]error) error {
-	switch err.(type) {
-	case RestError:
-		z := err.(RestError)
-		for handledStatus, handledErr := range transforms {
-			if z.StatusCode == handledStatus {
-				return handledErr
-			}
-		}
-		return status.Errorf(codes.Internal, "Unhandled Error: %v", err.Error())
-	}
-
-	return err
+	return nil
 }
 
 type CreateParams struct {
@@ -98,6 +143,34 @@ type CreateParams struct {
 	storeRealPath   string
 	storeExportPath string
 	name            string
+	snapshotPolicy  string
+	replication     *replicationTarget
+	aclTemplate     *FileAcl
+	aclTemplatePath string
+
+	// From --extra-create-metadata, may be empty.
+	pvcName      string
+	pvcNamespace string
+	pvName       string
+
+	namespaceDirectories bool
+	namespaceQuota       uint64
+}
+
+// Where and how a volume directory is replicated to a second cluster.
+type replicationTarget struct {
+	// Address of the target cluster (paramReplicationTarget).
+	server string
+
+	// REST API port on the target cluster (paramReplicationTargetRestPort).
+	restPort int
+
+	// Directory on the target cluster volumes are replicated under (paramReplicationTargetPath).
+	path string
+
+	// Secret with credentials for the target cluster.
+	secretName      string
+	secretNamespace string
 }
 
 // An internal representation of a volume created by the provisioner.
@@ -119,8 +192,38 @@ type qumuloVolume struct {
 
 	// Volume name (directory name created under storeRealPath and storeMountPath) - from req name.
 	name string
+
+	// Snapshot policy the volume directory is protected by (paramSnapshotPolicy), may be empty.
+	snapshotPolicy string
+
+	// Whether the volume directory is replicated to another cluster. Only this is recorded in
+	// the volume ID, the target itself is given by the StorageClass so replication is nil
+	// until looked up with lookUpReplicationTarget, except when creating the volume.
+	replicated  bool
+	replication *replicationTarget
+
+	// A pre-existing directory adopted through a static PV. The driver manages its quota but
+	// never deletes it.
+	adopted bool
+
+	// storeRealPath is a per-namespace directory which is removed with its last volume.
+	namespaceDirectory bool
 }
 
+const (
+	// Volume ID option marking an adopted directory, only ever written by hand in a static PV.
+	volumeOptionAdopted = "adopted"
+
+	// Volume ID option marking a volume in a per-namespace directory.
+	volumeOptionNamespaceDirectory = "namespacedirectory"
+
+	// Volume ID option marking a volume replicated to the target of its StorageClass.
+	volumeOptionReplicated = "replicated"
+
+	// The longest volume ID the CSI spec allows.
+	maxVolumeIdLength = 128
+)
+
 func getQuotaLimit(capacityRange *csi.CapacityRange) (uint64, error) {
 	if capacityRange == nil {
 		return 0, status.Error(codes.InvalidArgument, "CapacityRange must be provided")
@@ -147,6 +250,24 @@ func getQuotaLimit(capacityRange *csi.CapacityRange) (uint64, error) {
 func (cs *ControllerServer) CreateVolume(
 	ctx context.Context,
 	req *csi.CreateVolumeRequest,
+) (*csi.CreateVolumeResponse, error) {
+	resp, err := cs.createVolume(ctx, req)
+	if err != nil {
+		params := req.GetParameters()
+		err = cs.recordFailureEvent(
+			ctx,
+			params[pvcNamespaceKey],
+			params[pvcNameKey],
+			eventReasonProvisioningFailed,
+			err,
+		)
+	}
+	return resp, err
+}
+
+func (cs *ControllerServer) createVolume(
+	ctx context.Context,
+	req *csi.CreateVolumeRequest,
 ) (*csi.CreateVolumeResponse, error) {
 	name := req.GetName()
 
@@ -173,27 +294,72 @@ func (cs *ControllerServer) CreateVolume(
 		return nil, err
 	}
 
-	connection, err := createConnection(params.server, params.restPort, req.GetSecrets())
+	connection, err := cs.createConnection(ctx, params.server, params.restPort, req.GetSecrets())
 	if err != nil {
 		return nil, err
 	}
 
-	qVol, err := newQumuloVolume(params, connection)
+	qVol, err := newQumuloVolume(ctx, params, connection)
 	if err != nil {
 		return nil, err
 	}
 
-	attributes, err := connection.EnsureDir(qVol.storeRealPath, qVol.name)
+	if len(qVol.id) > maxVolumeIdLength {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"Volume ID %q is longer than %d bytes, use a shorter %s, %s or %s",
+			qVol.id,
+			maxVolumeIdLength,
+			paramServer,
+			paramStoreRealPath,
+			paramStoreExportPath,
+		)
+	}
+
+	if qVol.snapshotPolicy != "" {
+		// Reject a bad policy before anything is created.
+		_, _, err = connection.SnapshotPolicyGet(ctx, qVol.snapshotPolicy)
+		if err != nil {
+			return nil, transFormRestError(
+				err,
+				map[int]error{
+					404: status.Errorf(
+						codes.NotFound,
+						"Snapshot policy %q not found",
+						qVol.snapshotPolicy,
+					),
+				},
+			)
+		}
+	}
+
+	if qVol.namespaceDirectory {
+		err = cs.ensureNamespaceDirectory(ctx, connection, params, qVol)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	attributes, err := connection.EnsureDir(ctx, qVol.storeRealPath, qVol.name)
 	if err != nil {
 		return nil, transFormRestError(
 			err,
 			map[int]error{
-				404: status.Errorf(
-					codes.NotFound,
-					"%s directory %q missing for volume %q",
-					paramStoreRealPath,
-					qVol.storeRealPath,
-					qVol.id,
+				404: withRemediation(
+					status.Errorf(
+						codes.NotFound,
+						"%s directory %q missing for volume %q",
+						paramStoreRealPath,
+						qVol.storeRealPath,
+						qVol.id,
+					),
+					eventReasonDirectoryMissing,
+					fmt.Sprintf(
+						"Create directory %q on cluster %s, or fix %s in the StorageClass",
+						qVol.storeRealPath,
+						qVol.server,
+						paramStoreRealPath,
+					),
 				),
 				409: status.Errorf(
 					codes.AlreadyExists,
@@ -205,21 +371,44 @@ func (cs *ControllerServer) CreateVolume(
 		)
 	}
 
-	err = connection.EnsureQuota(attributes.Id, quotaLimit)
+	err = connection.EnsureQuota(ctx, attributes.Id, quotaLimit)
 	if err != nil {
-		return nil, status.Errorf(
-			codes.Internal,
-			"Failed to set quota on %v: %v",
-			qVol.id,
-			err.Error(),
-		)
+		return nil, transFormRestErrorf(err, map[int]error{}, "Failed to set quota on %v", qVol.id)
 	}
 
-	attributes, err = connection.FileChmod(attributes.Id, "0777")
+	if params.aclTemplate != nil || params.aclTemplatePath != "" {
+		err = applyAclTemplate(ctx, connection, params, attributes.Id)
+	} else {
+		attributes, err = connection.FileChmod(ctx, attributes.Id, "0777")
+		err = transFormRestErrorf(err, map[int]error{}, "Failed to set mode of %v", qVol.id)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if qVol.snapshotPolicy != "" {
+		err = connection.SnapshotPolicyAddSource(ctx, qVol.snapshotPolicy, attributes.Id)
+		if err != nil {
+			return nil, transFormRestError(
+				err,
+				map[int]error{
+					404: status.Errorf(
+						codes.NotFound,
+						"Snapshot policy %q not found",
+						qVol.snapshotPolicy,
+					),
+				},
+			)
+		}
+	}
+
+	if qVol.replication != nil {
+		err = cs.ensureReplication(ctx, connection, qVol, attributes.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &csi.CreateVolumeResponse{Volume: qVol.qumuloVolumeToCSIVolume()}, nil
 }
 
@@ -236,23 +425,63 @@ func (cs *ControllerServer) DeleteVolume(
 	qVol, err := makeQumuloVolumeFromID(volumeID)
 	if err != nil {
 		// An invalid ID should be treated as doesn't exist
-		klog.Warningf("failed to get Qumulo volume for volume id %v deletion: %v", volumeID, err)
+		logInfo(ctx, 0, "Invalid volume ID, treating it as deleted", "err", err)
 		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	connection, err := createConnection(qVol.server, qVol.restPort, req.GetSecrets())
+	if qVol.adopted {
+		logInfo(
+			ctx,
+			2,
+			"Volume is an adopted directory, leaving it in place",
+			"path",
+			qVol.getVolumeRealPath(),
+		)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	connection, err := cs.createConnection(ctx, qVol.server, qVol.restPort, req.GetSecrets())
 	if err != nil {
 		return nil, err
 	}
 
 	path := qVol.getVolumeRealPath()
-	klog.V(2).Infof("Removing subdirectory at %v with tree delete", path)
 
-	err = connection.TreeDeleteCreate(path)
+	if qVol.snapshotPolicy != "" {
+		attributes, err := connection.LookUp(ctx, path)
+		if err == nil {
+			err = connection.SnapshotPolicyRemoveSource(ctx, qVol.snapshotPolicy, attributes.Id)
+		}
+		if err != nil && !errorIsRestErrorWithStatus(err, 404) {
+			return nil, transFormRestError(err, map[int]error{})
+		}
+	}
+
+	if qVol.replicated {
+		// Only the source side is removed; the replicated copy is kept on the target.
+		attributes, err := connection.LookUp(ctx, path)
+		if err == nil {
+			err = connection.ReplicationSourceDeleteForRoot(ctx, attributes.Id)
+		}
+		if err != nil && !errorIsRestErrorWithStatus(err, 404) {
+			return nil, transFormRestError(err, map[int]error{})
+		}
+	}
+
+	logInfo(ctx, 2, "Removing subdirectory with tree delete", "path", path)
+
+	err = connection.TreeDeleteCreate(ctx, path)
 	if err != nil {
 		return nil, transFormRestError(err, map[int]error{})
 	}
 
+	if qVol.namespaceDirectory {
+		err = removeNamespaceDirectory(ctx, connection, qVol)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -274,7 +503,46 @@ func (cs *ControllerServer) ControllerGetVolume(
 	ctx context.Context,
 	req *csi.ControllerGetVolumeRequest,
 ) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	qVol, err := makeQumuloVolumeFromID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Volume not found %q", volumeID)
+	}
+
+	// The request carries no secrets, so the volume is checked with those its PV references.
+	var pv *v1.PersistentVolume
+	if cs.Driver.kubeClient != nil {
+		pv, err = cs.findPersistentVolume(ctx, volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "Failed to list PVs: %v", err)
+		}
+	}
+
+	condition, err := cs.getDirectoryCondition(ctx, qVol, pv)
+	if err != nil {
+		return nil, err
+	}
+
+	if qVol.replicated && !condition.Abnormal {
+		qVol.replication, err = cs.lookUpReplicationTarget(ctx, volumeID, pv)
+		if err != nil {
+			return nil, err
+		}
+
+		condition, err = cs.getReplicationCondition(ctx, qVol)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: qVol.qumuloVolumeToCSIVolume(),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: condition},
+	}, nil
 }
 
 func (cs *ControllerServer) ValidateVolumeCapabilities(
@@ -342,6 +610,18 @@ func (cs *ControllerServer) ControllerExpandVolume(
 	ctx context.Context,
 	req *csi.ControllerExpandVolumeRequest,
 ) (*csi.ControllerExpandVolumeResponse, error) {
+	resp, err := cs.controllerExpandVolume(ctx, req)
+	if err != nil {
+		namespace, name := cs.findVolumeClaim(ctx, req.GetVolumeId())
+		err = cs.recordFailureEvent(ctx, namespace, name, eventReasonExpansionFailed, err)
+	}
+	return resp, err
+}
+
+func (cs *ControllerServer) controllerExpandVolume(
+	ctx context.Context,
+	req *csi.ControllerExpandVolumeRequest,
+) (*csi.ControllerExpandVolumeResponse, error) {
 
 	volumeID := req.GetVolumeId()
 	if volumeID == "" {
@@ -358,12 +638,12 @@ func (cs *ControllerServer) ControllerExpandVolume(
 		return nil, err
 	}
 
-	connection, err := createConnection(qVol.server, qVol.restPort, req.GetSecrets())
+	connection, err := cs.createConnection(ctx, qVol.server, qVol.restPort, req.GetSecrets())
 	if err != nil {
 		return nil, err
 	}
 
-	attributes, err := connection.LookUp(qVol.getVolumeRealPath())
+	attributes, err := connection.LookUp(ctx, qVol.getVolumeRealPath())
 	if err != nil {
 		return nil, transFormRestError(
 			err,
@@ -373,7 +653,7 @@ func (cs *ControllerServer) ControllerExpandVolume(
 		)
 	}
 
-	err = connection.EnsureQuota(attributes.Id, quotaLimit)
+	err = connection.EnsureQuota(ctx, attributes.Id, quotaLimit)
 	if err != nil {
 		return nil, transFormRestError(
 			err,
@@ -389,6 +669,492 @@ func (cs *ControllerServer) ControllerExpandVolume(
 	}, nil
 }
 
+// Create the namespace directory a volume is placed in and keep its quota up to date.
+func (cs *ControllerServer) ensureNamespaceDirectory(
+	ctx context.Context,
+	connection *Connection,
+	params *CreateParams,
+	qVol *qumuloVolume,
+) error {
+	attributes, err := connection.EnsureDir(ctx, params.storeRealPath, params.pvcNamespace)
+	if err != nil {
+		return transFormRestError(
+			err,
+			map[int]error{
+				404: withRemediation(
+					status.Errorf(
+						codes.NotFound,
+						"%s directory %q missing for volume %q",
+						paramStoreRealPath,
+						params.storeRealPath,
+						qVol.id,
+					),
+					eventReasonDirectoryMissing,
+					fmt.Sprintf(
+						"Create directory %q on cluster %s, or fix %s in the StorageClass",
+						params.storeRealPath,
+						params.server,
+						paramStoreRealPath,
+					),
+				),
+				409: status.Errorf(
+					codes.AlreadyExists,
+					"A non-directory entity exists at %q for namespace %q",
+					qVol.storeRealPath,
+					params.pvcNamespace,
+				),
+			},
+		)
+	}
+
+	quotaLimit, err := cs.getNamespaceQuota(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	if quotaLimit == 0 {
+		return nil
+	}
+
+	err = connection.EnsureQuota(ctx, attributes.Id, quotaLimit)
+	if err != nil {
+		return transFormRestErrorf(
+			err,
+			map[int]error{},
+			"Failed to set quota on namespace directory %q",
+			qVol.storeRealPath,
+		)
+	}
+
+	return nil
+}
+
+// The namespace annotation wins over the StorageClass so quotas can be set per tenant.
+func (cs *ControllerServer) getNamespaceQuota(
+	ctx context.Context,
+	params *CreateParams,
+) (uint64, error) {
+	if cs.Driver.kubeClient == nil {
+		return params.namespaceQuota, nil
+	}
+
+	namespace, err := cs.Driver.kubeClient.CoreV1().Namespaces().Get(
+		ctx,
+		params.pvcNamespace,
+		metav1.GetOptions{},
+	)
+	if err != nil {
+		return 0, status.Errorf(
+			codes.Internal,
+			"Failed to read namespace %q: %v",
+			params.pvcNamespace,
+			err,
+		)
+	}
+
+	value, ok := namespace.Annotations[namespaceQuotaAnnotation]
+	if !ok {
+		return params.namespaceQuota, nil
+	}
+
+	limit, err := parseQuota(value)
+	if err != nil {
+		return 0, status.Errorf(
+			codes.InvalidArgument,
+			"invalid %s annotation %q on namespace %q",
+			namespaceQuotaAnnotation,
+			value,
+			params.pvcNamespace,
+		)
+	}
+
+	return limit, nil
+}
+
+// Remove the namespace directory once its last volume is gone. Tree deletes are asynchronous
+// so while the volume directory is the only thing left Unavailable is returned to make the
+// provisioner retry. The directory is unlinked, not tree deleted, so a volume created
+// concurrently in the namespace can never be lost.
+func removeNamespaceDirectory(
+	ctx context.Context,
+	connection *Connection,
+	qVol *qumuloVolume,
+) error {
+	entries, err := connection.ListDir(ctx, qVol.storeRealPath, 2)
+	if errorIsRestErrorWithStatus(err, 404) {
+		return nil
+	}
+	if err != nil {
+		return transFormRestError(err, map[int]error{})
+	}
+
+	if len(entries) == 1 && entries[0].Name == qVol.name {
+		return status.Errorf(
+			codes.Unavailable,
+			"Waiting for tree delete of %q to remove namespace directory",
+			qVol.getVolumeRealPath(),
+		)
+	}
+
+	if len(entries) != 0 {
+		return nil
+	}
+
+	logInfo(ctx, 2, "Removing empty namespace directory", "path", qVol.storeRealPath)
+
+	err = connection.FileDelete(ctx, qVol.storeRealPath)
+	if err != nil && !errorIsRestErrorWithStatus(err, 404) &&
+		!errorIsRestErrorWithStatus(err, 409) {
+		return transFormRestError(err, map[int]error{})
+	}
+
+	return nil
+}
+
+func parseQuota(value string) (uint64, error) {
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return 0, err
+	}
+	if quantity.Sign() < 0 {
+		return 0, fmt.Errorf("quota must not be negative")
+	}
+	return uint64(quantity.Value()), nil
+}
+
+// Give a new volume directory the StorageClass's ACL instead of open mode bits.
+func applyAclTemplate(
+	ctx context.Context,
+	connection *Connection,
+	params *CreateParams,
+	dirId string,
+) error {
+	acl := params.aclTemplate
+
+	if params.aclTemplatePath != "" {
+		templateAcl, err := connection.AclGet(ctx, params.aclTemplatePath)
+		if err != nil {
+			return transFormRestError(
+				err,
+				map[int]error{
+					404: status.Errorf(
+						codes.NotFound,
+						"%s %q not found",
+						paramAclTemplatePath,
+						params.aclTemplatePath,
+					),
+				},
+			)
+		}
+		acl = &templateAcl
+	}
+
+	err := connection.EnsureAcl(ctx, dirId, *acl)
+	if err != nil {
+		return transFormRestError(
+			err,
+			map[int]error{
+				400: status.Errorf(
+					codes.InvalidArgument,
+					"ACL template rejected by cluster: %v",
+					err,
+				),
+			},
+		)
+	}
+
+	return nil
+}
+
+// Read a secret through the Kubernetes API.
+func (cs *ControllerServer) getSecrets(
+	ctx context.Context,
+	namespace string,
+	name string,
+) (map[string]string, error) {
+	if cs.Driver.kubeClient == nil {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"Cannot read secret %s/%s, Kubernetes API access not configured",
+			namespace,
+			name,
+		)
+	}
+
+	secret, err := cs.Driver.kubeClient.CoreV1().Secrets(namespace).Get(
+		ctx,
+		name,
+		metav1.GetOptions{},
+	)
+	if apierrors.IsNotFound(err) {
+		return nil, status.Errorf(codes.NotFound, "Secret %s/%s not found", namespace, name)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			"Failed to read secret %s/%s: %v",
+			namespace,
+			name,
+			err,
+		)
+	}
+
+	secrets := map[string]string{}
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	for k, v := range secret.StringData {
+		secrets[k] = v
+	}
+
+	return secrets, nil
+}
+
+func (cs *ControllerServer) createReplicationTargetConnection(
+	ctx context.Context,
+	target *replicationTarget,
+) (*Connection, error) {
+	secrets, err := cs.getSecrets(ctx, target.secretNamespace, target.secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cs.createConnection(ctx, target.server, target.restPort, secrets)
+}
+
+// The PV of volumeID, nil if there isn't one.
+func (cs *ControllerServer) findPersistentVolume(
+	ctx context.Context,
+	volumeID string,
+) (*v1.PersistentVolume, error) {
+	pvs, err := cs.Driver.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pvs.Items {
+		if pvs.Items[i].Spec.CSI != nil && pvs.Items[i].Spec.CSI.VolumeHandle == volumeID {
+			return &pvs.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Whether the volume directory exists, checked with the controller expand secret of its PV, nil
+// if there isn't one. The quota usage exporter reads quotas with the same secret.
+func (cs *ControllerServer) getDirectoryCondition(
+	ctx context.Context,
+	qVol *qumuloVolume,
+	pv *v1.PersistentVolume,
+) (*csi.VolumeCondition, error) {
+	if pv == nil || pv.Spec.CSI == nil || pv.Spec.CSI.ControllerExpandSecretRef == nil {
+		return &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  "Volume condition not monitored without a controller-expand-secret",
+		}, nil
+	}
+
+	secretRef := pv.Spec.CSI.ControllerExpandSecretRef
+	secrets, err := cs.getSecrets(ctx, secretRef.Namespace, secretRef.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	connection, err := cs.createConnection(ctx, qVol.server, qVol.restPort, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	path := qVol.getVolumeRealPath()
+	_, err = connection.LookUp(ctx, path)
+	if errorIsRestErrorWithStatus(err, 404) {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("Volume directory %s not found on %s", path, qVol.server),
+		}, nil
+	}
+	if err != nil {
+		return nil, transFormRestErrorf(err, map[int]error{}, "Failed to look up %s", path)
+	}
+
+	return &csi.VolumeCondition{Abnormal: false, Message: "Volume directory exists"}, nil
+}
+
+// The replication target of a replicated volume, from the StorageClass of its PV. StorageClass
+// parameters can't be changed, so this is the target the volume was created with.
+func (cs *ControllerServer) lookUpReplicationTarget(
+	ctx context.Context,
+	volumeID string,
+	pv *v1.PersistentVolume,
+) (*replicationTarget, error) {
+	if pv == nil || pv.Spec.StorageClassName == "" {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"Cannot look up replication target of volume %q without the StorageClass of its PV",
+			volumeID,
+		)
+	}
+
+	class, err := cs.Driver.kubeClient.StorageV1().StorageClasses().Get(
+		ctx,
+		pv.Spec.StorageClassName,
+		metav1.GetOptions{},
+	)
+	if apierrors.IsNotFound(err) {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"StorageClass %s of volume %q not found",
+			pv.Spec.StorageClassName,
+			volumeID,
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Unavailable,
+			"Failed to get StorageClass %s: %v",
+			pv.Spec.StorageClassName,
+			err,
+		)
+	}
+
+	target, err := newReplicationTarget(class.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"StorageClass %s of volume %q has no %s",
+			class.Name,
+			volumeID,
+			paramReplicationTarget,
+		)
+	}
+
+	return target, nil
+}
+
+// Set up a replication relationship for the volume directory and authorize it on the target.
+func (cs *ControllerServer) ensureReplication(
+	ctx context.Context,
+	connection *Connection,
+	qVol *qumuloVolume,
+	dirId string,
+) error {
+	targetRootPath := qVol.getVolumeReplicationTargetPath()
+
+	relationship, err := connection.ReplicationSourceEnsure(
+		ctx,
+		qVol.replication.server,
+		dirId,
+		targetRootPath,
+	)
+	if err != nil {
+		return transFormRestError(err, map[int]error{})
+	}
+
+	targetConnection, err := cs.createReplicationTargetConnection(ctx, qVol.replication)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := targetConnection.ReplicationTargetStatusList(ctx)
+	if err != nil {
+		return transFormRestError(err, map[int]error{})
+	}
+
+	for _, targetStatus := range statuses {
+		if targetStatus.Id != relationship.Id {
+			continue
+		}
+
+		if targetStatus.State != "AWAITING_AUTHORIZATION" {
+			return nil
+		}
+
+		err = targetConnection.ReplicationTargetAuthorize(ctx, relationship.Id)
+		if err != nil {
+			return transFormRestError(err, map[int]error{})
+		}
+		return nil
+	}
+
+	return status.Errorf(
+		codes.Unavailable,
+		"Replication relationship %s for volume %q not yet known to target %s",
+		relationship.Id,
+		qVol.id,
+		qVol.replication.server,
+	)
+}
+
+func (cs *ControllerServer) getReplicationCondition(
+	ctx context.Context,
+	qVol *qumuloVolume,
+) (*csi.VolumeCondition, error) {
+	targetConnection, err := cs.createReplicationTargetConnection(ctx, qVol.replication)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := targetConnection.ReplicationTargetStatusList(ctx)
+	if err != nil {
+		return nil, transFormRestError(err, map[int]error{})
+	}
+
+	targetRootPath := qVol.getVolumeReplicationTargetPath()
+
+	for _, targetStatus := range statuses {
+		if targetStatus.TargetRootPath != targetRootPath {
+			continue
+		}
+
+		if targetStatus.State != "ESTABLISHED" {
+			message := fmt.Sprintf(
+				"Replication to %s:%s is %s",
+				qVol.replication.server,
+				targetRootPath,
+				targetStatus.State,
+			)
+			if targetStatus.EndReason != "" {
+				message += ": " + targetStatus.EndReason
+			}
+			return &csi.VolumeCondition{Abnormal: true, Message: message}, nil
+		}
+
+		if targetStatus.ErrorFromLastJob != "" {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message: fmt.Sprintf(
+					"Replication to %s:%s failed: %s",
+					qVol.replication.server,
+					targetRootPath,
+					targetStatus.ErrorFromLastJob,
+				),
+			}, nil
+		}
+
+		return &csi.VolumeCondition{
+			Abnormal: false,
+			Message: fmt.Sprintf(
+				"Replicating to %s:%s",
+				qVol.replication.server,
+				targetRootPath,
+			),
+		}, nil
+	}
+
+	return &csi.VolumeCondition{
+		Abnormal: true,
+		Message: fmt.Sprintf(
+			"No replication relationship to %s:%s",
+			qVol.replication.server,
+			targetRootPath,
+		),
+	}, nil
+}
+
 func (cs *ControllerServer) validateVolumeCapabilities(caps []*csi.VolumeCapability) error {
 	if len(caps) == 0 {
 		return fmt.Errorf("volume capabilities must be provided")
@@ -429,7 +1195,15 @@ func newCreateParams(name string, params map[string]string) (*CreateParams, erro
 		server          string
 		storeRealPath   string
 		storeExportPath string
+		snapshotPolicy  string
 		restPort        int
+		aclTemplate     *FileAcl
+		aclTemplatePath string
+		pvcName         string
+		pvcNamespace    string
+		pvName          string
+		namespaceDirs   bool
+		namespaceQuota  uint64
 		err             error
 	)
 
@@ -450,6 +1224,61 @@ func newCreateParams(name string, params map[string]string) (*CreateParams, erro
 			if err != nil {
 				return nil, status.Errorf(codes.InvalidArgument, "invalid port %q", v)
 			}
+		case paramSnapshotPolicy:
+			if _, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					"invalid %s %q, must be a policy id",
+					paramSnapshotPolicy,
+					v,
+				)
+			}
+			snapshotPolicy = v
+		case paramAclTemplate:
+			acl, err := ParseFileAcl([]byte(v))
+			if err != nil {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					"invalid %s: %v",
+					paramAclTemplate,
+					err,
+				)
+			}
+			aclTemplate = &acl
+		case paramAclTemplatePath:
+			aclTemplatePath = v
+		case paramNamespaceDirectories:
+			namespaceDirs, err = strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					"invalid %s %q",
+					paramNamespaceDirectories,
+					v,
+				)
+			}
+		case paramNamespaceQuota:
+			namespaceQuota, err = parseQuota(v)
+			if err != nil {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					"invalid %s %q",
+					paramNamespaceQuota,
+					v,
+				)
+			}
+		case pvcNameKey:
+			pvcName = v
+		case pvcNamespaceKey:
+			pvcNamespace = v
+		case pvNameKey:
+			pvName = v
+		case paramReplicationTarget,
+			paramReplicationTargetRestPort,
+			paramReplicationTargetPath,
+			paramReplicationSecretName,
+			paramReplicationSecretNamespace:
+			// Parsed by newReplicationTarget.
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "invalid parameter %q", k)
 		}
@@ -502,70 +1331,295 @@ func newCreateParams(name string, params map[string]string) (*CreateParams, erro
 		storeExportPath = "/"
 	}
 
+	if aclTemplate != nil && aclTemplatePath != "" {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"only one of %s and %s may be given",
+			paramAclTemplate,
+			paramAclTemplatePath,
+		)
+	}
+
+	if aclTemplatePath != "" && !strings.HasPrefix(aclTemplatePath, "/") {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"%s (%q) must start with a '/'",
+			paramAclTemplatePath,
+			aclTemplatePath,
+		)
+	}
+
+	if namespaceDirs && pvcNamespace == "" {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"%s requires the provisioner to run with --extra-create-metadata",
+			paramNamespaceDirectories,
+		)
+	}
+
+	if namespaceQuota != 0 && !namespaceDirs {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"%s requires %s",
+			paramNamespaceQuota,
+			paramNamespaceDirectories,
+		)
+	}
+
 	ret := &CreateParams{
-		server:          server,
-		restPort:        restPort,
-		storeRealPath:   storeRealPath,
-		storeExportPath: storeExportPath,
-		name:            name,
+		server:               server,
+		restPort:             restPort,
+		storeRealPath:        storeRealPath,
+		storeExportPath:      storeExportPath,
+		name:                 name,
+		snapshotPolicy:       snapshotPolicy,
+		aclTemplate:          aclTemplate,
+		aclTemplatePath:      aclTemplatePath,
+		pvcName:              pvcName,
+		pvcNamespace:         pvcNamespace,
+		pvName:               pvName,
+		namespaceDirectories: namespaceDirs,
+		namespaceQuota:       namespaceQuota,
+	}
+
+	ret.replication, err = newReplicationTarget(params)
+	if err != nil {
+		return nil, err
 	}
 
 	return ret, nil
 }
 
+// The replication target given by StorageClass parameters, nil if they don't replicate.
+func newReplicationTarget(params map[string]string) (*replicationTarget, error) {
+	replication := replicationTarget{restPort: 8000}
+	replicated := false
+
+	var err error
+	for k, v := range params {
+		switch strings.ToLower(k) {
+		case paramReplicationTarget:
+			replication.server = v
+		case paramReplicationTargetRestPort:
+			replication.restPort, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid port %q", v)
+			}
+		case paramReplicationTargetPath:
+			replication.path = v
+		case paramReplicationSecretName:
+			replication.secretName = v
+		case paramReplicationSecretNamespace:
+			replication.secretNamespace = v
+		default:
+			continue
+		}
+		replicated = true
+	}
+
+	if !replicated {
+		return nil, nil
+	}
+
+	err = validateReplicationTarget(&replication)
+	if err != nil {
+		return nil, err
+	}
+
+	return &replication, nil
+}
+
+func validateReplicationTarget(replication *replicationTarget) error {
+	required := []struct {
+		name  string
+		value string
+	}{
+		{paramReplicationTarget, replication.server},
+		{paramReplicationTargetPath, replication.path},
+		{paramReplicationSecretName, replication.secretName},
+		{paramReplicationSecretNamespace, replication.secretNamespace},
+	}
+
+	for _, r := range required {
+		if r.value == "" {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"%s is required when replicating to another cluster",
+				r.name,
+			)
+		}
+	}
+
+	if !strings.HasPrefix(replication.path, "/") {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"%s (%q) must start with a '/'",
+			paramReplicationTargetPath,
+			replication.path,
+		)
+	}
+
+	replication.path = filepath.Clean(replication.path)
+
+	return nil
+}
+
 // Volume ID formats:
 // v1:server:restPort//storeRealPath//storeMountPath//name
+// v2:server:restPort//storeRealPath//storeMountPath//name//options
+//
+// A pre-existing directory can be adopted by a static PV with a handwritten v2 ID whose options
+// contain adopted=true; storeRealPath/name is then the directory and storeMountPath is unused.
+//
+// The v2 format is only used when a volume has options which DeleteVolume needs to know about.
+// options is a URL query string (paramSnapshotPolicy=...) so it never contains a '/'. Options
+// are kept short since the CSI spec limits IDs to maxVolumeIdLength bytes: a replicated volume
+// only records replicated=true, its target is looked up from the StorageClass of its PV.
+
+func newQumuloVolume(
+	ctx context.Context,
+	params *CreateParams,
+	connetion *Connection,
+) (*qumuloVolume, error) {
 
-func newQumuloVolume(params *CreateParams, connetion *Connection) (*qumuloVolume, error) {
-
-	export, err := connetion.ExportGet(params.storeExportPath)
+	export, _, err := connetion.ExportGet(ctx, params.storeExportPath)
 	if err != nil {
 		return nil, transFormRestError(
 			err,
 			map[int]error{
-				404: status.Errorf(codes.NotFound, "Export %q not found", params.storeExportPath),
+				404: withRemediation(
+					status.Errorf(codes.NotFound, "Export %q not found", params.storeExportPath),
+					eventReasonExportMissing,
+					fmt.Sprintf(
+						"Create NFS export %q on cluster %s, or fix %s in the StorageClass",
+						params.storeExportPath,
+						params.server,
+						paramStoreExportPath,
+					),
+				),
 			},
 		)
 	}
 
 	if !strings.HasPrefix(params.storeRealPath, export.FsPath) {
-		return nil, status.Errorf(
-			codes.InvalidArgument,
-			"Volume directory %q would not be accessible via export %q fs_path %q",
-			params.storeRealPath,
-			params.storeExportPath,
-			export.FsPath,
+		return nil, withRemediation(
+			status.Errorf(
+				codes.InvalidArgument,
+				"Volume directory %q would not be accessible via export %q fs_path %q",
+				params.storeRealPath,
+				params.storeExportPath,
+				export.FsPath,
+			),
+			eventReasonExportMismatch,
+			fmt.Sprintf(
+				"Change the fs_path of export %q on cluster %s to %q or one of its parents, "+
+					"or set %s to an export which does",
+				params.storeExportPath,
+				params.server,
+				params.storeRealPath,
+				paramStoreExportPath,
+			),
 		)
 	}
 
 	suffix := strings.TrimPrefix(params.storeRealPath, export.FsPath)
 	mountPath := filepath.Join(params.storeExportPath, suffix)
 
-	id := fmt.Sprintf(
-		"v1:%s:%d/%s/%s//%s",
-		params.server,
-		params.restPort,
-		params.storeRealPath,
-		mountPath,
-		params.name,
-	)
-
 	vol := &qumuloVolume{
-		id:             id,
 		server:         params.server,
 		restPort:       params.restPort,
 		storeRealPath:  params.storeRealPath,
 		storeMountPath: mountPath,
 		name:           params.name,
+		snapshotPolicy: params.snapshotPolicy,
+		replicated:     params.replication != nil,
+		replication:    params.replication,
+	}
+
+	if params.namespaceDirectories {
+		vol.storeRealPath = filepath.Join(vol.storeRealPath, params.pvcNamespace)
+		vol.storeMountPath = filepath.Join(vol.storeMountPath, params.pvcNamespace)
+		vol.namespaceDirectory = true
 	}
 
+	vol.id = vol.makeID()
+
 	return vol, nil
 }
 
+func (vol *qumuloVolume) getOptions() url.Values {
+	options := url.Values{}
+	if vol.snapshotPolicy != "" {
+		options.Set(paramSnapshotPolicy, vol.snapshotPolicy)
+	}
+	if vol.adopted {
+		options.Set(volumeOptionAdopted, "true")
+	}
+	if vol.namespaceDirectory {
+		options.Set(volumeOptionNamespaceDirectory, "true")
+	}
+	if vol.replicated {
+		options.Set(volumeOptionReplicated, "true")
+	}
+	return options
+}
+
+func (vol *qumuloVolume) setOptions(options url.Values) error {
+	for k := range options {
+		switch k {
+		case paramSnapshotPolicy:
+			vol.snapshotPolicy = options.Get(k)
+		case volumeOptionAdopted:
+			adopted, err := strconv.ParseBool(options.Get(k))
+			if err != nil {
+				return fmt.Errorf("Invalid option %q", k)
+			}
+			vol.adopted = adopted
+		case volumeOptionNamespaceDirectory:
+			namespaceDirectory, err := strconv.ParseBool(options.Get(k))
+			if err != nil {
+				return fmt.Errorf("Invalid option %q", k)
+			}
+			vol.namespaceDirectory = namespaceDirectory
+		case volumeOptionReplicated:
+			replicated, err := strconv.ParseBool(options.Get(k))
+			if err != nil {
+				return fmt.Errorf("Invalid option %q", k)
+			}
+			vol.replicated = replicated
+		default:
+			return fmt.Errorf("Unknown option %q", k)
+		}
+	}
+	return nil
+}
+
+func (vol *qumuloVolume) makeID() string {
+	id := fmt.Sprintf(
+		"v1:%s:%d/%s/%s//%s",
+		vol.server,
+		vol.restPort,
+		vol.storeRealPath,
+		vol.storeMountPath,
+		vol.name,
+	)
+
+	options := vol.getOptions()
+	if len(options) != 0 {
+		id = "v2" + strings.TrimPrefix(id, "v1") + "//" + options.Encode()
+	}
+
+	return id
+}
+
 func (vol *qumuloVolume) getVolumeRealPath() string {
 	return filepath.Join(vol.storeRealPath, vol.name)
 }
 
+func (vol *qumuloVolume) getVolumeReplicationTargetPath() string {
+	return filepath.Join(vol.replication.path, vol.name)
+}
+
 func (vol *qumuloVolume) getVolumeSharePath() string {
 	return filepath.Join(vol.storeMountPath, vol.name)
 }
@@ -582,10 +1636,22 @@ func (vol *qumuloVolume) qumuloVolumeToCSIVolume() *csi.Volume {
 }
 
 func makeQumuloVolumeFromID(id string) (*qumuloVolume, error) {
+	var options url.Values
+
 	volRegex := regexp.MustCompile("^v1:([^:]+):([0-9]+)//(.*)//(.*)//([^/]+)$")
 	tokens := volRegex.FindStringSubmatch(id)
 	if tokens == nil {
-		return nil, fmt.Errorf("Could not decode volume ID %q", id)
+		volRegex = regexp.MustCompile("^v2:([^:]+):([0-9]+)//(.*)//(.*)//([^/]+)//([^/]+)$")
+		tokens = volRegex.FindStringSubmatch(id)
+		if tokens == nil {
+			return nil, fmt.Errorf("Could not decode volume ID %q", id)
+		}
+
+		var err error
+		options, err = url.ParseQuery(tokens[6])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid options in volume ID %q", id)
+		}
 	}
 
 	restPort, err := strconv.Atoi(tokens[2])
@@ -593,12 +1659,18 @@ func makeQumuloVolumeFromID(id string) (*qumuloVolume, error) {
 		return nil, fmt.Errorf("Invalid port in volume ID %q", id)
 	}
 
-	return &qumuloVolume{
+	vol := &qumuloVolume{
 		id:             id,
 		server:         tokens[1],
 		restPort:       restPort,
 		storeRealPath:  "/" + tokens[3],
 		storeMountPath: "/" + tokens[4],
 		name:           tokens[5],
-	}, nil
+	}
+
+	if err := vol.setOptions(options); err != nil {
+		return nil, fmt.Errorf("Invalid options in volume ID %q: %v", id, err)
+	}
+
+	return vol, nil
 }
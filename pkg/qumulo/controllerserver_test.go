@@ -17,17 +17,28 @@ limitations under the License.
 package qumulo
 
 import (
+	"net/http"
 	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"fmt"
 
 	"context"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-driver-qumulo/pkg/qumulo/fakecluster"
+	"github.com/kubernetes-csi/csi-driver-qumulo/pkg/qumulo/faults"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
 	mount "k8s.io/mount-utils"
 )
 
@@ -91,6 +102,7 @@ func makeCreateRequest(testDirPath string, name string) csi.CreateVolumeRequest
 		Secrets: map[string]string{
 			"username": testUsername,
 			"password": testPassword,
+			"insecure": testInsecure,
 		},
 	}
 }
@@ -209,7 +221,8 @@ func TestCreateVolumeAuthFailure(t *testing.T) {
 	req.Secrets["password"] = testPassword + "asdf"
 
 	_, err := initTestController(t).CreateVolume(context.TODO(), &req)
-	assert.Equal(t, err, status.Error(codes.Unauthenticated, "Login failed: 401"))
+	assert.Equal(t, status.Code(err), codes.Unauthenticated)
+	assert.Equal(t, status.Convert(err).Message(), "Login failed: 401")
 }
 
 func TestCreateVolumeParentDirectoryMissing(t *testing.T) {
@@ -235,7 +248,7 @@ func TestCreateVolumeExistingFile(t *testing.T) {
 
 	volumeDir := "confict"
 
-	_, err := testConnection.CreateFile(testDirPath, volumeDir)
+	_, err := testConnection.CreateFile(context.TODO(), testDirPath, volumeDir)
 	assert.NoError(t, err)
 
 	req := makeCreateRequest(testDirPath, volumeDir)
@@ -266,13 +279,16 @@ func TestCreateVolumeNoExportOverlap(t *testing.T) {
 	testDirPath, _, cleanup := requireCluster(t)
 	defer cleanup(t)
 
-	_, err := testConnection.CreateDir(testDirPath, "bar")
+	_, err := testConnection.CreateDir(context.TODO(), testDirPath, "bar")
 	assert.NoError(t, err)
 	exportPath := "/gotest/some/export"
 	exportFsPath := testDirPath + "/bar"
-	_, err = testConnection.ExportCreate(exportPath, exportFsPath)
+	_, err = testConnection.ExportCreate(
+		context.TODO(),
+		NfsExport{ExportPath: exportPath, FsPath: exportFsPath},
+	)
 	assert.NoError(t, err)
-	defer testConnection.ExportDelete(exportPath)
+	defer testConnection.ExportDelete(context.TODO(), exportPath, "")
 
 	req := makeCreateRequest(testDirPath, "vol1")
 	req.Parameters[paramStoreExportPath] = exportPath
@@ -302,11 +318,11 @@ func TestCreateVolumeHappyPath(t *testing.T) {
 
 	qVol, err := makeQumuloVolumeFromID(resp.Volume.VolumeId)
 	assert.NoError(t, err)
-	attributes, err := testConnection.LookUp(qVol.getVolumeRealPath())
+	attributes, err := testConnection.LookUp(context.TODO(), qVol.getVolumeRealPath())
 	assert.NoError(t, err)
 	assert.Equal(t, attributes.Mode, "0777")
 
-	quotaLimit, err := testConnection.GetQuota(attributes.Id)
+	quotaLimit, err := testConnection.GetQuota(context.TODO(), attributes.Id)
 	assert.NoError(t, err)
 	assert.Equal(t, quotaLimit, uint64(1024*1024*1024))
 }
@@ -316,11 +332,11 @@ func TestCreateVolumeHappyPathIdempotency(t *testing.T) {
 	defer cleanup(t)
 
 	volumeDir := "vol1"
-	attributes, err := testConnection.CreateDir(testDirPath, volumeDir)
+	attributes, err := testConnection.CreateDir(context.TODO(), testDirPath, volumeDir)
 	assert.NoError(t, err)
-	err = testConnection.CreateQuota(attributes.Id, 2*1024*1024*1024)
+	err = testConnection.CreateQuota(context.TODO(), attributes.Id, 2*1024*1024*1024)
 	assert.NoError(t, err)
-	attributes, err = testConnection.FileChmod(attributes.Id, "0555")
+	attributes, err = testConnection.FileChmod(context.TODO(), attributes.Id, "0555")
 	assert.NoError(t, err)
 
 	req := makeCreateRequest(testDirPath, volumeDir)
@@ -331,11 +347,11 @@ func TestCreateVolumeHappyPathIdempotency(t *testing.T) {
 
 	qVol, err := makeQumuloVolumeFromID(resp.Volume.VolumeId)
 	assert.NoError(t, err)
-	attributes, err = testConnection.LookUp(qVol.getVolumeRealPath())
+	attributes, err = testConnection.LookUp(context.TODO(), qVol.getVolumeRealPath())
 	assert.NoError(t, err)
 	assert.Equal(t, attributes.Mode, "0777")
 
-	quotaLimit, err := testConnection.GetQuota(attributes.Id)
+	quotaLimit, err := testConnection.GetQuota(context.TODO(), attributes.Id)
 	assert.NoError(t, err)
 	assert.Equal(t, quotaLimit, uint64(1024*1024*1024))
 }
@@ -345,9 +361,12 @@ func TestCreateVolumeHappyPathDifferentExport(t *testing.T) {
 	defer cleanup(t)
 
 	exportPath := "/gotest/some/export"
-	_, err := testConnection.ExportCreate(exportPath, testDirPath)
+	_, err := testConnection.ExportCreate(
+		context.TODO(),
+		NfsExport{ExportPath: exportPath, FsPath: testDirPath},
+	)
 	assert.NoError(t, err)
-	defer testConnection.ExportDelete(exportPath)
+	defer testConnection.ExportDelete(context.TODO(), exportPath, "")
 
 	volumeDir := "vol1"
 	req := makeCreateRequest(testDirPath, volumeDir)
@@ -372,15 +391,126 @@ func TestCreateVolumeHappyPathDifferentExport(t *testing.T) {
 
 	qVol, err := makeQumuloVolumeFromID(resp.Volume.VolumeId)
 	assert.NoError(t, err)
-	attributes, err := testConnection.LookUp(qVol.getVolumeRealPath())
+	attributes, err := testConnection.LookUp(context.TODO(), qVol.getVolumeRealPath())
 	assert.NoError(t, err)
 	assert.Equal(t, attributes.Mode, "0777")
 
-	quotaLimit, err := testConnection.GetQuota(attributes.Id)
+	quotaLimit, err := testConnection.GetQuota(context.TODO(), attributes.Id)
 	assert.NoError(t, err)
 	assert.Equal(t, quotaLimit, uint64(1024*1024*1024))
 }
 
+func TestCreateVolumeIdTooLong(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	name := "pvc-" + strings.Repeat("x", maxVolumeIdLength)
+	req := makeCreateRequest(testDirPath, name)
+
+	_, err := initTestController(t).CreateVolume(context.TODO(), &req)
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+
+	// Nothing should have been created.
+	_, err = testConnection.LookUp(context.TODO(), testDirPath+"/"+name)
+	assert.True(t, errorIsRestErrorWithStatus(err, 404))
+}
+
+func TestCreateVolumeSnapshotPolicyNotFound(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	req := makeCreateRequest(testDirPath, "vol1")
+	req.Parameters[paramSnapshotPolicy] = "999999"
+
+	_, err := initTestController(t).CreateVolume(context.TODO(), &req)
+
+	assert.Equal(t, err, status.Errorf(codes.NotFound, "Snapshot policy %q not found", "999999"))
+
+	// Nothing should have been created.
+	_, err = testConnection.LookUp(context.TODO(), testDirPath+"/vol1")
+	assert.True(t, errorIsRestErrorWithStatus(err, 404))
+}
+
+func TestCreateDeleteVolumeSnapshotPolicy(t *testing.T) {
+	if testCluster == nil {
+		t.Skip("Needs the in-memory cluster to create a snapshot policy")
+	}
+	testDirPath, testDirId, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	// Another directory the policy already protects, which must be kept.
+	policyId := testCluster.CreateSnapshotPolicy("csi-test", testDirId)
+
+	cs := initTestController(t)
+	req := makeCreateRequest(testDirPath, "vol1")
+	req.Parameters[paramSnapshotPolicy] = policyId
+
+	resp, err := cs.CreateVolume(context.TODO(), &req)
+	assert.NoError(t, err)
+
+	attributes, err := testConnection.LookUp(context.TODO(), testDirPath+"/vol1")
+	assert.NoError(t, err)
+
+	policy, _, err := testConnection.SnapshotPolicyGet(context.TODO(), policyId)
+	assert.NoError(t, err)
+	assert.Equal(t, policy.SourceFileIds, []string{testDirId, attributes.Id})
+
+	_, err = cs.DeleteVolume(
+		context.TODO(),
+		&csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId, Secrets: req.Secrets},
+	)
+	assert.NoError(t, err)
+
+	policy, _, err = testConnection.SnapshotPolicyGet(context.TODO(), policyId)
+	assert.NoError(t, err)
+	assert.Equal(t, policy.SourceFileIds, []string{testDirId})
+}
+
+func TestCreateVolumeAclTemplatePathNotFound(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	req := makeCreateRequest(testDirPath, "vol1")
+	req.Parameters[paramAclTemplatePath] = testDirPath + "/template"
+
+	_, err := initTestController(t).CreateVolume(context.TODO(), &req)
+
+	assert.Equal(
+		t,
+		err,
+		status.Errorf(codes.NotFound, "acltemplatepath %q not found", testDirPath+"/template"),
+	)
+}
+
+func TestCreateVolumeAclTemplatePath(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	template, err := testConnection.CreateDir(context.TODO(), testDirPath, "template")
+	assert.NoError(t, err)
+	_, err = testConnection.FileChmod(context.TODO(), template.Id, "0750")
+	assert.NoError(t, err)
+	templateAcl, err := testConnection.AclGet(context.TODO(), template.Id)
+	assert.NoError(t, err)
+
+	req := makeCreateRequest(testDirPath, "vol1")
+	req.Parameters[paramAclTemplatePath] = testDirPath + "/template"
+
+	// Twice to show retries are fine.
+	for i := 0; i < 2; i++ {
+		_, err = initTestController(t).CreateVolume(context.TODO(), &req)
+		assert.NoError(t, err)
+	}
+
+	attributes, err := testConnection.LookUp(context.TODO(), testDirPath+"/vol1")
+	assert.NoError(t, err)
+	assert.Equal(t, attributes.Mode, "0750")
+
+	acl, err := testConnection.AclGet(context.TODO(), attributes.Id)
+	assert.NoError(t, err)
+	assert.True(t, aclMatches(acl, templateAcl))
+}
+
 /*  _____                            ___     __    _
  * | ____|_  ___ __   __ _ _ __   __| \ \   / /__ | |_   _ _ __ ___   ___
  * |  _| \ \/ / '_ \ / _` | '_ \ / _` |\ \ / / _ \| | | | | '_ ` _ \ / _ \
@@ -454,11 +584,13 @@ func TestExpandVolumeAuthFailure(t *testing.T) {
 		Secrets: map[string]string{
 			"username": testUsername,
 			"password": testPassword + "asdf",
+			"insecure": testInsecure,
 		},
 	}
 
 	_, err := cs.ControllerExpandVolume(context.TODO(), req)
-	assert.Equal(t, err, status.Error(codes.Unauthenticated, "Login failed: 401"))
+	assert.Equal(t, status.Code(err), codes.Unauthenticated)
+	assert.Equal(t, status.Convert(err).Message(), "Login failed: 401")
 }
 
 func TestExpandVolumeVolumeDirectoryNotFound(t *testing.T) {
@@ -475,6 +607,7 @@ func TestExpandVolumeVolumeDirectoryNotFound(t *testing.T) {
 		Secrets: map[string]string{
 			"username": testUsername,
 			"password": testPassword,
+			"insecure": testInsecure,
 		},
 	}
 
@@ -496,13 +629,14 @@ func TestExpandVolumeVolumeHappyPath(t *testing.T) {
 		Secrets: map[string]string{
 			"username": testUsername,
 			"password": testPassword,
+			"insecure": testInsecure,
 		},
 	}
 
 	// Create dir and quota before operation.
-	attributes, err := testConnection.EnsureDir(testDirPath, "foobar")
+	attributes, err := testConnection.EnsureDir(context.TODO(), testDirPath, "foobar")
 	assert.NoError(t, err)
-	err = testConnection.EnsureQuota(attributes.Id, 1024*1024*1024)
+	err = testConnection.EnsureQuota(context.TODO(), attributes.Id, 1024*1024*1024)
 
 	resp, err := cs.ControllerExpandVolume(context.TODO(), req)
 	assert.NoError(t, err)
@@ -511,165 +645,1066 @@ func TestExpandVolumeVolumeHappyPath(t *testing.T) {
 		NodeExpansionRequired: false,
 	})
 
-	newLimit, err := testConnection.GetQuota(attributes.Id)
+	newLimit, err := testConnection.GetQuota(context.TODO(), attributes.Id)
 	assert.NoError(t, err)
 	assert.Equal(t, newLimit, uint64(2*1024*1024*1024))
 }
 
-/*  ____       _      _     __     __    _
- * |  _ \  ___| | ___| |_ __\ \   / /__ | |_   _ _ __ ___   ___
- * | | | |/ _ \ |/ _ \ __/ _ \ \ / / _ \| | | | | '_ ` _ \ / _ \
- * | |_| |  __/ |  __/ ||  __/\ V / (_) | | |_| | | | | | |  __/
- * |____/ \___|_|\___|\__\___| \_/ \___/|_|\__,_|_| |_| |_|\___|
- *  FIGLET: DeleteVolume
+/*   ____      _ __     __    _
+ *  / ___| ___| |\ \   / /__ | |_   _ _ __ ___   ___
+ * | |  _ / _ \ __\ \ / / _ \| | | | | '_ ` _ \ / _ \
+ * | |_| |  __/ |_ \ V / (_) | | |_| | | | | | |  __/
+ *  \____|\___|\__| \_/ \___/|_|\__,_|_| |_| |_|\___|
+ *  FIGLET: GetVolume
  */
 
-func TestDeleteVolumeVolumeIdMissing(t *testing.T) {
+func TestGetVolumeVolumeIdMissing(t *testing.T) {
 	cs := initTestController(t)
 
-	req := &csi.DeleteVolumeRequest{}
-
-	_, err := cs.DeleteVolume(context.TODO(), req)
+	_, err := cs.ControllerGetVolume(context.TODO(), &csi.ControllerGetVolumeRequest{})
 	assert.Equal(t, err, status.Error(codes.InvalidArgument, "Volume ID missing in request"))
 }
 
-func TestDeleteVolumeInvalidVolumeId(t *testing.T) {
+func TestGetVolumeInvalidVolumeId(t *testing.T) {
 	cs := initTestController(t)
 
-	req := &csi.DeleteVolumeRequest{VolumeId: "invalid ignore per code"}
-	_, err := makeQumuloVolumeFromID(req.VolumeId)
-	assert.Error(t, err)
+	req := &csi.ControllerGetVolumeRequest{VolumeId: "blah-blah"}
 
-	resp, err := cs.DeleteVolume(context.TODO(), req)
+	_, err := cs.ControllerGetVolume(context.TODO(), req)
+	assert.Equal(t, err, status.Error(codes.NotFound, "Volume not found \"blah-blah\""))
+}
+
+// A PV for volumeId whose controller expand secret holds the test cluster's credentials, and
+// that secret.
+func makeGetVolumeObjects(volumeId string, storageClass string) []runtime.Object {
+	return []runtime.Object{
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "qumulo-login", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"username": []byte(testUsername),
+				"password": []byte(testPassword),
+				"insecure": []byte(testInsecure),
+			},
+		},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv1"},
+			Spec: v1.PersistentVolumeSpec{
+				StorageClassName: storageClass,
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{
+						Driver:       DefaultDriverName,
+						VolumeHandle: volumeId,
+						ControllerExpandSecretRef: &v1.SecretReference{
+							Name:      "qumulo-login",
+							Namespace: "kube-system",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestGetVolumeNoExpandSecret(t *testing.T) {
+	cs := initTestController(t)
+
+	volumeId := "v1:server:123//a//b//foobar"
+	req := &csi.ControllerGetVolumeRequest{VolumeId: volumeId}
 
+	resp, err := cs.ControllerGetVolume(context.TODO(), req)
 	assert.NoError(t, err)
-	assert.Equal(t, resp, &csi.DeleteVolumeResponse{})
+	assert.Equal(t, resp.Volume.VolumeId, volumeId)
+	assert.Equal(
+		t,
+		resp.Status.VolumeCondition,
+		&csi.VolumeCondition{
+			Abnormal: false,
+			Message:  "Volume condition not monitored without a controller-expand-secret",
+		},
+	)
 }
 
-func TestDeleteVolumeMissingSecrets(t *testing.T) {
+func TestGetVolumeDirectoryExists(t *testing.T) {
 	testDirPath, _, cleanup := requireCluster(t)
 	defer cleanup(t)
 
-	cs := initTestController(t)
+	_, err := testConnection.CreateDir(context.TODO(), testDirPath, "foobar")
+	assert.NoError(t, err)
 
 	volumeId := makeVolumeId(testDirPath, testDirPath, "foobar")
+	cs := initTestController(t)
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(makeGetVolumeObjects(volumeId, "")...))
 
-	req := &csi.DeleteVolumeRequest{
-		VolumeId: volumeId,
-		Secrets:  map[string]string{},
-	}
-
-	_, err := cs.DeleteVolume(context.TODO(), req)
-	assert.Equal(t, err, status.Error(codes.Unauthenticated, "username and password secrets missing"))
+	resp, err := cs.ControllerGetVolume(
+		context.TODO(),
+		&csi.ControllerGetVolumeRequest{VolumeId: volumeId},
+	)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		resp.Status.VolumeCondition,
+		&csi.VolumeCondition{Abnormal: false, Message: "Volume directory exists"},
+	)
 }
 
-func TestDeleteVolumeAuthFailure(t *testing.T) {
+func TestGetVolumeDirectoryMissing(t *testing.T) {
 	testDirPath, _, cleanup := requireCluster(t)
 	defer cleanup(t)
 
-	cs := initTestController(t)
-
 	volumeId := makeVolumeId(testDirPath, testDirPath, "foobar")
+	cs := initTestController(t)
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(makeGetVolumeObjects(volumeId, "")...))
 
-	req := &csi.DeleteVolumeRequest{
-		VolumeId: volumeId,
-		Secrets: map[string]string{
-			"username": testUsername,
-			"password": testPassword + "asdf",
+	resp, err := cs.ControllerGetVolume(
+		context.TODO(),
+		&csi.ControllerGetVolumeRequest{VolumeId: volumeId},
+	)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		resp.Status.VolumeCondition,
+		&csi.VolumeCondition{
+			Abnormal: true,
+			Message: fmt.Sprintf(
+				"Volume directory %s/foobar not found on %s",
+				testDirPath,
+				testHost,
+			),
 		},
-	}
-
-	_, err := cs.DeleteVolume(context.TODO(), req)
-	assert.Equal(t, err, status.Error(codes.Unauthenticated, "Login failed: 401"))
+	)
 }
 
-func TestDeleteVolumeHappyPath(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
-	defer cleanup(t)
-
+func TestGetVolumeReplicatedNoKubeClient(t *testing.T) {
 	cs := initTestController(t)
 
-	volumeId := makeVolumeId(testDirPath, testDirPath, "foobar")
+	volumeId := "v2:server:123//a//b//foobar//replicated=true"
+	req := &csi.ControllerGetVolumeRequest{VolumeId: volumeId}
 
-	req := &csi.DeleteVolumeRequest{
-		VolumeId: volumeId,
-		Secrets: map[string]string{
-			"username": testUsername,
-			"password": testPassword,
+	_, err := cs.ControllerGetVolume(context.TODO(), req)
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+	assert.Equal(
+		t,
+		status.Convert(err).Message(),
+		fmt.Sprintf(
+			"Cannot look up replication target of volume %q without the StorageClass of its PV",
+			volumeId,
+		),
+	)
+}
+
+func TestLookUpReplicationTarget(t *testing.T) {
+	cs := initTestController(t)
+
+	volumeId := "v2:server:123//a//b//foobar//replicated=true"
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "foobar"},
+			Spec: v1.PersistentVolumeSpec{
+				StorageClassName: "replicated",
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{
+						Driver:       DefaultDriverName,
+						VolumeHandle: volumeId,
+					},
+				},
+			},
 		},
-	}
+		&storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "replicated"},
+			Provisioner: DefaultDriverName,
+			Parameters: map[string]string{
+				"server":                     "server",
+				"storeRealPath":              "/a",
+				"replicationTarget":          "dr",
+				"replicationTargetPath":      "/replicas",
+				"replicationSecretName":      "dr-login",
+				"replicationSecretNamespace": "kube-system",
+			},
+		},
+	))
 
-	// Create dir and test lookup before operation.
-	qVol, err := makeQumuloVolumeFromID(req.VolumeId)
-	assert.NoError(t, err)
-	_, err = testConnection.EnsureDir(testDirPath, "foobar")
-	assert.NoError(t, err)
-	_, err = testConnection.LookUp(qVol.getVolumeRealPath())
+	pv, err := cs.findPersistentVolume(context.TODO(), volumeId)
 	assert.NoError(t, err)
 
-	// Run
-	resp, err := cs.DeleteVolume(context.TODO(), req)
+	target, err := cs.lookUpReplicationTarget(context.TODO(), volumeId, pv)
 	assert.NoError(t, err)
-	assert.Equal(t, resp, &csi.DeleteVolumeResponse{})
+	assert.Equal(
+		t,
+		target,
+		&replicationTarget{
+			server:          "dr",
+			restPort:        8000,
+			path:            "/replicas",
+			secretName:      "dr-login",
+			secretNamespace: "kube-system",
+		},
+	)
 
-	// Directory deleted
-	_, err = testConnection.LookUp(qVol.getVolumeRealPath())
-	assert.True(t, errorIsRestErrorWithStatus(err, 404))
+	_, err = cs.lookUpReplicationTarget(context.TODO(), volumeId, nil)
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
 }
 
-func TestDeleteVolumeMissingDirectory(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
-	defer cleanup(t)
+/*  ____            _ _           _   _
+ * |  _ \ ___ _ __ | (_) ___ __ _| |_(_) ___  _ __
+ * | |_) / _ \ '_ \| | |/ __/ _` | __| |/ _ \| '_ \
+ * |  _ <  __/ |_) | | | (_| (_| | |_| | (_) | | | |
+ * |_| \_\___| .__/|_|_|\___\__,_|\__|_|\___/|_| |_|
+ *           |_|
+ *  FIGLET: Replication
+ */
 
-	cs := initTestController(t)
+const testReplicationPassword = "target-password"
 
-	volumeId := makeVolumeId(testDirPath, testDirPath, "foobar")
+// A second in-memory cluster for the test cluster to replicate to, and the secret and
+// StorageClass which name it. Skips the test against a real cluster.
+func requireReplicationTarget(t *testing.T) (*fakecluster.Server, []runtime.Object) {
+	if testCluster == nil {
+		t.Skip("Needs the in-memory cluster to replicate to a second cluster")
+	}
 
-	req := &csi.DeleteVolumeRequest{
-		VolumeId: volumeId,
-		Secrets: map[string]string{
-			"username": testUsername,
-			"password": testPassword,
+	target := fakecluster.NewServer("admin", testReplicationPassword)
+	t.Cleanup(target.Close)
+
+	objects := []runtime.Object{
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "target-login", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"username": []byte("admin"),
+				"password": []byte(testReplicationPassword),
+				"insecure": []byte("true"),
+			},
+		},
+		&storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: "replicated"},
+			Provisioner: DefaultDriverName,
+			Parameters:  makeReplicationParameters(target),
 		},
 	}
 
-	// No directory exists, should still be success.
-	qVol, err := makeQumuloVolumeFromID(req.VolumeId)
+	return target, objects
+}
+
+func makeReplicationParameters(target *fakecluster.Server) map[string]string {
+	return map[string]string{
+		paramReplicationTarget:          target.Host,
+		paramReplicationTargetRestPort:  strconv.Itoa(target.Port),
+		paramReplicationTargetPath:      "/replicas",
+		paramReplicationSecretName:      "target-login",
+		paramReplicationSecretNamespace: "kube-system",
+	}
+}
+
+func connectReplicationTarget(t *testing.T, target *fakecluster.Server) *Connection {
+	client, err := NewHTTPClient(TLSOptions{Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connection := MakeConnection(
+		target.Host,
+		target.Port,
+		"admin",
+		testReplicationPassword,
+		client,
+	)
+	return &connection
+}
+
+// Create a replicated volume called name in testDirPath, returning its ID.
+func createReplicatedVolume(
+	t *testing.T,
+	testDirPath string,
+	name string,
+	target *fakecluster.Server,
+	objects []runtime.Object,
+) string {
+	cs := initTestController(t)
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(objects...))
+
+	req := makeCreateRequest(testDirPath, name)
+	for k, v := range makeReplicationParameters(target) {
+		req.Parameters[k] = v
+	}
+
+	resp, err := cs.CreateVolume(context.TODO(), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Volume.VolumeId
+}
+
+func TestCreateVolumeReplicationAuthorizes(t *testing.T) {
+	target, objects := requireReplicationTarget(t)
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	testCluster.ReplicateTo(target)
+	defer testCluster.ReplicateTo(nil)
+
+	volumeId := createReplicatedVolume(t, testDirPath, "vol1", target, objects)
+	assert.Equal(
+		t,
+		volumeId,
+		fmt.Sprintf(
+			"v2:%s:%d/%s/%s//vol1//replicated=true",
+			testHost,
+			testPort,
+			testDirPath,
+			testDirPath,
+		),
+	)
+
+	statuses, err := connectReplicationTarget(t, target).ReplicationTargetStatusList(context.TODO())
 	assert.NoError(t, err)
-	_, err = testConnection.LookUp(qVol.getVolumeRealPath())
-	assert.True(t, errorIsRestErrorWithStatus(err, 404))
+	assert.Equal(t, len(statuses), 1)
+	assert.Equal(t, statuses[0].State, "ESTABLISHED")
+	assert.Equal(t, statuses[0].TargetRootPath, "/replicas/vol1")
 
-	// Run
-	resp, err := cs.DeleteVolume(context.TODO(), req)
+	// A retry finds the relationship already established.
+	createReplicatedVolume(t, testDirPath, "vol1", target, objects)
+
+	statuses, err = connectReplicationTarget(t, target).ReplicationTargetStatusList(context.TODO())
 	assert.NoError(t, err)
-	assert.Equal(t, resp, &csi.DeleteVolumeResponse{})
+	assert.Equal(t, len(statuses), 1)
+	assert.Equal(t, statuses[0].State, "ESTABLISHED")
 }
 
-/* __     __    _ _     _       _     __     __    _
- * \ \   / /_ _| (_) __| | __ _| |_ __\ \   / /__ | |_   _ _ __ ___   ___
- *  \ \ / / _` | | |/ _` |/ _` | __/ _ \ \ / / _ \| | | | | '_ ` _ \ / _ \
- *   \ V / (_| | | | (_| | (_| | ||  __/\ V / (_) | | |_| | | | | | |  __/
- *    \_/ \__,_|_|_|\__,_|\__,_|\__\___| \_/ \___/|_|\__,_|_| |_| |_|\___|
- *   ____                  _     _ _ _ _   _
- *  / ___|__ _ _ __   __ _| |__ (_) (_) |_(_) ___  ___
- * | |   / _` | '_ \ / _` | '_ \| | | | __| |/ _ \/ __|
- * | |__| (_| | |_) | (_| | |_) | | | | |_| |  __/\__ \
- *  \____\__,_| .__/ \__,_|_.__/|_|_|_|\__|_|\___||___/
- *            |_|
- *  FIGLET: ValidateVolumeCapabilities
- */
+func TestCreateVolumeReplicationTargetUnknown(t *testing.T) {
+	target, objects := requireReplicationTarget(t)
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
 
-func TestValidateVolumeCapabilities(t *testing.T) {
+	// Not linked with ReplicateTo, so the target never hears of the relationship.
+	cs := initTestController(t)
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(objects...))
+
+	req := makeCreateRequest(testDirPath, "vol1")
+	for k, v := range makeReplicationParameters(target) {
+		req.Parameters[k] = v
+	}
+
+	_, err := cs.CreateVolume(context.TODO(), &req)
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+	assert.Regexp(
+		t,
+		"^Replication relationship .* for volume .* not yet known to target "+
+			regexp.QuoteMeta(target.Host)+"$",
+		status.Convert(err).Message(),
+	)
+}
+
+func TestGetVolumeReplicationCondition(t *testing.T) {
 	cases := []struct {
-		desc        string
-		req         *csi.ValidateVolumeCapabilitiesRequest
-		resp        *csi.ValidateVolumeCapabilitiesResponse
-		expectedErr error
+		name      string
+		state     string
+		endReason string
+		abnormal  bool
+		message   string
 	}{
 		{
-			desc:        "Volume ID missing",
-			req:         &csi.ValidateVolumeCapabilitiesRequest{},
-			resp:        nil,
+			name:     "established",
+			abnormal: false,
+			message:  "Replicating to %s:/replicas/established",
+		},
+		{
+			name:      "ended",
+			state:     "ENDED",
+			endReason: "Relationship deleted on source",
+			abnormal:  true,
+			message:   "Replication to %s:/replicas/ended is ENDED: Relationship deleted on source",
+		},
+		{
+			name:     "disconnected",
+			state:    "DISCONNECTED",
+			abnormal: true,
+			message:  "Replication to %s:/replicas/disconnected is DISCONNECTED",
+		},
+	}
+
+	target, objects := requireReplicationTarget(t)
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	testCluster.ReplicateTo(target)
+	defer testCluster.ReplicateTo(nil)
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			volumeId := createReplicatedVolume(t, testDirPath, test.name, target, objects)
+
+			if test.state != "" {
+				ok := target.SetReplicationTargetState(
+					"/replicas/"+test.name,
+					test.state,
+					test.endReason,
+				)
+				assert.True(t, ok)
+			}
+
+			cs := initTestController(t)
+			cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+				append(objects, makeGetVolumeObjects(volumeId, "replicated")...)...,
+			))
+
+			resp, err := cs.ControllerGetVolume(
+				context.TODO(),
+				&csi.ControllerGetVolumeRequest{VolumeId: volumeId},
+			)
+			assert.NoError(t, err)
+			assert.Equal(
+				t,
+				resp.Status.VolumeCondition,
+				&csi.VolumeCondition{
+					Abnormal: test.abnormal,
+					Message:  fmt.Sprintf(test.message, target.Host),
+				},
+			)
+		})
+	}
+}
+
+func TestGetVolumeReplicationMissing(t *testing.T) {
+	target, objects := requireReplicationTarget(t)
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	// A replicated volume whose relationship the target doesn't have.
+	_, err := testConnection.CreateDir(context.TODO(), testDirPath, "vol1")
+	assert.NoError(t, err)
+	volumeId := fmt.Sprintf(
+		"v2:%s:%d/%s/%s//vol1//replicated=true",
+		testHost,
+		testPort,
+		testDirPath,
+		testDirPath,
+	)
+
+	cs := initTestController(t)
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+		append(objects, makeGetVolumeObjects(volumeId, "replicated")...)...,
+	))
+
+	resp, err := cs.ControllerGetVolume(
+		context.TODO(),
+		&csi.ControllerGetVolumeRequest{VolumeId: volumeId},
+	)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		resp.Status.VolumeCondition,
+		&csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("No replication relationship to %s:/replicas/vol1", target.Host),
+		},
+	)
+}
+
+func TestExpandVolumeAdoptedDirectory(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	cs := initTestController(t)
+
+	// A directory that was not created by the driver and has no quota.
+	attributes, err := testConnection.CreateDir(context.TODO(), testDirPath, "existing")
+	assert.NoError(t, err)
+
+	volumeId := fmt.Sprintf(
+		"v2:%s:%d/%s/%s//existing//adopted=true",
+		testHost,
+		testPort,
+		testDirPath,
+		testDirPath,
+	)
+
+	req := &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 3 * 1024 * 1024 * 1024},
+		Secrets: map[string]string{
+			"username": testUsername,
+			"password": testPassword,
+			"insecure": testInsecure,
+		},
+	}
+
+	_, err = cs.ControllerExpandVolume(context.TODO(), req)
+	assert.NoError(t, err)
+
+	limit, err := testConnection.GetQuota(context.TODO(), attributes.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, limit, uint64(3*1024*1024*1024))
+
+	// Releasing the volume leaves the directory alone.
+	_, err = cs.DeleteVolume(
+		context.TODO(),
+		&csi.DeleteVolumeRequest{VolumeId: volumeId, Secrets: req.Secrets},
+	)
+	assert.NoError(t, err)
+
+	_, err = testConnection.LookUp(context.TODO(), testDirPath+"/existing")
+	assert.NoError(t, err)
+}
+
+/*  ____       _      _     __     __    _
+ * |  _ \  ___| | ___| |_ __\ \   / /__ | |_   _ _ __ ___   ___
+ * | | | |/ _ \ |/ _ \ __/ _ \ \ / / _ \| | | | | '_ ` _ \ / _ \
+ * | |_| |  __/ |  __/ ||  __/\ V / (_) | | |_| | | | | | |  __/
+ * |____/ \___|_|\___|\__\___| \_/ \___/|_|\__,_|_| |_| |_|\___|
+ *  FIGLET: DeleteVolume
+ */
+
+func TestDeleteVolumeVolumeIdMissing(t *testing.T) {
+	cs := initTestController(t)
+
+	req := &csi.DeleteVolumeRequest{}
+
+	_, err := cs.DeleteVolume(context.TODO(), req)
+	assert.Equal(t, err, status.Error(codes.InvalidArgument, "Volume ID missing in request"))
+}
+
+func TestDeleteVolumeInvalidVolumeId(t *testing.T) {
+	cs := initTestController(t)
+
+	req := &csi.DeleteVolumeRequest{VolumeId: "invalid ignore per code"}
+	_, err := makeQumuloVolumeFromID(req.VolumeId)
+	assert.Error(t, err)
+
+	resp, err := cs.DeleteVolume(context.TODO(), req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, resp, &csi.DeleteVolumeResponse{})
+}
+
+func TestDeleteVolumeAdoptedNotDeleted(t *testing.T) {
+	cs := initTestController(t)
+
+	// No secrets: nothing on the cluster is touched.
+	req := &csi.DeleteVolumeRequest{
+		VolumeId: "v2:server:123//projects//projects//alpha//adopted=true",
+	}
+
+	resp, err := cs.DeleteVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, resp, &csi.DeleteVolumeResponse{})
+}
+
+func TestDeleteVolumeAdoptedKeepsSnapshotPolicy(t *testing.T) {
+	if testCluster == nil {
+		t.Skip("Needs the in-memory cluster to create a snapshot policy")
+	}
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	attributes, err := testConnection.CreateDir(context.TODO(), testDirPath, "existing")
+	assert.NoError(t, err)
+	policyId := testCluster.CreateSnapshotPolicy("csi-test", attributes.Id)
+
+	volumeId := fmt.Sprintf(
+		"v2:%s:%d/%s/%s//existing//adopted=true&snapshotpolicy=%s",
+		testHost,
+		testPort,
+		testDirPath,
+		testDirPath,
+		policyId,
+	)
+	req := &csi.DeleteVolumeRequest{
+		VolumeId: volumeId,
+		Secrets: map[string]string{
+			"username": testUsername,
+			"password": testPassword,
+			"insecure": testInsecure,
+		},
+	}
+
+	_, err = initTestController(t).DeleteVolume(context.TODO(), req)
+	assert.NoError(t, err)
+
+	policy, _, err := testConnection.SnapshotPolicyGet(context.TODO(), policyId)
+	assert.NoError(t, err)
+	assert.Equal(t, policy.SourceFileIds, []string{attributes.Id})
+
+	_, err = testConnection.LookUp(context.TODO(), testDirPath+"/existing")
+	assert.NoError(t, err)
+}
+
+func TestDeleteVolumeMissingSecrets(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	cs := initTestController(t)
+
+	volumeId := makeVolumeId(testDirPath, testDirPath, "foobar")
+
+	req := &csi.DeleteVolumeRequest{
+		VolumeId: volumeId,
+		Secrets:  map[string]string{},
+	}
+
+	_, err := cs.DeleteVolume(context.TODO(), req)
+	assert.Equal(t, err, status.Error(codes.Unauthenticated, "username and password secrets missing"))
+}
+
+func TestDeleteVolumeAuthFailure(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	cs := initTestController(t)
+
+	volumeId := makeVolumeId(testDirPath, testDirPath, "foobar")
+
+	req := &csi.DeleteVolumeRequest{
+		VolumeId: volumeId,
+		Secrets: map[string]string{
+			"username": testUsername,
+			"password": testPassword + "asdf",
+			"insecure": testInsecure,
+		},
+	}
+
+	_, err := cs.DeleteVolume(context.TODO(), req)
+	assert.Equal(t, status.Code(err), codes.Unauthenticated)
+	assert.Equal(t, status.Convert(err).Message(), "Login failed: 401")
+}
+
+func TestDeleteVolumeHappyPath(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	cs := initTestController(t)
+
+	volumeId := makeVolumeId(testDirPath, testDirPath, "foobar")
+
+	req := &csi.DeleteVolumeRequest{
+		VolumeId: volumeId,
+		Secrets: map[string]string{
+			"username": testUsername,
+			"password": testPassword,
+			"insecure": testInsecure,
+		},
+	}
+
+	// Create dir and test lookup before operation.
+	qVol, err := makeQumuloVolumeFromID(req.VolumeId)
+	assert.NoError(t, err)
+	_, err = testConnection.EnsureDir(context.TODO(), testDirPath, "foobar")
+	assert.NoError(t, err)
+	_, err = testConnection.LookUp(context.TODO(), qVol.getVolumeRealPath())
+	assert.NoError(t, err)
+
+	// Run
+	resp, err := cs.DeleteVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, resp, &csi.DeleteVolumeResponse{})
+
+	// Directory deleted
+	_, err = testConnection.LookUp(context.TODO(), qVol.getVolumeRealPath())
+	assert.True(t, errorIsRestErrorWithStatus(err, 404))
+}
+
+func TestDeleteVolumeMissingDirectory(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	cs := initTestController(t)
+
+	volumeId := makeVolumeId(testDirPath, testDirPath, "foobar")
+
+	req := &csi.DeleteVolumeRequest{
+		VolumeId: volumeId,
+		Secrets: map[string]string{
+			"username": testUsername,
+			"password": testPassword,
+			"insecure": testInsecure,
+		},
+	}
+
+	// No directory exists, should still be success.
+	qVol, err := makeQumuloVolumeFromID(req.VolumeId)
+	assert.NoError(t, err)
+	_, err = testConnection.LookUp(context.TODO(), qVol.getVolumeRealPath())
+	assert.True(t, errorIsRestErrorWithStatus(err, 404))
+
+	// Run
+	resp, err := cs.DeleteVolume(context.TODO(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, resp, &csi.DeleteVolumeResponse{})
+}
+
+/*  _____           _ _
+ * |  ___|_ _ _   _| | |_ ___
+ * | |_ / _` | | | | | __/ __|
+ * |  _| (_| | |_| | | |_\__ \
+ * |_|  \__,_|\__,_|_|\__|___/
+ *  FIGLET: Faults
+ */
+
+var (
+	filesPathPattern      = regexp.MustCompile(`^/v1/files/`)
+	quotasPathPattern     = regexp.MustCompile(`^/v1/files/quotas/`)
+	treeDeletePathPattern = regexp.MustCompile(`^/v1/tree-delete/`)
+)
+
+// A controller whose REST requests go through a fault injecting transport, retrying quickly.
+func initFaultyController(
+	t *testing.T,
+	fault *faults.Fault,
+) (*ControllerServer, *faults.Transport) {
+	cs := initTestController(t)
+	cs.Driver.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		Budget:         5 * time.Second,
+	})
+
+	transport := faults.New(nil, 1, fault)
+	cs.Driver.sessions.newClient = func(options TLSOptions) (*http.Client, error) {
+		client, err := NewHTTPClient(options)
+		if err != nil {
+			return nil, err
+		}
+		transport.Transport = client.Transport
+		client.Transport = transport
+		return client, nil
+	}
+
+	return cs, transport
+}
+
+type faultCase struct {
+	desc  string
+	fault faults.Fault
+	code  codes.Code
+}
+
+// Call an RPC with each fault injected, expecting it to fail with code or succeed with
+// codes.OK, then call it again without faults as the CO would, expecting it to succeed.
+func runFaultCases(
+	t *testing.T,
+	cases []faultCase,
+	setup func(t *testing.T, testDirPath string),
+	call func(cs *ControllerServer, testDirPath string) error,
+	verify func(t *testing.T, testDirPath string),
+) {
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.desc, func(t *testing.T) {
+			testDirPath, _, cleanup := requireCluster(t)
+			defer cleanup(t)
+
+			if setup != nil {
+				setup(t, testDirPath)
+			}
+
+			fault := test.fault
+			cs, transport := initFaultyController(t, &fault)
+
+			err := call(cs, testDirPath)
+			assert.Equal(t, status.Code(err).String(), test.code.String(), "%v", err)
+			assert.NotZero(t, transport.Injected(&fault), "fault was never injected")
+
+			transport.SetFaults()
+
+			err = call(cs, testDirPath)
+			assert.NoError(t, err)
+
+			verify(t, testDirPath)
+		})
+	}
+}
+
+func TestCreateVolumeFaults(t *testing.T) {
+	cases := []faultCase{
+		{
+			desc:  "slow responses",
+			fault: faults.Fault{Latency: 10 * time.Millisecond},
+			code:  codes.OK,
+		},
+		{
+			desc: "upgrading",
+			fault: faults.Fault{
+				Path:       filesPathPattern,
+				StatusCode: 503,
+				ErrorClass: "http_service_unavailable_error",
+				Times:      2,
+			},
+			code: codes.OK,
+		},
+		{
+			desc: "still upgrading",
+			fault: faults.Fault{
+				Path:       filesPathPattern,
+				StatusCode: 503,
+				ErrorClass: "http_service_unavailable_error",
+			},
+			code: codes.Unavailable,
+		},
+		{
+			desc: "expired token",
+			fault: faults.Fault{
+				Path:       filesPathPattern,
+				StatusCode: 401,
+				ErrorClass: "http_unauthorized_error",
+				Times:      1,
+			},
+			code: codes.OK,
+		},
+		{
+			desc: "no space",
+			fault: faults.Fault{
+				Method:     "POST",
+				Path:       filesPathPattern,
+				StatusCode: 507,
+				ErrorClass: "fs_no_space_error",
+				Times:      1,
+			},
+			code: codes.ResourceExhausted,
+		},
+		{
+			desc: "access denied",
+			fault: faults.Fault{
+				Path:       filesPathPattern,
+				StatusCode: 403,
+				ErrorClass: "fs_access_denied_error",
+				Times:      1,
+			},
+			code: codes.PermissionDenied,
+		},
+		{
+			desc:  "connection dropped after creating the directory",
+			fault: faults.Fault{Method: "POST", Path: filesPathPattern, Drop: true, Times: 1},
+			code:  codes.Unavailable,
+		},
+		{
+			desc: "connection dropped after setting the quota",
+			fault: faults.Fault{
+				Method: "POST",
+				Path:   quotasPathPattern,
+				Drop:   true,
+				Times:  1,
+			},
+			code: codes.Unavailable,
+		},
+		{
+			desc: "body cut off after creating the directory",
+			fault: faults.Fault{
+				Method:        "POST",
+				Path:          filesPathPattern,
+				Truncate:      true,
+				TruncateAfter: 10,
+				Times:         1,
+			},
+			code: codes.Unavailable,
+		},
+		{
+			desc: "body cut off on changing the mode",
+			fault: faults.Fault{
+				Method:        "PATCH",
+				Path:          filesPathPattern,
+				Truncate:      true,
+				TruncateAfter: 10,
+				Times:         1,
+			},
+			code: codes.Unavailable,
+		},
+	}
+
+	runFaultCases(
+		t,
+		cases,
+		nil,
+		func(cs *ControllerServer, testDirPath string) error {
+			req := makeCreateRequest(testDirPath, "vol1")
+			resp, err := cs.CreateVolume(context.TODO(), &req)
+			if err == nil {
+				assert.Equal(t, resp, makeCreateResponse(testDirPath, "vol1"))
+			}
+			return err
+		},
+		func(t *testing.T, testDirPath string) {
+			attributes, err := testConnection.LookUp(context.TODO(), testDirPath+"/vol1")
+			assert.NoError(t, err)
+			assert.Equal(t, attributes.Mode, "0777")
+
+			limit, err := testConnection.GetQuota(context.TODO(), attributes.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, limit, uint64(1024*1024*1024))
+		},
+	)
+}
+
+func TestExpandVolumeFaults(t *testing.T) {
+	cases := []faultCase{
+		{
+			desc: "upgrading",
+			fault: faults.Fault{
+				Path:       quotasPathPattern,
+				StatusCode: 503,
+				ErrorClass: "http_service_unavailable_error",
+				Times:      2,
+			},
+			code: codes.OK,
+		},
+		{
+			desc: "quota not found",
+			fault: faults.Fault{
+				Path:       quotasPathPattern,
+				StatusCode: 404,
+				ErrorClass: "api_quotas_quota_limit_not_found_error",
+				Times:      1,
+			},
+			code: codes.NotFound,
+		},
+		{
+			desc:  "connection dropped after updating the quota",
+			fault: faults.Fault{Method: "PUT", Path: quotasPathPattern, Drop: true, Times: 1},
+			code:  codes.OK,
+		},
+		{
+			desc:  "connection dropped every time",
+			fault: faults.Fault{Method: "PUT", Path: quotasPathPattern, Drop: true},
+			code:  codes.Unavailable,
+		},
+	}
+
+	runFaultCases(
+		t,
+		cases,
+		func(t *testing.T, testDirPath string) {
+			attributes, err := testConnection.CreateDir(context.TODO(), testDirPath, "foobar")
+			assert.NoError(t, err)
+			err = testConnection.CreateQuota(context.TODO(), attributes.Id, 1024*1024*1024)
+			assert.NoError(t, err)
+		},
+		func(cs *ControllerServer, testDirPath string) error {
+			_, err := cs.ControllerExpandVolume(
+				context.TODO(),
+				&csi.ControllerExpandVolumeRequest{
+					VolumeId: makeVolumeId(testDirPath, testDirPath, "foobar"),
+					CapacityRange: &csi.CapacityRange{
+						RequiredBytes: 2 * 1024 * 1024 * 1024,
+					},
+					Secrets: map[string]string{
+						"username": testUsername,
+						"password": testPassword,
+						"insecure": testInsecure,
+					},
+				},
+			)
+			return err
+		},
+		func(t *testing.T, testDirPath string) {
+			attributes, err := testConnection.LookUp(context.TODO(), testDirPath+"/foobar")
+			assert.NoError(t, err)
+
+			limit, err := testConnection.GetQuota(context.TODO(), attributes.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, limit, uint64(2*1024*1024*1024))
+		},
+	)
+}
+
+func TestDeleteVolumeFaults(t *testing.T) {
+	cases := []faultCase{
+		{
+			desc: "upgrading",
+			fault: faults.Fault{
+				Path:       treeDeletePathPattern,
+				StatusCode: 503,
+				ErrorClass: "http_service_unavailable_error",
+				Times:      2,
+			},
+			code: codes.OK,
+		},
+		{
+			desc: "access denied",
+			fault: faults.Fault{
+				Method:     "POST",
+				Path:       treeDeletePathPattern,
+				StatusCode: 403,
+				ErrorClass: "fs_access_denied_error",
+				Times:      1,
+			},
+			code: codes.PermissionDenied,
+		},
+		{
+			desc: "connection dropped after starting the tree delete",
+			fault: faults.Fault{
+				Method: "POST",
+				Path:   treeDeletePathPattern,
+				Drop:   true,
+				Times:  1,
+			},
+			code: codes.Unavailable,
+		},
+		{
+			desc: "body cut off looking up the directory",
+			fault: faults.Fault{
+				Method:        "GET",
+				Path:          filesPathPattern,
+				Truncate:      true,
+				TruncateAfter: 10,
+				Times:         1,
+			},
+			code: codes.OK,
+		},
+	}
+
+	runFaultCases(
+		t,
+		cases,
+		func(t *testing.T, testDirPath string) {
+			_, err := testConnection.CreateDir(context.TODO(), testDirPath, "foobar")
+			assert.NoError(t, err)
+		},
+		func(cs *ControllerServer, testDirPath string) error {
+			_, err := cs.DeleteVolume(
+				context.TODO(),
+				&csi.DeleteVolumeRequest{
+					VolumeId: makeVolumeId(testDirPath, testDirPath, "foobar"),
+					Secrets: map[string]string{
+						"username": testUsername,
+						"password": testPassword,
+						"insecure": testInsecure,
+					},
+				},
+			)
+			return err
+		},
+		func(t *testing.T, testDirPath string) {
+			_, err := testConnection.LookUp(context.TODO(), testDirPath+"/foobar")
+			assert.True(t, errorIsRestErrorWithStatus(err, 404))
+		},
+	)
+}
+
+/* __     __    _ _     _       _     __     __    _
+ * \ \   / /_ _| (_) __| | __ _| |_ __\ \   / /__ | |_   _ _ __ ___   ___
+ *  \ \ / / _` | | |/ _` |/ _` | __/ _ \ \ / / _ \| | | | | '_ ` _ \ / _ \
+ *   \ V / (_| | | | (_| | (_| | ||  __/\ V / (_) | | |_| | | | | | |  __/
+ *    \_/ \__,_|_|_|\__,_|\__,_|\__\___| \_/ \___/|_|\__,_|_| |_| |_|\___|
+ *   ____                  _     _ _ _ _   _
+ *  / ___|__ _ _ __   __ _| |__ (_) (_) |_(_) ___  ___
+ * | |   / _` | '_ \ / _` | '_ \| | | | __| |/ _ \/ __|
+ * | |__| (_| | |_) | (_| | |_) | | | | |_| |  __/\__ \
+ *  \____\__,_| .__/ \__,_|_.__/|_|_|_|\__|_|\___||___/
+ *            |_|
+ *  FIGLET: ValidateVolumeCapabilities
+ */
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	cases := []struct {
+		desc        string
+		req         *csi.ValidateVolumeCapabilitiesRequest
+		resp        *csi.ValidateVolumeCapabilitiesResponse
+		expectedErr error
+	}{
+		{
+			desc:        "Volume ID missing",
+			req:         &csi.ValidateVolumeCapabilitiesRequest{},
+			resp:        nil,
 			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
 		},
 		{
@@ -742,44 +1777,205 @@ func TestValidateVolumeCapabilities(t *testing.T) {
  *  FIGLET: ControllerGetCapabilites
  */
 
-func TestControllerGetCapabilities(t *testing.T) {
-	req := &csi.ControllerGetCapabilitiesRequest{}
-	expectedResp := &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: []*csi.ControllerServiceCapability{
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
-				},
+func TestControllerGetCapabilities(t *testing.T) {
+	req := &csi.ControllerGetCapabilitiesRequest{}
+	expectedResp := &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+		},
+	}
+
+	// Setup
+	cs := initTestController(t)
+
+	// Run
+	resp, err := cs.ControllerGetCapabilities(context.TODO(), req)
+
+	// Verify
+	assert.NoError(t, err)
+	if !reflect.DeepEqual(resp, expectedResp) {
+		t.Errorf("got resp %+v, expected %+v", resp, expectedResp)
+	}
+}
+
+func TestGetSecrets(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "dr-login", Namespace: "kube-system"},
+		Data: map[string][]byte{
+			"username": []byte("bob"),
+			"password": []byte("yeruncle"),
+		},
+	}))
+
+	secrets, err := cs.getSecrets(context.TODO(), "kube-system", "dr-login")
+	assert.NoError(t, err)
+	assert.Equal(t, secrets, map[string]string{"username": "bob", "password": "yeruncle"})
+
+	_, err = cs.getSecrets(context.TODO(), "kube-system", "nope")
+	assert.Equal(t, err, status.Error(codes.NotFound, "Secret kube-system/nope not found"))
+}
+
+func TestGetTLSOptions(t *testing.T) {
+	options, err := getTLSOptions(map[string]string{"username": "bob"})
+	assert.NoError(t, err)
+	assert.Equal(t, options, TLSOptions{CACert: []byte{}})
+
+	options, err = getTLSOptions(map[string]string{"servername": "qumulo", "insecure": "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, options, TLSOptions{CACert: []byte{}, ServerName: "qumulo", Insecure: true})
+
+	_, err = getTLSOptions(map[string]string{"insecure": "sure"})
+	assert.Equal(t, err, status.Error(codes.InvalidArgument, "invalid insecure \"sure\" in secret"))
+
+	_, err = getTLSOptions(map[string]string{"cacert": "junk"})
+	assert.Equal(
+		t,
+		err,
+		status.Error(
+			codes.InvalidArgument,
+			"invalid cacert in secret: No PEM certificates found in CA bundle",
+		),
+	)
+}
+
+func TestGetNamespaceQuota(t *testing.T) {
+	params := &CreateParams{pvcNamespace: "team-a", namespaceQuota: 1000}
+
+	cs := initTestController(t)
+	limit, err := cs.getNamespaceQuota(context.TODO(), params)
+	assert.NoError(t, err)
+	assert.Equal(t, limit, uint64(1000))
+
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+	}))
+	limit, err = cs.getNamespaceQuota(context.TODO(), params)
+	assert.NoError(t, err)
+	assert.Equal(t, limit, uint64(1000))
+
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "team-a",
+			Annotations: map[string]string{"qumulo.csi.k8s.io/namespace-quota": "2Ki"},
+		},
+	}))
+	limit, err = cs.getNamespaceQuota(context.TODO(), params)
+	assert.NoError(t, err)
+	assert.Equal(t, limit, uint64(2048))
+
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "team-a",
+			Annotations: map[string]string{"qumulo.csi.k8s.io/namespace-quota": "-5"},
+		},
+	}))
+	_, err = cs.getNamespaceQuota(context.TODO(), params)
+	assert.Equal(
+		t,
+		err,
+		status.Error(
+			codes.InvalidArgument,
+			"invalid qumulo.csi.k8s.io/namespace-quota annotation \"-5\" on namespace \"team-a\"",
+		),
+	)
+}
+
+func TestRemoveNamespaceDirectory(t *testing.T) {
+	vol := &qumuloVolume{storeRealPath: "/a/team-a", name: "vol1", namespaceDirectory: true}
+	listUri := "/v1/files/%2Fa%2Fteam-a/entries/?limit=2"
+	entry := func(name string) string {
+		return "{\"id\": \"9\", \"name\": \"" + name + "\", " +
+			"\"type\": \"FS_FILE_TYPE_DIRECTORY\", \"mode\": \"0777\"}"
+	}
+
+	cases := []struct {
+		name      string
+		messages  []Message
+		expectErr error
+	}{
+		{
+			name:     "already gone",
+			messages: []Message{{listUri, 404, "", ""}},
+		},
+		{
+			name: "other volumes remain",
+			messages: []Message{
+				{listUri, 200, "", "{\"files\": [" + entry("vol2") + "]}"},
 			},
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-					},
-				},
+		},
+		{
+			name: "tree delete pending",
+			messages: []Message{
+				{listUri, 200, "", "{\"files\": [" + entry("vol1") + "]}"},
 			},
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-					},
-				},
+			expectErr: status.Error(
+				codes.Unavailable,
+				"Waiting for tree delete of \"/a/team-a/vol1\" to remove namespace directory",
+			),
+		},
+		{
+			name: "empty",
+			messages: []Message{
+				{listUri, 200, "", "{\"files\": []}"},
+				{"/v1/files/%2Fa%2Fteam-a", 200, "", ""},
+			},
+		},
+		{
+			name: "raced with a new volume",
+			messages: []Message{
+				{listUri, 200, "", "{\"files\": []}"},
+				{"/v1/files/%2Fa%2Fteam-a", 409, "", ""},
 			},
 		},
 	}
 
-	// Setup
-	cs := initTestController(t)
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			messages := test.messages
+			client := newTestClient(t, "1.2.3.4", 44, &messages)
+			connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
 
-	// Run
-	resp, err := cs.ControllerGetCapabilities(context.TODO(), req)
+			err := removeNamespaceDirectory(context.TODO(), &connection, vol)
+			assert.Equal(t, err, test.expectErr)
 
-	// Verify
-	assert.NoError(t, err)
-	if !reflect.DeepEqual(resp, expectedResp) {
-		t.Errorf("got resp %+v, expected %+v", resp, expectedResp)
+			assertMessagesConsumed(t, messages)
+		})
 	}
 }
 
@@ -856,6 +2052,54 @@ func TestGetQumuloVolumeFromID(t *testing.T) {
 			},
 			expectErr: "",
 		},
+		{
+			name: "Happy v2 with snapshot policy",
+			req:  "v2:server1:444//foo/bar/baz//some/export//frog//snapshotpolicy=3",
+			expectRet: &qumuloVolume{
+				id:             "v2:server1:444//foo/bar/baz//some/export//frog//snapshotpolicy=3",
+				server:         "server1",
+				restPort:       444,
+				storeRealPath:  "/foo/bar/baz",
+				storeMountPath: "/some/export",
+				name:           "frog",
+				snapshotPolicy: "3",
+			},
+			expectErr: "",
+		},
+		{
+			name: "Happy v2 adopted",
+			req:  "v2:server1:444//projects//projects//alpha//adopted=true",
+			expectRet: &qumuloVolume{
+				id:             "v2:server1:444//projects//projects//alpha//adopted=true",
+				server:         "server1",
+				restPort:       444,
+				storeRealPath:  "/projects",
+				storeMountPath: "/projects",
+				name:           "alpha",
+				adopted:        true,
+			},
+			expectErr: "",
+		},
+		{
+			name:      "v2 bad adopted",
+			req:       "v2:server1:444//projects//projects//alpha//adopted=maybe",
+			expectRet: nil,
+			expectErr: "Invalid options in volume ID " +
+				"\"v2:server1:444//projects//projects//alpha//adopted=maybe\": Invalid option \"adopted\"",
+		},
+		{
+			name:      "v2 missing options",
+			req:       "v2:server1:444//foo/bar/baz//some/export//frog",
+			expectRet: nil,
+			expectErr: "Could not decode volume ID \"v2:server1:444//foo/bar/baz//some/export//frog\"",
+		},
+		{
+			name:      "v2 unknown option",
+			req:       "v2:server1:444//foo//some/export//frog//what=3",
+			expectRet: nil,
+			expectErr: "Invalid options in volume ID \"v2:server1:444//foo//some/export//frog//what=3\": " +
+				"Unknown option \"what\"",
+		},
 	}
 
 	for _, test := range cases {
@@ -877,6 +2121,76 @@ func TestGetQumuloVolumeFromID(t *testing.T) {
 	}
 }
 
+func TestMakeVolumeIDRoundTrip(t *testing.T) {
+	cases := []struct {
+		name     string
+		vol      qumuloVolume
+		expectId string
+	}{
+		{
+			name: "no options uses v1",
+			vol: qumuloVolume{
+				server:         "server1",
+				restPort:       444,
+				storeRealPath:  "/foo/bar",
+				storeMountPath: "/some/export",
+				name:           "frog",
+			},
+			expectId: "v1:server1:444//foo/bar//some/export//frog",
+		},
+		{
+			name: "snapshot policy uses v2",
+			vol: qumuloVolume{
+				server:         "server1",
+				restPort:       444,
+				storeRealPath:  "/",
+				storeMountPath: "/",
+				name:           "frog",
+				snapshotPolicy: "12",
+			},
+			expectId: "v2:server1:444//////frog//snapshotpolicy=12",
+		},
+		{
+			name: "replication uses v2",
+			vol: qumuloVolume{
+				server:         "server1",
+				restPort:       444,
+				storeRealPath:  "/a",
+				storeMountPath: "/",
+				name:           "frog",
+				replicated:     true,
+			},
+			expectId: "v2:server1:444//a////frog//replicated=true",
+		},
+		{
+			name: "namespace directory uses v2",
+			vol: qumuloVolume{
+				server:             "server1",
+				restPort:           444,
+				storeRealPath:      "/a/team-a",
+				storeMountPath:     "/team-a",
+				name:               "frog",
+				namespaceDirectory: true,
+			},
+			expectId: "v2:server1:444//a/team-a//team-a//frog//namespacedirectory=true",
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			id := test.vol.makeID()
+			assert.Equal(t, id, test.expectId)
+
+			vol, err := makeQumuloVolumeFromID(id)
+			assert.NoError(t, err)
+
+			test.vol.id = id
+			assert.Equal(t, *vol, test.vol)
+		})
+	}
+}
+
 func TestGetQuotaLimit(t *testing.T) {
 	cases := []struct {
 		name      string
@@ -1022,6 +2336,239 @@ func TestNewCreateParams(t *testing.T) {
 			),
 			expectRet: nil,
 		},
+		{
+			name:    "non-numeric snapshot policy",
+			volName: "vol1",
+			params: map[string]string{
+				"server":         "somserver",
+				"StoreRealPath":  "/foo/bar",
+				"snapshotPolicy": "nightly",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"invalid snapshotpolicy \"nightly\", must be a policy id",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "snapshot policy",
+			volName: "vol1",
+			params: map[string]string{
+				"server":         "somserver",
+				"StoreRealPath":  "/foo/bar",
+				"snapshotPolicy": "7",
+			},
+			expectErr: nil,
+			expectRet: &CreateParams{
+				server:          "somserver",
+				restPort:        8000,
+				storeRealPath:   "/foo/bar",
+				storeExportPath: "/",
+				name:            "vol1",
+				snapshotPolicy:  "7",
+			},
+		},
+		{
+			name:    "replication missing secret",
+			volName: "vol1",
+			params: map[string]string{
+				"server":                "somserver",
+				"StoreRealPath":         "/foo/bar",
+				"replicationTarget":     "dr",
+				"replicationTargetPath": "/replicas",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"replicationsecretname is required when replicating to another cluster",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "replication relative target path",
+			volName: "vol1",
+			params: map[string]string{
+				"server":                     "somserver",
+				"StoreRealPath":              "/foo/bar",
+				"replicationTarget":          "dr",
+				"replicationTargetPath":      "replicas",
+				"replicationSecretName":      "dr-login",
+				"replicationSecretNamespace": "kube-system",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"replicationtargetpath (\"replicas\") must start with a '/'",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "replication",
+			volName: "vol1",
+			params: map[string]string{
+				"server":                     "somserver",
+				"StoreRealPath":              "/foo/bar",
+				"replicationTarget":          "dr",
+				"replicationTargetRestPort":  "9000",
+				"replicationTargetPath":      "/replicas/",
+				"replicationSecretName":      "dr-login",
+				"replicationSecretNamespace": "kube-system",
+			},
+			expectErr: nil,
+			expectRet: &CreateParams{
+				server:          "somserver",
+				restPort:        8000,
+				storeRealPath:   "/foo/bar",
+				storeExportPath: "/",
+				name:            "vol1",
+				replication: &replicationTarget{
+					server:          "dr",
+					restPort:        9000,
+					path:            "/replicas",
+					secretName:      "dr-login",
+					secretNamespace: "kube-system",
+				},
+			},
+		},
+		{
+			name:    "invalid acl template",
+			volName: "vol1",
+			params: map[string]string{
+				"server":        "somserver",
+				"StoreRealPath": "/foo/bar",
+				"aclTemplate":   "{not json",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"invalid acltemplate: invalid character 'n' looking for beginning of object key string",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "acl template and template path",
+			volName: "vol1",
+			params: map[string]string{
+				"server":          "somserver",
+				"StoreRealPath":   "/foo/bar",
+				"aclTemplate":     "{}",
+				"aclTemplatePath": "/templates/acl",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"only one of acltemplate and acltemplatepath may be given",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "acl template path must start with slash",
+			volName: "vol1",
+			params: map[string]string{
+				"server":          "somserver",
+				"StoreRealPath":   "/foo/bar",
+				"aclTemplatePath": "templates/acl",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"acltemplatepath (\"templates/acl\") must start with a '/'",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "acl template",
+			volName: "vol1",
+			params: map[string]string{
+				"server":        "somserver",
+				"StoreRealPath": "/foo/bar",
+				"aclTemplate": `{"control": ["PRESENT"], "aces": [{"type": "ALLOWED", ` +
+					`"flags": ["CONTAINER_INHERIT"], "trustee": {"name": "CORP\\devs"}, ` +
+					`"rights": ["READ"]}]}`,
+			},
+			expectErr: nil,
+			expectRet: &CreateParams{
+				server:          "somserver",
+				restPort:        8000,
+				storeRealPath:   "/foo/bar",
+				storeExportPath: "/",
+				name:            "vol1",
+				aclTemplate: &FileAcl{
+					Control: []string{"PRESENT"},
+					Aces: []FileAce{
+						{
+							Type:    "ALLOWED",
+							Flags:   []string{"CONTAINER_INHERIT"},
+							Trustee: []byte(`{"name": "CORP\\devs"}`),
+							Rights:  []string{"READ"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:    "namespace directories without metadata",
+			volName: "vol1",
+			params: map[string]string{
+				"server":               "somserver",
+				"StoreRealPath":        "/foo/bar",
+				"namespaceDirectories": "true",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"namespacedirectories requires the provisioner to run with --extra-create-metadata",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "namespace quota without namespace directories",
+			volName: "vol1",
+			params: map[string]string{
+				"server":         "somserver",
+				"StoreRealPath":  "/foo/bar",
+				"namespaceQuota": "10Gi",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"namespacequota requires namespacedirectories",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "invalid namespace quota",
+			volName: "vol1",
+			params: map[string]string{
+				"server":         "somserver",
+				"StoreRealPath":  "/foo/bar",
+				"namespaceQuota": "lots",
+			},
+			expectErr: status.Error(
+				codes.InvalidArgument,
+				"invalid namespacequota \"lots\"",
+			),
+			expectRet: nil,
+		},
+		{
+			name:    "namespace directories",
+			volName: "vol1",
+			params: map[string]string{
+				"server":                           "somserver",
+				"StoreRealPath":                    "/foo/bar",
+				"namespaceDirectories":             "true",
+				"namespaceQuota":                   "10Gi",
+				"csi.storage.k8s.io/pvc/name":      "data",
+				"csi.storage.k8s.io/pvc/namespace": "team-a",
+				"csi.storage.k8s.io/pv/name":       "pvc-1234",
+			},
+			expectErr: nil,
+			expectRet: &CreateParams{
+				server:               "somserver",
+				restPort:             8000,
+				storeRealPath:        "/foo/bar",
+				storeExportPath:      "/",
+				name:                 "vol1",
+				pvcName:              "data",
+				pvcNamespace:         "team-a",
+				pvName:               "pvc-1234",
+				namespaceDirectories: true,
+				namespaceQuota:       10 * 1024 * 1024 * 1024,
+			},
+		},
 		{
 			name:    "default path and export",
 			volName: "vol1",
@@ -0,0 +1,107 @@
+package qumulo
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type restErrorMapping struct {
+	// Zero matches any status.
+	statusCode int
+
+	// Empty matches any error class.
+	errorClass string
+
+	code codes.Code
+}
+
+// How Qumulo errors surface as gRPC codes, unless a call site overrides them. Entries with an
+// error class are matched before those with only a status.
+var restErrorCodes = []restErrorMapping{
+	{0, "fs_no_space_error", codes.ResourceExhausted},
+	{0, "fs_quota_exceeded_error", codes.ResourceExhausted},
+	{0, "fs_access_denied_error", codes.PermissionDenied},
+	{0, "fs_no_such_entry_error", codes.NotFound},
+	{0, "fs_no_such_path_error", codes.NotFound},
+	{0, "fs_entry_exists_error", codes.AlreadyExists},
+	{0, "fs_not_a_directory_error", codes.FailedPrecondition},
+	{0, "fs_directory_not_empty_error", codes.FailedPrecondition},
+
+	{400, "", codes.InvalidArgument},
+	{401, "", codes.Unauthenticated},
+	{403, "", codes.PermissionDenied},
+	{404, "", codes.NotFound},
+	{409, "", codes.FailedPrecondition},
+	{412, "", codes.Aborted},
+	{429, "", codes.ResourceExhausted},
+	{502, "", codes.Unavailable},
+	{503, "", codes.Unavailable},
+	{504, "", codes.Unavailable},
+	{507, "", codes.ResourceExhausted},
+}
+
+func restErrorCode(z RestError) codes.Code {
+	for _, mapping := range restErrorCodes {
+		if mapping.errorClass != "" && mapping.errorClass == z.ErrorClass &&
+			(mapping.statusCode == 0 || mapping.statusCode == z.StatusCode) {
+			return mapping.code
+		}
+	}
+
+	for _, mapping := range restErrorCodes {
+		if mapping.errorClass == "" && mapping.statusCode == z.StatusCode {
+			return mapping.code
+		}
+	}
+
+	return codes.Internal
+}
+
+func describeRestError(z RestError) string {
+	if z.Description == "" {
+		return fmt.Sprintf("Qumulo error %d %s", z.StatusCode, z.ErrorClass)
+	}
+	return fmt.Sprintf("%s (%d %s)", z.Description, z.StatusCode, z.ErrorClass)
+}
+
+// Turn an error from a Connection into a gRPC status. transforms gives errors for statuses
+// which mean something specific to the call site, everything else goes through
+// restErrorCodes.
+func transFormRestError(err error, transforms map[int]error) error {
+	return transFormRestErrorf(err, transforms, "")
+}
+
+// Like transFormRestError, prefixing the message of errors mapped by restErrorCodes.
+func transFormRestErrorf(
+	err error,
+	transforms map[int]error,
+	format string,
+	args ...interface{},
+) error {
+	prefix := ""
+	if format != "" {
+		prefix = fmt.Sprintf(format, args...) + ": "
+	}
+
+	switch z := err.(type) {
+	case nil:
+		return nil
+	case RestError:
+		if handledErr, ok := transforms[z.StatusCode]; ok {
+			return handledErr
+		}
+		return status.Errorf(restErrorCode(z), "%s%s", prefix, describeRestError(z))
+	case ConcurrentModificationError:
+		return status.Errorf(codes.Aborted, "%s%v", prefix, z)
+	}
+
+	// Including failures to reach the cluster, which transportError made Unavailable.
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	// Anything else, like a response which doesn't decode, is a bug on one side or the other.
+	return status.Errorf(codes.Internal, "%s%v", prefix, err)
+}
@@ -0,0 +1,146 @@
+package qumulo
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTransFormRestError(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		transforms map[int]error
+		expectErr  error
+	}{
+		{
+			name:      "nil",
+			err:       nil,
+			expectErr: nil,
+		},
+		{
+			name: "error class wins over status",
+			err: RestError{
+				StatusCode:  409,
+				Description: "Entry exists",
+				ErrorClass:  "fs_entry_exists_error",
+			},
+			expectErr: status.Error(
+				codes.AlreadyExists,
+				"Entry exists (409 fs_entry_exists_error)",
+			),
+		},
+		{
+			name: "quota exceeded",
+			err: RestError{
+				StatusCode:  507,
+				Description: "Quota exceeded",
+				ErrorClass:  "fs_quota_exceeded_error",
+			},
+			expectErr: status.Error(
+				codes.ResourceExhausted,
+				"Quota exceeded (507 fs_quota_exceeded_error)",
+			),
+		},
+		{
+			name: "permission denied",
+			err: RestError{
+				StatusCode:  403,
+				Description: "Access denied",
+				ErrorClass:  "fs_access_denied_error",
+			},
+			expectErr: status.Error(
+				codes.PermissionDenied,
+				"Access denied (403 fs_access_denied_error)",
+			),
+		},
+		{
+			name:      "status only",
+			err:       RestError{StatusCode: 503},
+			expectErr: status.Error(codes.Unavailable, "Qumulo error 503 "),
+		},
+		{
+			name: "unknown",
+			err: RestError{
+				StatusCode:  500,
+				Description: "Oops",
+				ErrorClass:  "something_error",
+			},
+			expectErr: status.Error(codes.Internal, "Oops (500 something_error)"),
+		},
+		{
+			name: "override",
+			err: RestError{
+				StatusCode:  404,
+				Description: "No such entry",
+				ErrorClass:  "fs_no_such_entry_error",
+			},
+			transforms: map[int]error{404: status.Error(codes.NotFound, "volume missing")},
+			expectErr:  status.Error(codes.NotFound, "volume missing"),
+		},
+		{
+			name:      "status error passed through",
+			err:       status.Error(codes.Unauthenticated, "Login failed: 401"),
+			expectErr: status.Error(codes.Unauthenticated, "Login failed: 401"),
+		},
+		{
+			name: "concurrent modification",
+			err:  ConcurrentModificationError{Resource: "Snapshot policy", Id: "3"},
+			expectErr: status.Error(
+				codes.Aborted,
+				"Snapshot policy 3 was modified concurrently too many times",
+			),
+		},
+		{
+			name: "unreachable",
+			err: unreachableError{
+				host: "1.2.3.4",
+				port: 8000,
+				err:  fmt.Errorf("connection reset by peer"),
+			},
+			expectErr: status.Error(
+				codes.Unavailable,
+				"Request to 1.2.3.4:8000 failed: connection reset by peer",
+			),
+		},
+		{
+			name:      "other error",
+			err:       fmt.Errorf("unexpected end of JSON input"),
+			expectErr: status.Error(codes.Internal, "unexpected end of JSON input"),
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			err := transFormRestError(test.err, test.transforms)
+			if test.expectErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, status.Code(err), status.Code(test.expectErr))
+			assert.Equal(
+				t,
+				status.Convert(err).Message(),
+				status.Convert(test.expectErr).Message(),
+			)
+		})
+	}
+}
+
+func TestTransFormRestErrorf(t *testing.T) {
+	err := transFormRestErrorf(
+		RestError{StatusCode: 403, Description: "Access denied"},
+		map[int]error{},
+		"Failed to set quota on %v",
+		"vol1",
+	)
+	assert.Equal(
+		t,
+		err,
+		status.Error(codes.PermissionDenied, "Failed to set quota on vol1: Access denied (403 )"),
+	)
+}
@@ -0,0 +1,163 @@
+package qumulo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events posted to PVCs.
+const (
+	eventReasonProvisioningFailed = "ProvisioningFailed"
+	eventReasonExpansionFailed    = "ExpansionFailed"
+	eventReasonExportMismatch     = "ExportDoesNotCoverDirectory"
+	eventReasonExportMissing      = "ExportNotFound"
+	eventReasonDirectoryMissing   = "StoreDirectoryNotFound"
+	eventReasonClusterVersion     = "ClusterVersionUnsupported"
+	eventReasonLoginFailed        = "ClusterLoginFailed"
+	eventReasonPermissionDenied   = "ClusterPermissionDenied"
+)
+
+// An error with a more specific event reason and a hint on how to fix its cause. It keeps the
+// gRPC status of the error it wraps.
+type remediationError struct {
+	err    error
+	reason string
+	hint   string
+}
+
+func (e *remediationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *remediationError) Unwrap() error {
+	return e.err
+}
+
+func (e *remediationError) GRPCStatus() *status.Status {
+	return status.Convert(e.err)
+}
+
+func withRemediation(err error, reason string, hint string) error {
+	if err == nil {
+		return nil
+	}
+	return &remediationError{err: err, reason: reason, hint: hint}
+}
+
+// Post events through the API client, replacing any earlier recorder.
+func (n *Driver) startEventRecorder() {
+	if n.eventBroadcaster != nil {
+		n.eventBroadcaster.Shutdown()
+		n.eventBroadcaster = nil
+		n.eventRecorder = nil
+	}
+
+	if n.kubeClient == nil {
+		return
+	}
+
+	n.eventBroadcaster = record.NewBroadcaster()
+	n.eventBroadcaster.StartRecordingToSink(
+		&typedcorev1.EventSinkImpl{Interface: n.kubeClient.CoreV1().Events("")},
+	)
+	n.eventRecorder = n.eventBroadcaster.NewRecorder(
+		scheme.Scheme,
+		v1.EventSource{Component: n.name},
+	)
+}
+
+// The reason and hint of an event about err, and err without any remediationError wrapper.
+func describeFailure(err error, defaultReason string) (reason string, hint string, cause error) {
+	var remediation *remediationError
+	if errors.As(err, &remediation) {
+		return remediation.reason, remediation.hint, remediation.err
+	}
+
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		return eventReasonLoginFailed,
+			"Check the username and password in the secret named by the StorageClass",
+			err
+	case codes.PermissionDenied:
+		return eventReasonPermissionDenied,
+			"Grant the cluster user in the secret named by the StorageClass the privileges " +
+				"listed in the driver's Qumulo Cluster Login Parameters documentation",
+			err
+	}
+
+	return defaultReason, "", err
+}
+
+// Post a warning about a failed operation to the PVC, if it's known and the controller has
+// Kubernetes API access. Returns err without its remediation, for the gRPC response.
+func (cs *ControllerServer) recordFailureEvent(
+	ctx context.Context,
+	pvcNamespace string,
+	pvcName string,
+	defaultReason string,
+	err error,
+) error {
+	// Unwrapped without describeFailure when no event is posted, so the status is returned
+	// untouched.
+	var remediation *remediationError
+	cause := err
+	if errors.As(err, &remediation) {
+		cause = remediation.err
+	}
+
+	if cs.Driver.eventRecorder == nil || pvcName == "" {
+		return cause
+	}
+
+	reason, hint, _ := describeFailure(err, defaultReason)
+
+	pvc, getErr := cs.Driver.kubeClient.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(
+		ctx,
+		pvcName,
+		metav1.GetOptions{},
+	)
+	if getErr != nil {
+		logInfo(ctx, 2, "Cannot post event to PVC", "err", getErr)
+		return cause
+	}
+
+	message := status.Convert(cause).Message()
+	if hint != "" {
+		message = fmt.Sprintf("%s. %s", message, hint)
+	}
+
+	cs.Driver.eventRecorder.Event(pvc, v1.EventTypeWarning, reason, message)
+
+	return cause
+}
+
+// The PVC bound to the PV of volumeID, for operations whose request doesn't name it.
+func (cs *ControllerServer) findVolumeClaim(
+	ctx context.Context,
+	volumeID string,
+) (namespace string, name string) {
+	if cs.Driver.kubeClient == nil {
+		return "", ""
+	}
+
+	pv, err := cs.findPersistentVolume(ctx, volumeID)
+	if err != nil {
+		logInfo(ctx, 2, "Cannot find PVC of volume", "err", err)
+		return "", ""
+	}
+
+	if pv == nil || pv.Spec.ClaimRef == nil {
+		return "", ""
+	}
+
+	return pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+}
@@ -0,0 +1,226 @@
+package qumulo
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDescribeFailure(t *testing.T) {
+	versionErr := status.Error(codes.FailedPrecondition, "Cluster version 4.1.0 must be >= 4.2.4")
+
+	cases := []struct {
+		name          string
+		err           error
+		expectReason  string
+		expectHint    string
+		expectedCause error
+	}{
+		{
+			name:          "remediation",
+			err:           withRemediation(versionErr, eventReasonClusterVersion, "Upgrade"),
+			expectReason:  eventReasonClusterVersion,
+			expectHint:    "Upgrade",
+			expectedCause: versionErr,
+		},
+		{
+			name:          "unclassified",
+			err:           versionErr,
+			expectReason:  eventReasonProvisioningFailed,
+			expectedCause: versionErr,
+		},
+		{
+			name:          "login",
+			err:           status.Error(codes.Unauthenticated, "Login failed: 401"),
+			expectReason:  eventReasonLoginFailed,
+			expectHint:    "Check the username and password in the secret named by the StorageClass",
+			expectedCause: status.Error(codes.Unauthenticated, "Login failed: 401"),
+		},
+		{
+			name:         "privilege",
+			err:          status.Error(codes.PermissionDenied, "Failed to set quota"),
+			expectReason: eventReasonPermissionDenied,
+			expectHint: "Grant the cluster user in the secret named by the StorageClass the " +
+				"privileges listed in the driver's Qumulo Cluster Login Parameters documentation",
+			expectedCause: status.Error(codes.PermissionDenied, "Failed to set quota"),
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			reason, hint, cause := describeFailure(test.err, eventReasonProvisioningFailed)
+			assert.Equal(t, reason, test.expectReason)
+			assert.Equal(t, hint, test.expectHint)
+			assert.Equal(t, status.Code(cause), status.Code(test.expectedCause))
+			assert.EqualError(t, cause, test.expectedCause.Error())
+		})
+	}
+}
+
+func TestRemediationErrorKeepsStatus(t *testing.T) {
+	err := withRemediation(status.Error(codes.NotFound, "Export \"/x\" not found"), "r", "h")
+	assert.Equal(t, status.Code(err), codes.NotFound)
+	assert.EqualError(t, err, "rpc error: code = NotFound desc = Export \"/x\" not found")
+	assert.Nil(t, withRemediation(nil, "r", "h"))
+}
+
+func newEventTestController(t *testing.T, messages *[]Message) *ControllerServer {
+	cs := initTestController(t)
+	client := fake.NewSimpleClientset(
+		&v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "team-a", UID: "1234"},
+		},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234"},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{
+						Driver:       DefaultDriverName,
+						VolumeHandle: "v1:1.2.3.4:44//a//a//pvc-1234",
+					},
+				},
+				ClaimRef: &v1.ObjectReference{Name: "data", Namespace: "team-a"},
+			},
+		},
+	)
+
+	// The fake rejects the namespaced events the recorder creates through Events("").
+	client.PrependReactor(
+		"create",
+		"events",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			event := action.(k8stesting.CreateAction).GetObject().(*v1.Event)
+			err := client.Tracker().Create(action.GetResource(), event, event.Namespace)
+			return true, event, err
+		},
+	)
+
+	cs.Driver.SetKubeClient(client)
+	t.Cleanup(func() { cs.Driver.SetKubeClient(nil) })
+
+	cs.Driver.sessions.newClient = func(TLSOptions) (*http.Client, error) {
+		return newTestClient(t, "1.2.3.4", 44, messages), nil
+	}
+
+	return cs
+}
+
+// Events are written by a background goroutine.
+func waitForEvents(t *testing.T, cs *ControllerServer, count int) []v1.Event {
+	var events []v1.Event
+	assert.Eventually(
+		t,
+		func() bool {
+			list, err := cs.Driver.kubeClient.CoreV1().Events("team-a").List(
+				context.TODO(),
+				metav1.ListOptions{},
+			)
+			assert.NoError(t, err)
+			events = list.Items
+			return len(events) >= count
+		},
+		5*time.Second,
+		10*time.Millisecond,
+	)
+	return events
+}
+
+func TestCreateVolumeEventExportMismatch(t *testing.T) {
+	messages := append(
+		connectMessages("yeruncle"),
+		Message{"/v2/nfs/exports/%2Fexport", 200, "", "{\"id\": \"3\", \"fs_path\": \"/b\"}"},
+	)
+	cs := newEventTestController(t, &messages)
+
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-1234",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+				},
+			},
+		},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024},
+		Parameters: map[string]string{
+			"server":                           "1.2.3.4",
+			"restport":                         "44",
+			"storerealpath":                    "/a",
+			"storeexportpath":                  "/export",
+			"csi.storage.k8s.io/pvc/name":      "data",
+			"csi.storage.k8s.io/pvc/namespace": "team-a",
+		},
+		Secrets: map[string]string{"username": "bob", "password": "yeruncle"},
+	}
+
+	_, err := cs.CreateVolume(context.TODO(), req)
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+	assert.EqualError(
+		t,
+		err,
+		"rpc error: code = InvalidArgument desc = Volume directory \"/a\" would not be "+
+			"accessible via export \"/export\" fs_path \"/b\"",
+	)
+	assertMessagesConsumed(t, messages)
+
+	events := waitForEvents(t, cs, 1)
+	assert.Equal(t, events[0].InvolvedObject.Kind, "PersistentVolumeClaim")
+	assert.Equal(t, events[0].InvolvedObject.Name, "data")
+	assert.Equal(t, string(events[0].InvolvedObject.UID), "1234")
+	assert.Equal(t, events[0].Type, v1.EventTypeWarning)
+	assert.Equal(t, events[0].Reason, eventReasonExportMismatch)
+	assert.Equal(
+		t,
+		events[0].Message,
+		"Volume directory \"/a\" would not be accessible via export \"/export\" fs_path \"/b\". "+
+			"Change the fs_path of export \"/export\" on cluster 1.2.3.4 to \"/a\" or one of its "+
+			"parents, or set storeexportpath to an export which does",
+	)
+}
+
+func TestExpandVolumeEventClusterVersion(t *testing.T) {
+	messages := []Message{
+		{"/v1/version", 200, "", "{\"revision_id\": \"Qumulo Core 4.1.0\"}"},
+	}
+	cs := newEventTestController(t, &messages)
+
+	req := &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "v1:1.2.3.4:44//a//a//pvc-1234",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2048},
+		Secrets:       map[string]string{"username": "bob", "password": "yeruncle"},
+	}
+
+	_, err := cs.ControllerExpandVolume(context.TODO(), req)
+	assert.Equal(t, status.Code(err), codes.FailedPrecondition)
+	assert.EqualError(
+		t,
+		err,
+		"rpc error: code = FailedPrecondition desc = Cluster version 4.1.0 must be >= 4.2.4",
+	)
+	assertMessagesConsumed(t, messages)
+
+	events := waitForEvents(t, cs, 1)
+	assert.Equal(t, events[0].InvolvedObject.Name, "data")
+	assert.Equal(t, events[0].Reason, eventReasonClusterVersion)
+	assert.Equal(
+		t,
+		events[0].Message,
+		"Cluster version 4.1.0 must be >= 4.2.4. "+
+			"Upgrade cluster 1.2.3.4 to Qumulo Core 4.2.4 or later",
+	)
+}
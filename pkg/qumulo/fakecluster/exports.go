@@ -0,0 +1,204 @@
+package fakecluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type export struct {
+	Id                     string          `json:"id"`
+	ExportPath             string          `json:"export_path"`
+	FsPath                 string          `json:"fs_path"`
+	Description            string          `json:"description"`
+	TenantId               int             `json:"tenant_id"`
+	Restrictions           json.RawMessage `json:"restrictions"`
+	FieldsToPresentAs32Bit []string        `json:"fields_to_present_as_32_bit"`
+
+	// Changed by every modification, and sent as the ETag.
+	generation int
+}
+
+func (e *export) etag() string {
+	return fmt.Sprintf("\"%d\"", e.generation)
+}
+
+// Read-write for every host, without user mapping.
+var defaultRestrictions = json.RawMessage(
+	`[{"host_restrictions": [], "read_only": false, "require_privileged_port": false, ` +
+		`"user_mapping": "NFS_MAP_NONE", ` +
+		`"map_to_user": {"id_type": "LOCAL_USER", "id_value": "0"}}]`,
+)
+
+// Look up an export by export path or by id.
+func (s *Server) lookUpExport(ref string) (*export, error) {
+	if !strings.HasPrefix(ref, "/") {
+		if e, ok := s.exports[ref]; ok {
+			return e, nil
+		}
+	} else {
+		for _, e := range s.exports {
+			if e.ExportPath == path.Clean(ref) {
+				return e, nil
+			}
+		}
+	}
+
+	return nil, errorf(404, "nfs_export_doesnt_exist_error", "Export %s does not exist", ref)
+}
+
+func (s *Server) listExports(r *request) (interface{}, error) {
+	exports := []*export{}
+	for _, e := range s.exports {
+		exports = append(exports, e)
+	}
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].ExportPath < exports[j].ExportPath
+	})
+
+	return exports, nil
+}
+
+// Check and normalize the body of a create or modify request. The export's fs path must
+// exist, or with ?allow-fs-path-create=true it is created as needed.
+func (s *Server) checkExport(r *request, body *export) error {
+	if !strings.HasPrefix(body.ExportPath, "/") || !strings.HasPrefix(body.FsPath, "/") {
+		return errorf(
+			400,
+			"nfs_export_invalid_path_error",
+			"Export path %q and fs path %q must be absolute",
+			body.ExportPath,
+			body.FsPath,
+		)
+	}
+	body.ExportPath = path.Clean(body.ExportPath)
+	body.FsPath = path.Clean(body.FsPath)
+
+	if e, err := s.lookUpExport(body.ExportPath); err == nil && e.Id != body.Id {
+		return errorf(
+			409,
+			"nfs_export_duplicate_error",
+			"Export %s already exists",
+			body.ExportPath,
+		)
+	}
+
+	var err error
+	if r.URL.Query().Get("allow-fs-path-create") == "true" {
+		_, err = s.createDirectories(body.FsPath)
+	} else {
+		_, err = s.lookUpDirectory(body.FsPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(body.Restrictions) == 0 {
+		body.Restrictions = defaultRestrictions
+	}
+	if body.TenantId == 0 {
+		body.TenantId = 1
+	}
+	if body.FieldsToPresentAs32Bit == nil {
+		body.FieldsToPresentAs32Bit = []string{}
+	}
+
+	return nil
+}
+
+// Fail with 412 if If-Match names an older version of e.
+func checkExportEtag(r *request, e *export) error {
+	if match := r.Header.Get("If-Match"); match != "" && match != e.etag() {
+		return errorf(
+			412,
+			"http_precondition_failed_error",
+			"Export %s was modified",
+			r.args[0],
+		)
+	}
+	return nil
+}
+
+func (s *Server) createExport(r *request) (interface{}, error) {
+	var body export
+	err := decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	body.Id = ""
+	err = s.checkExport(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	body.Id = strconv.Itoa(s.nextExportId)
+	s.nextExportId++
+	s.exports[body.Id] = &body
+
+	r.header.Set("ETag", body.etag())
+
+	return body, nil
+}
+
+func (s *Server) getExport(r *request) (interface{}, error) {
+	e, err := s.lookUpExport(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	r.header.Set("ETag", e.etag())
+
+	return e, nil
+}
+
+// Replace an export, keeping its id.
+func (s *Server) modifyExport(r *request) (interface{}, error) {
+	e, err := s.lookUpExport(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkExportEtag(r, e)
+	if err != nil {
+		return nil, err
+	}
+
+	var body export
+	err = decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	body.Id = e.Id
+	err = s.checkExport(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	body.generation = e.generation + 1
+	*e = body
+
+	r.header.Set("ETag", e.etag())
+
+	return e, nil
+}
+
+func (s *Server) deleteExport(r *request) (interface{}, error) {
+	e, err := s.lookUpExport(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkExportEtag(r, e)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(s.exports, e.Id)
+
+	return nil, nil
+}
@@ -0,0 +1,590 @@
+package fakecluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	directoryType = "FS_FILE_TYPE_DIRECTORY"
+	fileType      = "FS_FILE_TYPE_FILE"
+
+	// The local admin user and Users group.
+	defaultOwner = "500"
+	defaultGroup = "513"
+)
+
+type file struct {
+	id       string
+	name     string
+	parent   *file
+	fileType string
+	mode     uint32
+	owner    string
+	group    string
+	size     uint64
+
+	// Derived from mode when nil.
+	acl *acl
+
+	created  time.Time
+	modified time.Time
+	changed  time.Time
+
+	// By name, for directories.
+	children map[string]*file
+}
+
+func newFile(id string, name string, fileType string, parent *file) *file {
+	now := time.Now()
+
+	f := &file{
+		id:       id,
+		name:     name,
+		parent:   parent,
+		fileType: fileType,
+		mode:     0666,
+		owner:    defaultOwner,
+		group:    defaultGroup,
+		created:  now,
+		modified: now,
+		changed:  now,
+	}
+
+	if fileType == directoryType {
+		f.mode = 0777
+		f.children = map[string]*file{}
+	}
+
+	return f
+}
+
+func (f *file) isDirectory() bool {
+	return f.fileType == directoryType
+}
+
+// The path as the cluster reports it, with a trailing '/' for directories.
+func (f *file) path() string {
+	if f.parent == nil {
+		return "/"
+	}
+
+	p := f.parent.path() + f.name
+	if f.isDirectory() {
+		p += "/"
+	}
+	return p
+}
+
+// Bytes used by the file, or by everything under a directory.
+func (f *file) usage() uint64 {
+	usage := f.size
+	for _, child := range f.children {
+		usage += child.usage()
+	}
+	return usage
+}
+
+func (f *file) sortedChildNames() []string {
+	names := []string{}
+	for name := range f.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *file) touch() {
+	now := time.Now()
+	f.modified = now
+	f.changed = now
+}
+
+func noSuchEntry(ref string) error {
+	return errorf(404, "fs_no_such_entry_error", "%s does not exist", ref)
+}
+
+// Look up a file by absolute path or by id, like the {ref} of the files API.
+func (s *Server) lookUp(ref string) (*file, error) {
+	if !strings.HasPrefix(ref, "/") {
+		f, ok := s.files[ref]
+		if !ok {
+			return nil, noSuchEntry(ref)
+		}
+		return f, nil
+	}
+
+	f := s.root
+	for _, name := range strings.Split(path.Clean(ref), "/") {
+		if name == "" {
+			continue
+		}
+		child, ok := f.children[name]
+		if !ok {
+			return nil, noSuchEntry(ref)
+		}
+		f = child
+	}
+
+	return f, nil
+}
+
+func (s *Server) lookUpDirectory(ref string) (*file, error) {
+	f, err := s.lookUp(ref)
+	if err != nil {
+		return nil, err
+	}
+	if !f.isDirectory() {
+		return nil, errorf(400, "fs_not_a_directory_error", "%s is not a directory", ref)
+	}
+	return f, nil
+}
+
+func (s *Server) create(parent *file, name string, fileType string) (*file, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return nil, errorf(400, "fs_invalid_file_name_error", "Invalid name %q", name)
+	}
+	if _, ok := parent.children[name]; ok {
+		return nil, errorf(
+			409,
+			"fs_entry_exists_error",
+			"%s already exists",
+			parent.path()+name,
+		)
+	}
+
+	f := newFile(strconv.Itoa(s.nextId), name, fileType, parent)
+	s.nextId++
+
+	parent.children[name] = f
+	parent.touch()
+	s.files[f.id] = f
+
+	return f, nil
+}
+
+// Unlink f and everything under it.
+func (s *Server) remove(f *file) {
+	for _, child := range f.children {
+		s.remove(child)
+	}
+
+	delete(s.files, f.id)
+	delete(s.quotas, f.id)
+	delete(s.treeDeletes, f.id)
+
+	if f.parent != nil && f.parent.children[f.name] == f {
+		delete(f.parent.children, f.name)
+		f.parent.touch()
+	}
+}
+
+// Create a directory and any missing parents, as a test fixture.
+func (s *Server) CreateDirectory(dirPath string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.createDirectories(dirPath)
+	return err
+}
+
+func (s *Server) createDirectories(dirPath string) (*file, error) {
+	f := s.root
+	for _, name := range strings.Split(path.Clean(dirPath), "/") {
+		if name == "" {
+			continue
+		}
+
+		child, ok := f.children[name]
+		if !ok {
+			var err error
+			child, err = s.create(f, name, directoryType)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !child.isDirectory() {
+			return nil, errorf(400, "fs_not_a_directory_error", "%s is not a directory", dirPath)
+		}
+		f = child
+	}
+
+	return f, nil
+}
+
+// Set the size of a file, so it shows in the capacity usage of quotas above it.
+func (s *Server) SetFileSize(filePath string, size uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, err := s.lookUp(filePath)
+	if err != nil {
+		return err
+	}
+	if f.isDirectory() {
+		return fmt.Errorf("%s is a directory", filePath)
+	}
+
+	f.size = size
+	f.touch()
+
+	return nil
+}
+
+/*        _   _        _ _           _
+ *   __ _| |_| |_ _ __(_) |__  _   _| |_ ___  ___
+ *  / _` | __| __| '__| | '_ \| | | | __/ _ \/ __|
+ * | (_| | |_| |_| |  | | |_) | |_| | ||  __/\__ \
+ *  \__,_|\__|\__|_|  |_|_.__/ \__,_|\__\___||___/
+ *  FIGLET: attributes
+ */
+
+type attributes struct {
+	Path             string `json:"path"`
+	Name             string `json:"name"`
+	Id               string `json:"id"`
+	FileNumber       string `json:"file_number"`
+	Type             string `json:"type"`
+	Mode             string `json:"mode"`
+	Owner            string `json:"owner"`
+	Group            string `json:"group"`
+	Size             string `json:"size"`
+	NumLinks         int    `json:"num_links"`
+	ChildCount       int    `json:"child_count"`
+	CreationTime     string `json:"creation_time"`
+	ModificationTime string `json:"modification_time"`
+	ChangeTime       string `json:"change_time"`
+}
+
+func (f *file) attributes() attributes {
+	numLinks := 1
+	if f.isDirectory() {
+		// Its entry in the parent, its "." and the ".." of each subdirectory.
+		numLinks = 2
+		for _, child := range f.children {
+			if child.isDirectory() {
+				numLinks++
+			}
+		}
+	}
+
+	return attributes{
+		Path:             f.path(),
+		Name:             f.name,
+		Id:               f.id,
+		FileNumber:       f.id,
+		Type:             f.fileType,
+		Mode:             fmt.Sprintf("%04o", f.mode),
+		Owner:            f.owner,
+		Group:            f.group,
+		Size:             strconv.FormatUint(f.size, 10),
+		NumLinks:         numLinks,
+		ChildCount:       len(f.children),
+		CreationTime:     formatTime(f.created),
+		ModificationTime: formatTime(f.modified),
+		ChangeTime:       formatTime(f.changed),
+	}
+}
+
+func (s *Server) getAttributes(r *request) (interface{}, error) {
+	f, err := s.lookUp(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return f.attributes(), nil
+}
+
+type setAttributesRequest struct {
+	Mode string `json:"mode"`
+}
+
+func (s *Server) setAttributes(r *request) (interface{}, error) {
+	f, err := s.lookUp(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var body setAttributesRequest
+	err = decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.Mode != "" {
+		mode, err := strconv.ParseUint(body.Mode, 8, 32)
+		if err != nil || mode > 07777 {
+			return nil, errorf(400, "http_bad_request_error", "Invalid mode %q", body.Mode)
+		}
+
+		// Like chmod, replaces the ACL with one for the mode.
+		f.mode = uint32(mode)
+		f.acl = nil
+		f.changed = time.Now()
+	}
+
+	return f.attributes(), nil
+}
+
+/*             _        _
+ *   ___ _ __ | |_ _ __(_) ___  ___
+ *  / _ \ '_ \| __| '__| |/ _ \/ __|
+ * |  __/ | | | |_| |  | |  __/\__ \
+ *  \___|_| |_|\__|_|  |_|\___||___/
+ *  FIGLET: entries
+ */
+
+type listEntriesResponse struct {
+	Files  []attributes `json:"files"`
+	Paging paging       `json:"paging"`
+}
+
+func (s *Server) listEntries(r *request) (interface{}, error) {
+	dir, err := s.lookUpDirectory(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	names, next, err := paginate(r.Request, dir.sortedChildNames())
+	if err != nil {
+		return nil, err
+	}
+
+	response := listEntriesResponse{Files: []attributes{}, Paging: paging{Next: next}}
+	for _, name := range names {
+		response.Files = append(response.Files, dir.children[name].attributes())
+	}
+
+	return response, nil
+}
+
+type createEntryRequest struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+func (s *Server) createEntry(r *request) (interface{}, error) {
+	dir, err := s.lookUpDirectory(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var body createEntryRequest
+	err = decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	var newType string
+	switch body.Action {
+	case "CREATE_DIRECTORY":
+		newType = directoryType
+	case "CREATE_FILE":
+		newType = fileType
+	default:
+		return nil, errorf(400, "http_bad_request_error", "Unsupported action %q", body.Action)
+	}
+
+	f, err := s.create(dir, body.Name, newType)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.attributes(), nil
+}
+
+// Delete a file or an empty directory.
+func (s *Server) deleteFile(r *request) (interface{}, error) {
+	f, err := s.lookUp(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if f == s.root {
+		return nil, errorf(403, "fs_access_denied_error", "The root directory can't be deleted")
+	}
+	if len(f.children) != 0 {
+		return nil, errorf(409, "fs_directory_not_empty_error", "%s is not empty", f.path())
+	}
+
+	s.remove(f)
+
+	return nil, nil
+}
+
+/*     _    ____ _
+ *    / \  / ___| |    ___
+ *   / _ \| |   | |   / __|
+ *  / ___ \ |___| |___\__ \
+ * /_/   \_\____|_____|___/
+ *  FIGLET: ACLs
+ */
+
+type acl struct {
+	Control                 []string `json:"control"`
+	PosixSpecialPermissions []string `json:"posix_special_permissions"`
+	Aces                    []ace    `json:"aces"`
+}
+
+type ace struct {
+	Type    string          `json:"type"`
+	Flags   []string        `json:"flags"`
+	Trustee json.RawMessage `json:"trustee"`
+	Rights  []string        `json:"rights"`
+}
+
+// The fields of a trustee which say who it is.
+type trustee struct {
+	Domain string `json:"domain"`
+	AuthId string `json:"auth_id"`
+}
+
+const worldDomain = "WORLD"
+
+// Mode bits are modelled with one right each.
+var modeRights = []struct {
+	bit   uint32
+	right string
+}{
+	{4, "READ"},
+	{2, "WRITE_FILE"},
+	{1, "EXECUTE"},
+}
+
+// The ACL the cluster gives a file with only mode bits: an allow for each of the owner, group
+// and everyone with any bits set.
+func (f *file) modeAcl() acl {
+	result := acl{Control: []string{"PRESENT"}, PosixSpecialPermissions: []string{}, Aces: []ace{}}
+
+	trustees := []struct {
+		shift   uint
+		trustee trustee
+	}{
+		{6, trustee{Domain: "LOCAL", AuthId: f.owner}},
+		{3, trustee{Domain: "LOCAL", AuthId: f.group}},
+		{0, trustee{Domain: worldDomain, AuthId: "8589934592"}},
+	}
+
+	for _, t := range trustees {
+		bits := (f.mode >> t.shift) & 7
+		if bits == 0 {
+			continue
+		}
+
+		rights := []string{}
+		for _, r := range modeRights {
+			if bits&r.bit != 0 {
+				rights = append(rights, r.right)
+			}
+		}
+
+		data, err := json.Marshal(t.trustee)
+		if err != nil {
+			panic(err)
+		}
+		result.Aces = append(
+			result.Aces,
+			ace{Type: "ALLOWED", Flags: []string{}, Trustee: data, Rights: rights},
+		)
+	}
+
+	return result
+}
+
+// The mode bits granted to the owner, group and everyone by an ACL.
+func (f *file) aclMode(a acl) uint32 {
+	mode := f.mode &^ 0777
+
+	for _, ace := range a.Aces {
+		if ace.Type != "ALLOWED" {
+			continue
+		}
+
+		var t trustee
+		json.Unmarshal(ace.Trustee, &t)
+
+		var shift uint
+		switch {
+		case t.Domain == worldDomain:
+			shift = 0
+		case t.AuthId == f.owner:
+			shift = 6
+		case t.AuthId == f.group:
+			shift = 3
+		default:
+			continue
+		}
+
+		for _, r := range modeRights {
+			for _, right := range ace.Rights {
+				if right == r.right {
+					mode |= r.bit << shift
+				}
+			}
+		}
+	}
+
+	return mode
+}
+
+func (f *file) getAcl() acl {
+	if f.acl != nil {
+		return *f.acl
+	}
+	return f.modeAcl()
+}
+
+func (s *Server) getAcl(r *request) (interface{}, error) {
+	f, err := s.lookUp(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return f.getAcl(), nil
+}
+
+// Replace the ACL, updating the mode bits to match it like the cluster does.
+func (s *Server) setAcl(r *request) (interface{}, error) {
+	f, err := s.lookUp(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var body acl
+	err = decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ace := range body.Aces {
+		if ace.Type != "ALLOWED" && ace.Type != "DENIED" {
+			return nil, errorf(400, "fs_invalid_acl_error", "Invalid ACE type %q", ace.Type)
+		}
+		var t trustee
+		err := json.Unmarshal(ace.Trustee, &t)
+		if err != nil || (t.Domain == "" && t.AuthId == "") {
+			return nil, errorf(400, "fs_invalid_acl_error", "Invalid trustee %s", ace.Trustee)
+		}
+	}
+
+	if body.Control == nil {
+		body.Control = []string{}
+	}
+	if body.PosixSpecialPermissions == nil {
+		body.PosixSpecialPermissions = []string{}
+	}
+	if body.Aces == nil {
+		body.Aces = []ace{}
+	}
+
+	f.acl = &body
+	f.mode = f.aclMode(body)
+	f.changed = time.Now()
+
+	return f.getAcl(), nil
+}
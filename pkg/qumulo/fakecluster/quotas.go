@@ -0,0 +1,175 @@
+package fakecluster
+
+import (
+	"sort"
+	"strconv"
+)
+
+type quota struct {
+	Id    string `json:"id"`
+	Limit string `json:"limit"`
+}
+
+type quotaStatus struct {
+	Id            string `json:"id"`
+	Path          string `json:"path"`
+	Limit         string `json:"limit"`
+	CapacityUsage string `json:"capacity_usage"`
+}
+
+type listQuotasResponse struct {
+	Quotas []quota `json:"quotas"`
+	Paging paging  `json:"paging"`
+}
+
+type listQuotaStatusResponse struct {
+	Quotas []quotaStatus `json:"quotas"`
+	Paging paging        `json:"paging"`
+}
+
+func quotaNotFound(id string) error {
+	return errorf(404, "api_quotas_quota_limit_not_found_error", "No quota on %s", id)
+}
+
+func parseLimit(value string) (uint64, error) {
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errorf(400, "http_bad_request_error", "Invalid limit %q", value)
+	}
+	return limit, nil
+}
+
+func (s *Server) quota(id string) quota {
+	return quota{Id: id, Limit: strconv.FormatUint(s.quotas[id], 10)}
+}
+
+func (s *Server) quotaStatus(id string) quotaStatus {
+	f := s.files[id]
+	return quotaStatus{
+		Id:            id,
+		Path:          f.path(),
+		Limit:         strconv.FormatUint(s.quotas[id], 10),
+		CapacityUsage: strconv.FormatUint(f.usage(), 10),
+	}
+}
+
+// The ids of directories with quotas, paged by id.
+func (s *Server) pageQuotas(r *request) ([]string, string, error) {
+	ids := []string{}
+	for id := range s.quotas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return paginate(r.Request, ids)
+}
+
+func (s *Server) listQuotas(r *request) (interface{}, error) {
+	ids, next, err := s.pageQuotas(r)
+	if err != nil {
+		return nil, err
+	}
+
+	response := listQuotasResponse{Quotas: []quota{}, Paging: paging{Next: next}}
+	for _, id := range ids {
+		response.Quotas = append(response.Quotas, s.quota(id))
+	}
+
+	return response, nil
+}
+
+func (s *Server) createQuota(r *request) (interface{}, error) {
+	var body quota
+	err := decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.lookUpDirectory(body.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := parseLimit(body.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := s.quotas[f.id]; ok {
+		return nil, errorf(
+			409,
+			"api_quotas_quota_limit_already_set_error",
+			"A quota is already set on %s",
+			f.id,
+		)
+	}
+
+	s.quotas[f.id] = limit
+
+	return s.quota(f.id), nil
+}
+
+func (s *Server) getQuota(r *request) (interface{}, error) {
+	id := r.args[0]
+	if _, ok := s.quotas[id]; !ok {
+		return nil, quotaNotFound(id)
+	}
+
+	return s.quota(id), nil
+}
+
+func (s *Server) updateQuota(r *request) (interface{}, error) {
+	id := r.args[0]
+	if _, ok := s.quotas[id]; !ok {
+		return nil, quotaNotFound(id)
+	}
+
+	var body quota
+	err := decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := parseLimit(body.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	s.quotas[id] = limit
+
+	return s.quota(id), nil
+}
+
+func (s *Server) deleteQuota(r *request) (interface{}, error) {
+	id := r.args[0]
+	if _, ok := s.quotas[id]; !ok {
+		return nil, quotaNotFound(id)
+	}
+
+	delete(s.quotas, id)
+
+	return nil, nil
+}
+
+func (s *Server) listQuotaStatus(r *request) (interface{}, error) {
+	ids, next, err := s.pageQuotas(r)
+	if err != nil {
+		return nil, err
+	}
+
+	response := listQuotaStatusResponse{Quotas: []quotaStatus{}, Paging: paging{Next: next}}
+	for _, id := range ids {
+		response.Quotas = append(response.Quotas, s.quotaStatus(id))
+	}
+
+	return response, nil
+}
+
+func (s *Server) getQuotaStatus(r *request) (interface{}, error) {
+	id := r.args[0]
+	if _, ok := s.quotas[id]; !ok {
+		return nil, quotaNotFound(id)
+	}
+
+	return s.quotaStatus(id), nil
+}
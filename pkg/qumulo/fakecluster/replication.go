@@ -0,0 +1,163 @@
+package fakecluster
+
+import (
+	"fmt"
+	"sort"
+)
+
+type replicationSourceRelationship struct {
+	Id             string `json:"id"`
+	TargetAddress  string `json:"target_address"`
+	TargetPort     int    `json:"target_port"`
+	SourceRootId   string `json:"source_root_id"`
+	TargetRootPath string `json:"target_root_path"`
+}
+
+type replicationTargetStatus struct {
+	Id               string `json:"id"`
+	State            string `json:"state"`
+	EndReason        string `json:"end_reason"`
+	SourceAddress    string `json:"source_address"`
+	TargetRootPath   string `json:"target_root_path"`
+	ErrorFromLastJob string `json:"error_from_last_job"`
+}
+
+// Relationships created on s show up on target awaiting authorization, as if target_address
+// named it. Without a target they stay unknown to every other cluster. nil stops replicating.
+func (s *Server) ReplicateTo(target *Server) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.replicatesTo = target
+}
+
+// Set the state of the target relationship replicating to targetRootPath, e.g. "ENDED" with
+// an end reason. Returns false if there is none.
+func (s *Server) SetReplicationTargetState(
+	targetRootPath string,
+	state string,
+	endReason string,
+) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, status := range s.replicationTargets {
+		if status.TargetRootPath == targetRootPath {
+			status.State = state
+			status.EndReason = endReason
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) listReplicationSources(r *request) (interface{}, error) {
+	relationships := []*replicationSourceRelationship{}
+	for _, relationship := range s.replicationSources {
+		relationships = append(relationships, relationship)
+	}
+	sort.Slice(relationships, func(i, j int) bool {
+		return relationships[i].Id < relationships[j].Id
+	})
+
+	return relationships, nil
+}
+
+func (s *Server) createReplicationSource(r *request) (interface{}, error) {
+	var relationship replicationSourceRelationship
+	err := decodeBody(r.Request, &relationship)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.lookUpDirectory(relationship.SourceRootId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, existing := range s.replicationSources {
+		if existing.SourceRootId == relationship.SourceRootId {
+			return nil, errorf(
+				409,
+				"replication_source_root_already_in_relationship_error",
+				"%s is already the source of relationship %s",
+				relationship.SourceRootId,
+				existing.Id,
+			)
+		}
+	}
+
+	s.nextRelationshipId++
+	relationship.Id = fmt.Sprintf("fake-relationship-%d", s.nextRelationshipId)
+	s.replicationSources[relationship.Id] = &relationship
+
+	if target := s.replicatesTo; target != nil {
+		if target != s {
+			target.mutex.Lock()
+			defer target.mutex.Unlock()
+		}
+		target.replicationTargets[relationship.Id] = &replicationTargetStatus{
+			Id:             relationship.Id,
+			State:          "AWAITING_AUTHORIZATION",
+			SourceAddress:  s.Host,
+			TargetRootPath: relationship.TargetRootPath,
+		}
+	}
+
+	return relationship, nil
+}
+
+func (s *Server) deleteReplicationSource(r *request) (interface{}, error) {
+	id := r.args[0]
+	if _, ok := s.replicationSources[id]; !ok {
+		return nil, errorf(
+			404,
+			"replication_relationship_not_found_error",
+			"Relationship %s does not exist",
+			id,
+		)
+	}
+
+	delete(s.replicationSources, id)
+
+	return nil, nil
+}
+
+func (s *Server) listReplicationTargetStatuses(r *request) (interface{}, error) {
+	statuses := []*replicationTargetStatus{}
+	for _, status := range s.replicationTargets {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Id < statuses[j].Id
+	})
+
+	return statuses, nil
+}
+
+func (s *Server) authorizeReplicationTarget(r *request) (interface{}, error) {
+	status, ok := s.replicationTargets[r.args[0]]
+	if !ok {
+		return nil, errorf(
+			404,
+			"replication_relationship_not_found_error",
+			"Relationship %s does not exist",
+			r.args[0],
+		)
+	}
+
+	if status.State != "AWAITING_AUTHORIZATION" {
+		return nil, errorf(
+			400,
+			"replication_relationship_not_awaiting_authorization_error",
+			"Relationship %s is %s",
+			status.Id,
+			status.State,
+		)
+	}
+
+	status.State = "ESTABLISHED"
+
+	return status, nil
+}
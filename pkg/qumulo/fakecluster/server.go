@@ -0,0 +1,460 @@
+// Package fakecluster is an in-memory Qumulo cluster which serves the parts of the REST API
+// the driver uses over HTTPS, so REST and controller code can be tested without a cluster.
+//
+// Errors carry the status codes and error classes a cluster returns for the cases the driver
+// handles, such as fs_entry_exists_error or api_quotas_quota_limit_already_set_error.
+package fakecluster
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultRevision = "Qumulo Core 5.0.0"
+
+type Server struct {
+	// Where the REST API is served, with a self-signed certificate from CACert.
+	Host string
+	Port int
+
+	server *httptest.Server
+
+	mutex sync.Mutex
+
+	username  string
+	password  string
+	revision  string
+	tokens    map[string]bool
+	nextToken int
+
+	root   *file
+	files  map[string]*file
+	nextId int
+
+	quotas map[string]uint64
+
+	exports      map[string]*export
+	nextExportId int
+
+	treeDeletes     map[string]*treeDeleteJob
+	holdTreeDeletes bool
+
+	policies     map[string]*snapshotPolicy
+	nextPolicyId int
+
+	replicationSources map[string]*replicationSourceRelationship
+	replicationTargets map[string]*replicationTargetStatus
+	replicatesTo       *Server
+	nextRelationshipId int
+}
+
+// Start a cluster with an empty root directory, exported as "/", which username can log in
+// to with password. Close it when done.
+func NewServer(username string, password string) *Server {
+	s := &Server{
+		username:     username,
+		password:     password,
+		revision:     DefaultRevision,
+		tokens:       map[string]bool{},
+		files:        map[string]*file{},
+		nextId:       3,
+		quotas:       map[string]uint64{},
+		exports:      map[string]*export{},
+		nextExportId: 2,
+		treeDeletes:  map[string]*treeDeleteJob{},
+		policies:     map[string]*snapshotPolicy{},
+		nextPolicyId: 1,
+
+		replicationSources: map[string]*replicationSourceRelationship{},
+		replicationTargets: map[string]*replicationTargetStatus{},
+	}
+
+	// As on a real cluster, the root directory has id 2 and export 1 is "/".
+	s.root = newFile("2", "", directoryType, nil)
+	s.files[s.root.id] = s.root
+	s.exports["1"] = &export{
+		Id:                     "1",
+		ExportPath:             "/",
+		FsPath:                 "/",
+		TenantId:               1,
+		Restrictions:           defaultRestrictions,
+		FieldsToPresentAs32Bit: []string{},
+	}
+
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+
+	serverUrl, err := url.Parse(s.server.URL)
+	if err != nil {
+		panic(err)
+	}
+	s.Host = serverUrl.Hostname()
+	s.Port, err = strconv.Atoi(serverUrl.Port())
+	if err != nil {
+		panic(err)
+	}
+
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// The PEM encoded certificate the cluster serves, for verifying it.
+func (s *Server) CACert() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+}
+
+// Set the revision_id returned by /v1/version, e.g. "Qumulo Core 4.2.0".
+func (s *Server) SetRevision(revision string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.revision = revision
+}
+
+// Invalidate every bearer token, as if the sessions had expired.
+func (s *Server) ExpireSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tokens = map[string]bool{}
+}
+
+/*                  _
+ *  _ __ ___  _   _| |_ ___  ___
+ * | '__/ _ \| | | | __/ _ \/ __|
+ * | | | (_) | |_| | ||  __/\__ \
+ * |_|  \___/ \__,_|\__\___||___/
+ *  FIGLET: routes
+ */
+
+// A request matched by a route.
+type request struct {
+	*http.Request
+
+	// The "*" segments of the route's pattern.
+	args []string
+
+	// Headers of the response.
+	header http.Header
+}
+
+type handler func(s *Server, r *request) (interface{}, error)
+
+type route struct {
+	method string
+
+	// Segments of "*" match any one segment, which is passed to the handler unescaped.
+	pattern string
+
+	handle handler
+}
+
+var routes = []route{
+	{"GET", "/v1/version", (*Server).getVersion},
+
+	{"GET", "/v1/files/quotas/", (*Server).listQuotas},
+	{"POST", "/v1/files/quotas/", (*Server).createQuota},
+	{"GET", "/v1/files/quotas/status/", (*Server).listQuotaStatus},
+	{"GET", "/v1/files/quotas/status/*", (*Server).getQuotaStatus},
+	{"GET", "/v1/files/quotas/*", (*Server).getQuota},
+	{"PUT", "/v1/files/quotas/*", (*Server).updateQuota},
+	{"DELETE", "/v1/files/quotas/*", (*Server).deleteQuota},
+
+	{"GET", "/v1/files/*/entries/", (*Server).listEntries},
+	{"POST", "/v1/files/*/entries/", (*Server).createEntry},
+	{"GET", "/v1/files/*/info/attributes", (*Server).getAttributes},
+	{"PATCH", "/v1/files/*/info/attributes", (*Server).setAttributes},
+	{"DELETE", "/v1/files/*", (*Server).deleteFile},
+	{"GET", "/v2/files/*/info/acl", (*Server).getAcl},
+	{"PUT", "/v2/files/*/info/acl", (*Server).setAcl},
+
+	{"GET", "/v2/nfs/exports/", (*Server).listExports},
+	{"POST", "/v2/nfs/exports/", (*Server).createExport},
+	{"GET", "/v2/nfs/exports/*", (*Server).getExport},
+	{"PUT", "/v2/nfs/exports/*", (*Server).modifyExport},
+	{"DELETE", "/v2/nfs/exports/*", (*Server).deleteExport},
+
+	{"GET", "/v1/tree-delete/jobs/", (*Server).listTreeDeletes},
+	{"POST", "/v1/tree-delete/jobs/", (*Server).createTreeDelete},
+	{"GET", "/v1/tree-delete/jobs/*", (*Server).getTreeDelete},
+
+	{"GET", "/v1/snapshots/policies/*", (*Server).getSnapshotPolicy},
+	{"PATCH", "/v1/snapshots/policies/*", (*Server).modifySnapshotPolicy},
+
+	{"GET", "/v2/replication/source-relationships/", (*Server).listReplicationSources},
+	{"POST", "/v2/replication/source-relationships/", (*Server).createReplicationSource},
+	{"DELETE", "/v2/replication/source-relationships/*", (*Server).deleteReplicationSource},
+	{
+		"GET",
+		"/v2/replication/target-relationships/status/",
+		(*Server).listReplicationTargetStatuses,
+	},
+	{
+		"POST",
+		"/v2/replication/target-relationships/*/authorize",
+		(*Server).authorizeReplicationTarget,
+	},
+}
+
+// Match the escaped path of a request, so that an escaped '/' in a file path stays part of
+// its segment.
+func (r *route) match(escapedPath string) ([]string, bool) {
+	patternSegments := strings.Split(r.pattern, "/")
+	segments := strings.Split(escapedPath, "/")
+	if len(segments) != len(patternSegments) {
+		return nil, false
+	}
+
+	args := []string{}
+	for i, segment := range segments {
+		if patternSegments[i] != "*" {
+			if segment != patternSegments[i] {
+				return nil, false
+			}
+			continue
+		}
+
+		// The driver escapes with url.QueryEscape.
+		arg, err := url.QueryUnescape(segment)
+		if err != nil || arg == "" {
+			return nil, false
+		}
+		args = append(args, arg)
+	}
+
+	return args, true
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var response interface{}
+	var err error
+
+	if r.URL.Path == "/v1/session/login" && r.Method == "POST" {
+		response, err = s.login(r)
+	} else if !s.authenticated(r) {
+		err = errorf(401, "http_unauthorized_error", "Need to log in first")
+	} else {
+		response, err = s.route(w, r)
+	}
+
+	if err != nil {
+		restErr, ok := err.(*restError)
+		if !ok {
+			restErr = errorf(500, "http_internal_server_error", "%v", err)
+		}
+		writeJSON(w, restErr.status, restErr.response())
+		return
+	}
+
+	if response == nil {
+		w.WriteHeader(200)
+		return
+	}
+	writeJSON(w, 200, response)
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pathMatched := false
+	for i := range routes {
+		args, ok := routes[i].match(r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if routes[i].method == r.Method {
+			return routes[i].handle(s, &request{Request: r, args: args, header: w.Header()})
+		}
+	}
+
+	if pathMatched {
+		return nil, errorf(
+			405,
+			"http_method_not_allowed_error",
+			"%s not allowed on %s",
+			r.Method,
+			r.URL.Path,
+		)
+	}
+	return nil, errorf(404, "http_not_found_error", "No such resource %s", r.URL.Path)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func decodeBody(r *http.Request, value interface{}) error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, value)
+	if err != nil {
+		return errorf(400, "http_bad_request_error", "Invalid request body: %v", err)
+	}
+
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+type paging struct {
+	Next string `json:"next"`
+}
+
+// One page of sorted keys, starting after the "after" query parameter and holding at most
+// "limit" keys, and the URI of the next page, empty on the last one.
+func paginate(r *http.Request, keys []string) (page []string, next string, err error) {
+	query := r.URL.Query()
+
+	start := 0
+	if after := query.Get("after"); after != "" {
+		start = sort.Search(len(keys), func(i int) bool { return keys[i] > after })
+	}
+
+	limit := len(keys)
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return nil, "", errorf(400, "http_bad_request_error", "Invalid limit %q", value)
+		}
+	}
+
+	end := start + limit
+	if end >= len(keys) {
+		return keys[start:], "", nil
+	}
+
+	page = keys[start:end]
+	next = fmt.Sprintf(
+		"%s?after=%s&limit=%d",
+		r.URL.EscapedPath(),
+		url.QueryEscape(page[len(page)-1]),
+		limit,
+	)
+
+	return page, next, nil
+}
+
+/*   ___ _ __ _ __ ___  _ __ ___
+ *  / _ \ '__| '__/ _ \| '__/ __|
+ * |  __/ |  | | | (_) | |  \__ \
+ *  \___|_|  |_|  \___/|_|  |___/
+ *  FIGLET: errors
+ */
+
+type restError struct {
+	status      int
+	errorClass  string
+	description string
+}
+
+func errorf(status int, errorClass string, format string, args ...interface{}) *restError {
+	return &restError{
+		status:      status,
+		errorClass:  errorClass,
+		description: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *restError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.status, e.errorClass, e.description)
+}
+
+type errorResponse struct {
+	Module      string   `json:"module"`
+	ErrorClass  string   `json:"error_class"`
+	Description string   `json:"description"`
+	UserVisible bool     `json:"user_visible"`
+	Stack       []string `json:"stack"`
+}
+
+func (e *restError) response() errorResponse {
+	return errorResponse{
+		Module:      "fakecluster",
+		ErrorClass:  e.errorClass,
+		Description: e.description,
+		UserVisible: true,
+		Stack:       []string{},
+	}
+}
+
+/*              _   _
+ *   __ _ _   _| |_| |__
+ *  / _` | | | | __| '_ \
+ * | (_| | |_| | |_| | | |
+ *  \__,_|\__,_|\__|_| |_|
+ *  FIGLET: auth
+ */
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	BearerToken string `json:"bearer_token"`
+}
+
+func (s *Server) login(r *http.Request) (interface{}, error) {
+	var body loginRequest
+	err := decodeBody(r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if body.Username != s.username || body.Password != s.password {
+		return nil, errorf(401, "api_invalid_credentials_error", "Invalid username or password")
+	}
+
+	s.nextToken++
+	token := fmt.Sprintf("1:fake-token-%d", s.nextToken)
+	s.tokens[token] = true
+
+	return loginResponse{BearerToken: token}, nil
+}
+
+func (s *Server) authenticated(r *http.Request) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return s.tokens[token]
+}
+
+type versionResponse struct {
+	RevisionId string `json:"revision_id"`
+	BuildId    string `json:"build_id"`
+	Flavor     string `json:"flavor"`
+}
+
+func (s *Server) getVersion(r *request) (interface{}, error) {
+	return versionResponse{RevisionId: s.revision, BuildId: "fake", Flavor: "release"}, nil
+}
@@ -0,0 +1,101 @@
+package fakecluster
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type snapshotPolicy struct {
+	Id            int      `json:"id"`
+	Name          string   `json:"name"`
+	SourceFileIds []string `json:"source_file_ids"`
+
+	// Changed by every modification, and sent as the ETag.
+	generation int
+}
+
+type modifySnapshotPolicyRequest struct {
+	Name          *string   `json:"name"`
+	SourceFileIds *[]string `json:"source_file_ids"`
+}
+
+// Add a snapshot policy as a test fixture, returning its id.
+func (s *Server) CreateSnapshotPolicy(name string, sourceFileIds ...string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if sourceFileIds == nil {
+		sourceFileIds = []string{}
+	}
+
+	policy := &snapshotPolicy{Id: s.nextPolicyId, Name: name, SourceFileIds: sourceFileIds}
+	s.nextPolicyId++
+
+	id := strconv.Itoa(policy.Id)
+	s.policies[id] = policy
+
+	return id
+}
+
+func (policy *snapshotPolicy) etag() string {
+	return fmt.Sprintf("\"%d\"", policy.generation)
+}
+
+func (s *Server) lookUpSnapshotPolicy(id string) (*snapshotPolicy, error) {
+	policy, ok := s.policies[id]
+	if !ok {
+		return nil, errorf(
+			404,
+			"snapshot_policy_not_found_error",
+			"Snapshot policy %s does not exist",
+			id,
+		)
+	}
+	return policy, nil
+}
+
+func (s *Server) getSnapshotPolicy(r *request) (interface{}, error) {
+	policy, err := s.lookUpSnapshotPolicy(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	r.header.Set("ETag", policy.etag())
+
+	return policy, nil
+}
+
+// Modify the given fields of a policy, failing with 412 if If-Match names an older version.
+func (s *Server) modifySnapshotPolicy(r *request) (interface{}, error) {
+	policy, err := s.lookUpSnapshotPolicy(r.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" && match != policy.etag() {
+		return nil, errorf(
+			412,
+			"http_precondition_failed_error",
+			"Snapshot policy %s was modified",
+			r.args[0],
+		)
+	}
+
+	var body modifySnapshotPolicyRequest
+	err = decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body.Name != nil {
+		policy.Name = *body.Name
+	}
+	if body.SourceFileIds != nil {
+		policy.SourceFileIds = *body.SourceFileIds
+	}
+	policy.generation++
+
+	r.header.Set("ETag", policy.etag())
+
+	return policy, nil
+}
@@ -0,0 +1,105 @@
+package fakecluster
+
+import (
+	"sort"
+	"time"
+)
+
+// A tree delete which hasn't run yet. Jobs run as soon as they're created unless held.
+type treeDeleteJob struct {
+	Id          string `json:"id"`
+	CreateTime  string `json:"create_time"`
+	InitialPath string `json:"initial_path"`
+}
+
+type listTreeDeletesResponse struct {
+	Jobs []*treeDeleteJob `json:"jobs"`
+}
+
+type createTreeDeleteRequest struct {
+	Id string `json:"id"`
+}
+
+// While held, tree delete jobs stay queued like a slow delete on a cluster. Releasing the hold
+// runs them.
+func (s *Server) HoldTreeDeletes(hold bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.holdTreeDeletes = hold
+	if !hold {
+		s.runTreeDeletes()
+	}
+}
+
+func (s *Server) runTreeDeletes() {
+	for id := range s.treeDeletes {
+		if f, ok := s.files[id]; ok {
+			s.remove(f)
+		}
+		delete(s.treeDeletes, id)
+	}
+}
+
+func (s *Server) listTreeDeletes(r *request) (interface{}, error) {
+	response := listTreeDeletesResponse{Jobs: []*treeDeleteJob{}}
+	for _, job := range s.treeDeletes {
+		response.Jobs = append(response.Jobs, job)
+	}
+	sort.Slice(response.Jobs, func(i, j int) bool {
+		return response.Jobs[i].Id < response.Jobs[j].Id
+	})
+
+	return response, nil
+}
+
+func (s *Server) createTreeDelete(r *request) (interface{}, error) {
+	var body createTreeDeleteRequest
+	err := decodeBody(r.Request, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.lookUp(body.Id)
+	if err != nil {
+		return nil, err
+	}
+	if f == s.root {
+		return nil, errorf(403, "fs_access_denied_error", "The root directory can't be deleted")
+	}
+	if _, ok := s.treeDeletes[f.id]; ok {
+		return nil, errorf(
+			409,
+			"tree_delete_job_already_exists_error",
+			"A tree delete of %s is already running",
+			f.id,
+		)
+	}
+
+	job := &treeDeleteJob{
+		Id:          f.id,
+		CreateTime:  formatTime(time.Now()),
+		InitialPath: f.path(),
+	}
+	s.treeDeletes[f.id] = job
+
+	if !s.holdTreeDeletes {
+		s.runTreeDeletes()
+	}
+
+	return job, nil
+}
+
+func (s *Server) getTreeDelete(r *request) (interface{}, error) {
+	job, ok := s.treeDeletes[r.args[0]]
+	if !ok {
+		return nil, errorf(
+			404,
+			"tree_delete_job_not_found_error",
+			"No tree delete of %s is running",
+			r.args[0],
+		)
+	}
+
+	return job, nil
+}
@@ -0,0 +1,226 @@
+// Package faults provides an http.RoundTripper which injects the failures seen from real
+// clusters: slow responses, error statuses such as 503 during an upgrade or 401 for an
+// expired token, connections dropped after the cluster acted on a request, and bodies cut off
+// part way through.
+package faults
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// What to inject into which requests, and when. Each matching request counts towards the
+// schedule whether or not the fault is injected into it.
+type Fault struct {
+	// Requests the fault applies to, any method and any path when empty.
+	Method string
+	Path   *regexp.Regexp
+
+	// Skip the first After matching requests, then inject into Times requests, 0 for all of
+	// them. With a Probability between 0 and 1 only that fraction of those requests are
+	// chosen at random.
+	After       int
+	Times       int
+	Probability float64
+
+	// Delay the request, or give up early if its context ends.
+	Latency time.Duration
+
+	// Answer with this status and a Qumulo error body instead of sending the request. A
+	// RetryAfter value is sent as the Retry-After header.
+	StatusCode int
+	ErrorClass string
+	RetryAfter string
+
+	// Send the request but fail as if the connection was reset before the response arrived,
+	// so the cluster acts on a request the client thinks failed.
+	Drop bool
+
+	// Send the request but fail reading the response body after this many bytes.
+	Truncate      bool
+	TruncateAfter int
+
+	matched  int
+	injected int
+}
+
+// The body of an injected error status, in the form the cluster uses.
+type errorResponse struct {
+	Module      string `json:"module"`
+	ErrorClass  string `json:"error_class"`
+	Description string `json:"description"`
+	UserVisible bool   `json:"user_visible"`
+}
+
+// Wraps Transport, injecting the first scheduled fault which matches each request.
+type Transport struct {
+	Transport http.RoundTripper
+
+	mutex  sync.Mutex
+	faults []*Fault
+	random *rand.Rand
+}
+
+// Probabilities are decided by a generator seeded with seed, so tests can be repeated.
+func New(transport http.RoundTripper, seed int64, faults ...*Fault) *Transport {
+	return &Transport{
+		Transport: transport,
+		faults:    faults,
+		random:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Replace the faults, e.g. with none once a test has seen an RPC fail.
+func (t *Transport) SetFaults(faults ...*Fault) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.faults = faults
+}
+
+// How many requests fault has been injected into.
+func (t *Transport) Injected(fault *Fault) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return fault.injected
+}
+
+func (fault *Fault) matches(req *http.Request) bool {
+	if fault.Method != "" && fault.Method != req.Method {
+		return false
+	}
+	return fault.Path == nil || fault.Path.MatchString(req.URL.Path)
+}
+
+// The fault to inject into req, if any.
+func (t *Transport) schedule(req *http.Request) *Fault {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var chosen *Fault
+	for _, fault := range t.faults {
+		if !fault.matches(req) {
+			continue
+		}
+		fault.matched++
+
+		if chosen != nil || fault.matched <= fault.After {
+			continue
+		}
+		if fault.Times != 0 && fault.injected >= fault.Times {
+			continue
+		}
+		if fault.Probability != 0 && t.random.Float64() >= fault.Probability {
+			continue
+		}
+
+		fault.injected++
+		chosen = fault
+	}
+
+	return chosen
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fault := t.schedule(req)
+	if fault == nil {
+		return t.Transport.RoundTrip(req)
+	}
+
+	if fault.Latency > 0 {
+		timer := time.NewTimer(fault.Latency)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+
+	if fault.StatusCode != 0 {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return errorStatus(req, fault), nil
+	}
+
+	response, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if fault.Drop {
+		response.Body.Close()
+		return nil, &net.OpError{
+			Op:  "read",
+			Net: "tcp",
+			Err: syscall.ECONNRESET,
+		}
+	}
+
+	if fault.Truncate {
+		response.Body = &truncatedBody{
+			reader: io.LimitReader(response.Body, int64(fault.TruncateAfter)),
+			closer: response.Body,
+		}
+		response.ContentLength = -1
+	}
+
+	return response, nil
+}
+
+func errorStatus(req *http.Request, fault *Fault) *http.Response {
+	body, _ := json.Marshal(errorResponse{
+		Module:      "faults",
+		ErrorClass:  fault.ErrorClass,
+		Description: fmt.Sprintf("Injected %d for %s %s", fault.StatusCode, req.Method, req.URL),
+	})
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	if fault.RetryAfter != "" {
+		header.Set("Retry-After", fault.RetryAfter)
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(fault.StatusCode) + " " + http.StatusText(fault.StatusCode),
+		StatusCode:    fault.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// Reads up to the truncation point and then fails like a connection reset mid-body.
+type truncatedBody struct {
+	reader io.Reader
+	closer io.Closer
+}
+
+func (body *truncatedBody) Read(p []byte) (int, error) {
+	n, err := body.reader.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (body *truncatedBody) Close() error {
+	return body.closer.Close()
+}
@@ -0,0 +1,150 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A server which counts its requests and answers each with a fixed body.
+func newTestServer(t *testing.T) (*httptest.Server, *int32) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Write([]byte(`{"id": "2", "name": "volume"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &count
+}
+
+func get(
+	ctx context.Context,
+	transport http.RoundTripper,
+	url string,
+) (status int, body string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return
+	}
+
+	response, err := transport.RoundTrip(req)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(data), err
+}
+
+func TestSchedule(t *testing.T) {
+	server, count := newTestServer(t)
+
+	fault := &Fault{StatusCode: 503, ErrorClass: "cluster_upgrading", After: 1, Times: 2}
+	transport := New(http.DefaultTransport, 1, fault)
+
+	statuses := []int{}
+	for i := 0; i < 5; i++ {
+		status, _, err := get(context.TODO(), transport, server.URL+"/v1/version")
+		assert.NoError(t, err)
+		statuses = append(statuses, status)
+	}
+
+	assert.Equal(t, statuses, []int{200, 503, 503, 200, 200})
+	assert.Equal(t, transport.Injected(fault), 2)
+	assert.Equal(t, atomic.LoadInt32(count), int32(3))
+}
+
+func TestMatch(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	fault := &Fault{Method: "GET", Path: regexp.MustCompile(`^/v1/files/`), StatusCode: 404}
+	transport := New(http.DefaultTransport, 1, fault)
+
+	status, _, err := get(context.TODO(), transport, server.URL+"/v1/version")
+	assert.NoError(t, err)
+	assert.Equal(t, status, 200)
+
+	status, body, err := get(context.TODO(), transport, server.URL+"/v1/files/2")
+	assert.NoError(t, err)
+	assert.Equal(t, status, 404)
+	assert.Contains(t, body, `"module":"faults"`)
+}
+
+func TestProbability(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	fault := &Fault{StatusCode: 500, Probability: 0.5}
+	transport := New(http.DefaultTransport, 42, fault)
+
+	for i := 0; i < 100; i++ {
+		get(context.TODO(), transport, server.URL)
+	}
+
+	injected := transport.Injected(fault)
+	assert.Greater(t, injected, 25)
+	assert.Less(t, injected, 75)
+
+	// The same seed injects into the same requests.
+	again := &Fault{StatusCode: 500, Probability: 0.5}
+	transport = New(http.DefaultTransport, 42, again)
+	for i := 0; i < 100; i++ {
+		get(context.TODO(), transport, server.URL)
+	}
+	assert.Equal(t, transport.Injected(again), injected)
+}
+
+func TestDrop(t *testing.T) {
+	server, count := newTestServer(t)
+
+	transport := New(http.DefaultTransport, 1, &Fault{Drop: true, Times: 1})
+
+	_, _, err := get(context.TODO(), transport, server.URL)
+	assert.True(t, errors.Is(err, syscall.ECONNRESET))
+	assert.Equal(t, atomic.LoadInt32(count), int32(1))
+
+	status, _, err := get(context.TODO(), transport, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, status, 200)
+}
+
+func TestTruncate(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	transport := New(http.DefaultTransport, 1, &Fault{Truncate: true, TruncateAfter: 8})
+
+	_, body, err := get(context.TODO(), transport, server.URL)
+	assert.Equal(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, body, `{"id": "`)
+}
+
+func TestLatency(t *testing.T) {
+	server, count := newTestServer(t)
+
+	transport := New(http.DefaultTransport, 1, &Fault{Latency: 20 * time.Millisecond})
+
+	start := time.Now()
+	status, _, err := get(context.TODO(), transport, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, status, 200)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+
+	transport.SetFaults(&Fault{Latency: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = get(ctx, transport, server.URL)
+	assert.Equal(t, err, context.DeadlineExceeded)
+	assert.Equal(t, atomic.LoadInt32(count), int32(1))
+}
@@ -0,0 +1,181 @@
+package qumulo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// How long a cluster has to accept a connection before it counts as unreachable.
+const clusterDialTimeout = 5 * time.Second
+
+// Bounds a health check made through the HTTP endpoint.
+const healthCheckTimeout = 10 * time.Second
+
+// Where mount(8) finds helpers, which needn't be on the plugin's PATH.
+var mountHelperDirs = []string{"/sbin", "/usr/sbin"}
+
+type healthResult struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Healthy bool           `json:"healthy"`
+	Checks  []healthResult `json:"checks"`
+}
+
+func makeHealthResult(name string, err error) healthResult {
+	if err != nil {
+		return healthResult{Name: name, Healthy: false, Error: err.Error()}
+	}
+	return healthResult{Name: name, Healthy: true}
+}
+
+// Run the configured checks. Probe leaves out withClusters: it feeds the livenessprobe sidecar,
+// and restarting the plugin doesn't fix a storage outage. The HTTP endpoint includes them, so
+// cluster reachability can be used as a readiness signal.
+func (n *Driver) checkHealth(ctx context.Context, withClusters bool) healthReport {
+	report := healthReport{Healthy: true, Checks: []healthResult{}}
+
+	for _, helper := range n.mountHelpers {
+		report.Checks = append(
+			report.Checks,
+			makeHealthResult("mount helper "+helper, findMountHelper(helper)),
+		)
+	}
+
+	if withClusters && n.probeClusters {
+		report.Checks = append(report.Checks, n.checkClusters(ctx)...)
+	}
+
+	for _, result := range report.Checks {
+		if !result.Healthy {
+			report.Healthy = false
+		}
+	}
+
+	return report
+}
+
+func findMountHelper(name string) error {
+	if _, err := exec.LookPath(name); err == nil {
+		return nil
+	}
+
+	for _, dir := range mountHelperDirs {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s not found, volumes can't be mounted", name)
+}
+
+// Every cluster named by a StorageClass of this driver must accept connections on its REST
+// port.
+func (n *Driver) checkClusters(ctx context.Context) []healthResult {
+	if n.kubeClient == nil {
+		return []healthResult{
+			makeHealthResult("clusters", errors.New("Kubernetes API access not configured")),
+		}
+	}
+
+	classes, err := n.kubeClient.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []healthResult{makeHealthResult("clusters", err)}
+	}
+
+	addresses := map[string]bool{}
+	for _, class := range classes.Items {
+		if class.Provisioner != n.name {
+			continue
+		}
+
+		server, port := "", "8000"
+		for k, v := range class.Parameters {
+			switch strings.ToLower(k) {
+			case paramServer:
+				server = v
+			case paramRestPort:
+				port = v
+			}
+		}
+		if server == "" {
+			continue
+		}
+
+		addresses[net.JoinHostPort(server, port)] = true
+	}
+
+	sorted := []string{}
+	for address := range addresses {
+		sorted = append(sorted, address)
+	}
+	sort.Strings(sorted)
+
+	results := []healthResult{}
+	for _, address := range sorted {
+		results = append(results, makeHealthResult("cluster "+address, dialCluster(ctx, address)))
+	}
+
+	return results
+}
+
+func dialCluster(ctx context.Context, address string) error {
+	ctx, cancel := context.WithTimeout(ctx, clusterDialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Reports each check as JSON, with 503 if any failed.
+func (n *Driver) serveHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	report := n.checkHealth(ctx, true)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		klog.Warningf("Failed to write health report: %v", err)
+	}
+}
+
+// Serve /healthz on address until the process exits.
+func (n *Driver) ServeHealth(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", n.serveHealth)
+
+	go func() {
+		klog.Infof("Serving health checks on %s", address)
+		err := http.ListenAndServe(address, mux)
+		if err != nil {
+			klog.Fatalf("Health listener failed: %v", err)
+		}
+	}()
+}
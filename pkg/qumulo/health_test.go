@@ -0,0 +1,204 @@
+package qumulo
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func makeHealthStorageClass(
+	name string,
+	provisioner string,
+	server string,
+) *storagev1.StorageClass {
+	return &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name},
+		Provisioner: provisioner,
+		Parameters:  map[string]string{"server": server},
+	}
+}
+
+func TestFindMountHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sbin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "mount.fake"), []byte{}, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "mount.noexec"), []byte{}, 0644))
+
+	saved := mountHelperDirs
+	mountHelperDirs = []string{dir}
+	defer func() { mountHelperDirs = saved }()
+
+	assert.NoError(t, findMountHelper("mount.fake"))
+	assert.EqualError(
+		t,
+		findMountHelper("mount.noexec"),
+		"mount.noexec not found, volumes can't be mounted",
+	)
+	assert.EqualError(
+		t,
+		findMountHelper("mount.nope"),
+		"mount.nope not found, volumes can't be mounted",
+	)
+}
+
+func TestProbeMountHelperMissing(t *testing.T) {
+	d := NewEmptyDriver("")
+	d.SetMountHelpers([]string{"mount.nope"})
+	ids := IdentityServer{Driver: d}
+
+	resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, resp.Ready.Value, false)
+}
+
+func TestProbeIgnoresClusters(t *testing.T) {
+	// A port nothing listens on.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+
+	down := makeHealthStorageClass("down", DefaultDriverName, "127.0.0.1")
+	down.Parameters["restport"] = closedPort
+
+	d := NewEmptyDriver("")
+	d.SetProbeClusters(true)
+	d.SetKubeClient(fake.NewSimpleClientset(down))
+	ids := IdentityServer{Driver: d}
+
+	// A storage outage mustn't get the plugin restarted by the livenessprobe sidecar.
+	resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, resp.Ready.Value, true)
+
+	recorder := httptest.NewRecorder()
+	d.serveHealth(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, recorder.Code, http.StatusServiceUnavailable)
+}
+
+func TestCheckClusters(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// A port nothing listens on.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+
+	up := makeHealthStorageClass("up", DefaultDriverName, "127.0.0.1")
+	up.Parameters["restport"] = port
+	down := makeHealthStorageClass("down", DefaultDriverName, "127.0.0.1")
+	down.Parameters["restport"] = closedPort
+	other := makeHealthStorageClass("other", "nfs.csi.k8s.io", "10.0.0.1")
+
+	d := NewEmptyDriver("")
+	d.SetProbeClusters(true)
+
+	report := d.checkHealth(context.TODO(), true)
+	assert.Equal(
+		t,
+		report,
+		healthReport{
+			Healthy: false,
+			Checks: []healthResult{
+				{
+					Name:    "clusters",
+					Healthy: false,
+					Error:   "Kubernetes API access not configured",
+				},
+			},
+		},
+	)
+
+	d.SetKubeClient(fake.NewSimpleClientset(up, down, other))
+
+	report = d.checkHealth(context.TODO(), true)
+	assert.False(t, report.Healthy)
+	assert.Len(t, report.Checks, 2)
+	for _, result := range report.Checks {
+		switch result.Name {
+		case "cluster 127.0.0.1:" + port:
+			assert.True(t, result.Healthy)
+		case "cluster 127.0.0.1:" + closedPort:
+			assert.False(t, result.Healthy)
+			assert.Contains(t, result.Error, "connection refused")
+		default:
+			t.Errorf("unexpected check %q", result.Name)
+		}
+	}
+
+	d.SetKubeClient(fake.NewSimpleClientset(up, other))
+	assert.True(t, d.checkHealth(context.TODO(), true).Healthy)
+}
+
+func TestCheckClustersParameterCase(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// Spelled as in the docs.
+	class := makeHealthStorageClass("camel", DefaultDriverName, "")
+	class.Parameters = map[string]string{"Server": "127.0.0.1", "restPort": port}
+
+	d := NewEmptyDriver("")
+	d.SetProbeClusters(true)
+	d.SetKubeClient(fake.NewSimpleClientset(class))
+
+	report := d.checkHealth(context.TODO(), true)
+	assert.Equal(
+		t,
+		report.Checks,
+		[]healthResult{{Name: "cluster 127.0.0.1:" + port, Healthy: true}},
+	)
+	assert.True(t, report.Healthy)
+}
+
+func TestServeHealth(t *testing.T) {
+	d := NewEmptyDriver("")
+
+	recorder := httptest.NewRecorder()
+	d.serveHealth(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.JSONEq(t, recorder.Body.String(), "{\"healthy\": true, \"checks\": []}")
+
+	d.SetMountHelpers([]string{"mount.nope"})
+
+	recorder = httptest.NewRecorder()
+	d.serveHealth(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, recorder.Code, http.StatusServiceUnavailable)
+
+	var report healthReport
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(
+		t,
+		report,
+		healthReport{
+			Healthy: false,
+			Checks: []healthResult{
+				{
+					Name:    "mount helper mount.nope",
+					Healthy: false,
+					Error:   "mount.nope not found, volumes can't be mounted",
+				},
+			},
+		},
+	)
+}
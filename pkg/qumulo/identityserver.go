@@ -46,15 +46,19 @@ func (ids *IdentityServer) GetPluginInfo(
 	}, nil
 }
 
-// Probe check whether the plugin is running or not.
-// This method does not need to return anything.
-// Currently the spec does not dictate what you should return either.
-// Hence, return an empty response
+// Ready only when the configured prerequisites hold, see checkHealth.
 func (ids *IdentityServer) Probe(
 	ctx context.Context,
 	req *csi.ProbeRequest,
 ) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+	report := ids.Driver.checkHealth(ctx, false)
+	for _, result := range report.Checks {
+		if !result.Healthy {
+			logInfo(ctx, 0, "Health check failed", "check", result.Name, "err", result.Error)
+		}
+	}
+
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: report.Healthy}}, nil
 }
 
 func (ids *IdentityServer) GetPluginCapabilities(
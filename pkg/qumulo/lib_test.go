@@ -1,15 +1,18 @@
 package qumulo
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"testing"
 
+	"github.com/kubernetes-csi/csi-driver-qumulo/pkg/qumulo/fakecluster"
+	"github.com/kubernetes-csi/csi-driver-qumulo/pkg/qumulo/recorder"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/klog/v2"
 )
@@ -37,21 +40,35 @@ var (
 	testPort     int
 	testUsername string
 	testPassword string
+	testInsecure string
 
 	testConnection *Connection
 	testFixtureDir string
 	testNumber     int
+
+	// Set when testing against the in-memory cluster rather than a real one.
+	testCluster *fakecluster.Server
+
+	// Records or replays the requests of testConnection for requireRecordedCluster.
+	testRecorder *recorder.Recorder
+	testRecord   bool
 )
 
+// Where requireRecordedCluster keeps the requests of each test.
+const testFixturesDir = "testdata/rest"
+
 func TestMain(m *testing.M) {
 	// Get cluster connection settings from the environment first then allow override
-	// with flags. An empty host indicates no cluster which bypassess tests using requireCluster.
+	// with flags. An empty host runs the tests using requireCluster against an in-memory
+	// cluster.
 
 	testHost = os.Getenv("QUMULO_TEST_HOST")
 	portStr := os.Getenv("QUMULO_TEST_PORT")
 	testUsername = os.Getenv("QUMULO_TEST_USERNAME")
 	testPassword = os.Getenv("QUMULO_TEST_PASSWORD")
 	testroot := os.Getenv("QUMULO_TEST_ROOT")
+	testInsecure = os.Getenv("QUMULO_TEST_INSECURE")
+	testRecord = os.Getenv("QUMULO_TEST_RECORD") != ""
 
 	var nocleanup bool
 	var logging bool
@@ -60,46 +77,83 @@ func TestMain(m *testing.M) {
 	flag.StringVar(&portStr, "port", portStr, "Port to connect to")
 	flag.StringVar(&testUsername, "username", testUsername, "Username to connect as")
 	flag.StringVar(&testPassword, "password", testPassword, "Password to use")
+	flag.StringVar(
+		&testInsecure,
+		"insecure",
+		testInsecure,
+		"Skip verification of the cluster's certificate",
+	)
 	flag.StringVar(&testroot, "testroot", testroot, "Root directory to put test dir in")
 	flag.BoolVar(&nocleanup, "nocleanup", false, "Skip clean up of artifacts")
+	flag.BoolVar(
+		&testRecord,
+		"record",
+		testRecord,
+		"Record the requests of REST tests to "+testFixturesDir+" rather than replaying them",
+	)
 	flag.BoolVar(&logging, "logging", false, "Enable logging")
 
 	flag.Parse()
 
-	if len(testHost) != 0 {
-		var err error
-		testPort, err = strconv.Atoi(portStr)
-		if err != nil {
-			klog.Fatal(err)
-		}
+	if testRecord && len(testroot) != 0 {
+		klog.Fatal("Recording needs the default test root so paths match")
+	}
 
-		if testPort == 0 {
-			klog.Fatal("QUMULO_TEST_PORT is required with QUMULO_TEST_HOST")
-		}
-		if len(testUsername) == 0 {
-			klog.Fatal("QUMULO_TEST_USERNAME is required with QUMULO_TEST_HOST")
-		}
-		if len(testPassword) == 0 {
-			klog.Fatal("QUMULO_TEST_PASSWORD is required with QUMULO_TEST_HOST")
-		}
+	if len(testHost) == 0 {
+		testCluster = fakecluster.NewServer("admin", "fake-password")
 
-		c := MakeConnection(testHost, testPort, testUsername, testPassword, new(http.Client))
+		testHost = testCluster.Host
+		portStr = strconv.Itoa(testCluster.Port)
+		testUsername = "admin"
+		testPassword = "fake-password"
+		testInsecure = "true"
+	}
 
-		if len(testroot) == 0 {
-			testroot = "/"
-		}
+	var err error
+	testPort, err = strconv.Atoi(portStr)
+	if err != nil {
+		klog.Fatal(err)
+	}
 
-		_, err = c.CreateDir(testroot, "gotest")
-		if err != nil {
-			klog.Fatal(err)
-		}
+	if testPort == 0 {
+		klog.Fatal("QUMULO_TEST_PORT is required with QUMULO_TEST_HOST")
+	}
+	if len(testUsername) == 0 {
+		klog.Fatal("QUMULO_TEST_USERNAME is required with QUMULO_TEST_HOST")
+	}
+	if len(testPassword) == 0 {
+		klog.Fatal("QUMULO_TEST_PASSWORD is required with QUMULO_TEST_HOST")
+	}
+
+	tlsOptions, err := getTLSOptions(map[string]string{secretInsecure: testInsecure})
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	client, err := NewHTTPClient(tlsOptions)
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	testRecorder = recorder.New(client.Transport)
+	client.Transport = testRecorder
+
+	c := MakeConnection(testHost, testPort, testUsername, testPassword, client)
 
-		testFixtureDir = fmt.Sprintf("%s/gotest", testroot)
-		testFixtureDir = regexp.MustCompile("(///*)").ReplaceAllLiteralString(testFixtureDir, "/")
+	if len(testroot) == 0 {
+		testroot = "/"
+	}
 
-		testConnection = &c
+	_, err = c.CreateDir(context.TODO(), testroot, "gotest")
+	if err != nil {
+		klog.Fatal(err)
 	}
 
+	testFixtureDir = fmt.Sprintf("%s/gotest", testroot)
+	testFixtureDir = regexp.MustCompile("(///*)").ReplaceAllLiteralString(testFixtureDir, "/")
+
+	testConnection = &c
+
 	if !logging {
 		vlogFlags := &flag.FlagSet{}
 		klog.InitFlags(vlogFlags)
@@ -116,7 +170,7 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 
 	if testConnection != nil && !nocleanup {
-		err := testConnection.TreeDeleteCreate(testFixtureDir)
+		err := testConnection.TreeDeleteCreate(context.TODO(), testFixtureDir)
 		if err != nil {
 			klog.Warningf(
 				"Failed to clean up test dir %q with tree delete: %v",
@@ -127,31 +181,63 @@ func TestMain(m *testing.M) {
 		}
 	}
 
+	if testCluster != nil {
+		testCluster.Close()
+	}
+
 	os.Exit(code)
 }
 
 func requireCluster(t *testing.T) (testDirPath string, testDirId string, cleanup func(t *testing.T)) {
-	if testConnection == nil {
-		t.Skip("requires qumulo server")
-		return
+	name := fmt.Sprintf("testNumber-%d", testNumber)
+	testNumber += 1
+
+	return makeTestDir(t, name)
+}
+
+// Like requireCluster, but the requests testConnection makes for the test are replayed from its
+// fixture in testFixturesDir if there is one, or recorded to it with -record. Only use this for
+// tests which make all their requests through testConnection.
+func requireRecordedCluster(
+	t *testing.T,
+) (testDirPath string, testDirId string, cleanup func(t *testing.T)) {
+	fixture := filepath.Join(testFixturesDir, t.Name()+".json")
+
+	if testRecord {
+		testRecorder.Record(fixture)
+	} else if _, err := os.Stat(fixture); err == nil {
+		err = testRecorder.Replay(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
+	t.Cleanup(func() {
+		err := testRecorder.Stop()
+		if err != nil {
+			t.Error(err)
+		}
+	})
 
-	name := fmt.Sprintf("testNumber-%d", testNumber)
+	// Named after the test so the paths in fixtures don't depend on which tests run.
+	return makeTestDir(t, t.Name())
+}
 
-	attributes, err := testConnection.CreateDir(testFixtureDir, name)
+func makeTestDir(
+	t *testing.T,
+	name string,
+) (testDirPath string, testDirId string, cleanup func(t *testing.T)) {
+	attributes, err := testConnection.CreateDir(context.TODO(), testFixtureDir, name)
 	if err != nil {
 		t.Fatalf("Error creating subdir %s/%s: %v", testFixtureDir, name, err)
 		return
 	}
 
-	testNumber += 1
-
 	testDirPath = fmt.Sprintf("%s/%s", testFixtureDir, name)
 	testDirId = attributes.Id
 
 	cleanup = func(t *testing.T) {
 		if !t.Failed() {
-			err := testConnection.TreeDeleteCreate(testDirPath)
+			err := testConnection.TreeDeleteCreate(context.TODO(), testDirPath)
 			assert.NoError(t, err)
 		}
 	}
@@ -0,0 +1,103 @@
+package qumulo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// Logged with every line written while handling one CSI call, so that the lines of concurrent
+// calls, including their REST requests, can be told apart.
+type requestLog struct {
+	correlationID string
+	keysAndValues []interface{}
+}
+
+type requestLogKey struct{}
+
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	panicOnError(err)
+	return hex.EncodeToString(id)
+}
+
+func withRequestLog(
+	ctx context.Context,
+	correlationID string,
+	keysAndValues ...interface{},
+) context.Context {
+	return context.WithValue(
+		ctx,
+		requestLogKey{},
+		&requestLog{correlationID: correlationID, keysAndValues: keysAndValues},
+	)
+}
+
+// The ID of the CSI call ctx belongs to, empty outside of one.
+func correlationID(ctx context.Context) string {
+	if log, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return log.correlationID
+	}
+	return ""
+}
+
+func logValues(ctx context.Context, keysAndValues []interface{}) []interface{} {
+	log, ok := ctx.Value(requestLogKey{}).(*requestLog)
+	if !ok {
+		return keysAndValues
+	}
+
+	values := []interface{}{"correlationID", log.correlationID}
+	values = append(values, log.keysAndValues...)
+	return append(values, keysAndValues...)
+}
+
+func logInfo(ctx context.Context, level klog.Level, msg string, keysAndValues ...interface{}) {
+	if klog.V(level).Enabled() {
+		klog.InfoSDepth(1, msg, logValues(ctx, keysAndValues)...)
+	}
+}
+
+func logError(ctx context.Context, err error, msg string, keysAndValues ...interface{}) {
+	klog.ErrorSDepth(1, err, msg, logValues(ctx, keysAndValues)...)
+}
+
+// The volume, PVC and cluster a CSI request is about, as far as the request tells.
+func requestLogValues(req interface{}) []interface{} {
+	values := []interface{}{}
+	cluster := ""
+
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		values = append(values, "volumeID", r.GetVolumeId())
+		if qVol, err := makeQumuloVolumeFromID(r.GetVolumeId()); err == nil {
+			cluster = qVol.server
+		}
+	}
+
+	var params map[string]string
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		values = append(values, "volumeName", r.GetName())
+		params = r.GetParameters()
+		cluster = params[paramServer]
+	case interface{ GetVolumeContext() map[string]string }:
+		params = r.GetVolumeContext()
+		if cluster == "" {
+			cluster = params[paramServer]
+		}
+	}
+
+	if params[pvcNameKey] != "" {
+		values = append(values, "pvc", klog.KRef(params[pvcNamespaceKey], params[pvcNameKey]))
+	}
+
+	if cluster != "" {
+		values = append(values, "cluster", cluster)
+	}
+
+	return values
+}
@@ -0,0 +1,135 @@
+package qumulo
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2"
+)
+
+// Records the headers of each request, then hands it to base.
+type requestHeaderTransport struct {
+	base    http.RoundTripper
+	headers []http.Header
+}
+
+func (self *requestHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	self.headers = append(self.headers, req.Header.Clone())
+	return self.base.RoundTrip(req)
+}
+
+func TestRequestLogValues(t *testing.T) {
+	cases := []struct {
+		name     string
+		req      interface{}
+		expected []interface{}
+	}{
+		{
+			name:     "no volume",
+			req:      &csi.ControllerGetCapabilitiesRequest{},
+			expected: []interface{}{},
+		},
+		{
+			name: "create",
+			req: &csi.CreateVolumeRequest{
+				Name: "pvc-123",
+				Parameters: map[string]string{
+					"server":                           "qumulo",
+					"csi.storage.k8s.io/pvc/name":      "data",
+					"csi.storage.k8s.io/pvc/namespace": "team-a",
+				},
+			},
+			expected: []interface{}{
+				"volumeName",
+				"pvc-123",
+				"pvc",
+				klog.KRef("team-a", "data"),
+				"cluster",
+				"qumulo",
+			},
+		},
+		{
+			name: "volume id",
+			req:  &csi.DeleteVolumeRequest{VolumeId: "v1:qumulo:8000//a//a//pvc-123"},
+			expected: []interface{}{
+				"volumeID",
+				"v1:qumulo:8000//a//a//pvc-123",
+				"cluster",
+				"qumulo",
+			},
+		},
+		{
+			name: "invalid volume id",
+			req:  &csi.ControllerExpandVolumeRequest{VolumeId: "junk"},
+			expected: []interface{}{
+				"volumeID",
+				"junk",
+			},
+		},
+		{
+			name: "volume context",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:      "pvc-123",
+				VolumeContext: map[string]string{"server": "qumulo"},
+			},
+			expected: []interface{}{
+				"volumeID",
+				"pvc-123",
+				"cluster",
+				"qumulo",
+			},
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, requestLogValues(test.req), test.expected)
+		})
+	}
+}
+
+func TestLogValues(t *testing.T) {
+	ctx := context.TODO()
+	assert.Equal(t, logValues(ctx, []interface{}{"uri", "/hi"}), []interface{}{"uri", "/hi"})
+	assert.Equal(t, correlationID(ctx), "")
+
+	ctx = withRequestLog(ctx, "abc123", "volumeID", "v1")
+	assert.Equal(
+		t,
+		logValues(ctx, []interface{}{"uri", "/hi"}),
+		[]interface{}{"correlationID", "abc123", "volumeID", "v1", "uri", "/hi"},
+	)
+	assert.Equal(t, correlationID(ctx), "abc123")
+}
+
+func TestRestCorrelationHeader(t *testing.T) {
+	messages := []Message{
+		{"/hi", 401, "", ""},
+		{"/v1/session/login", 200, "{\"username\":\"bob\",\"password\":\"yeruncle\"}", "{}"},
+		{"/hi", 200, "", "yo"},
+		{"/hi", 200, "", "yo"},
+	}
+	transport := &requestHeaderTransport{base: &FakeTransport{t, "1.2.3.4", 44, &messages}}
+	client := &http.Client{Transport: transport}
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	connection.CorrelationHeader = "X-Request-ID"
+
+	_, err := connection.Get(withRequestLog(context.TODO(), "abc123"), "/hi")
+	assert.NoError(t, err)
+
+	_, err = connection.Get(context.TODO(), "/hi")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+
+	assert.Len(t, transport.headers, 4)
+	for _, header := range transport.headers[:3] {
+		assert.Equal(t, header.Get("X-Request-ID"), "abc123")
+	}
+	assert.Equal(t, transport.headers[3].Get("X-Request-ID"), "")
+}
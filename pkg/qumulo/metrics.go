@@ -0,0 +1,174 @@
+package qumulo
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "qumulo_csi"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	csiOperations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operations_total",
+			Help:      "CSI RPCs by method and gRPC result code.",
+		},
+		[]string{"method", "code"},
+	)
+	csiOperationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of CSI RPCs by method and gRPC result code.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		},
+		[]string{"method", "code"},
+	)
+	csiOperationsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "operations_in_flight",
+			Help:      "CSI RPCs currently being handled, by method.",
+		},
+		[]string{"method"},
+	)
+
+	restRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rest_requests_total",
+			Help:      "Qumulo REST requests by cluster, verb, URI template and HTTP status.",
+		},
+		[]string{"host", "verb", "uri", "code"},
+	)
+	restRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "rest_request_duration_seconds",
+			Help:      "Duration of Qumulo REST requests by cluster, verb and URI template.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"host", "verb", "uri"},
+	)
+	restLogins = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rest_logins_total",
+			Help:      "Qumulo REST logins by cluster and result.",
+		},
+		[]string{"host", "result"},
+	)
+	sessionCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "session_cache_lookups_total",
+			Help:      "Controller REST session cache lookups by result (hit or miss).",
+		},
+		[]string{"result"},
+	)
+	treeDeleteJobs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tree_delete_jobs_total",
+			Help:      "Tree delete jobs by cluster and result (created or running).",
+		},
+		[]string{"host", "result"},
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		csiOperations,
+		csiOperationDuration,
+		csiOperationsInFlight,
+		restRequests,
+		restRequestDuration,
+		restLogins,
+		sessionCacheLookups,
+		treeDeleteJobs,
+	)
+}
+
+// Serve /metrics on address until the process exits.
+func ServeMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	go func() {
+		klog.Infof("Serving metrics on %s", address)
+		err := http.ListenAndServe(address, mux)
+		if err != nil {
+			klog.Fatalf("Metrics listener failed: %v", err)
+		}
+	}()
+}
+
+func metricsGRPC(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+
+	inFlight := csiOperationsInFlight.WithLabelValues(method)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	code := status.Code(err).String()
+	csiOperations.WithLabelValues(method, code).Inc()
+	csiOperationDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// File ids, escaped paths and relationship UUIDs would make a series per volume.
+var uriIdSegment = regexp.MustCompile(
+	`^([0-9]+|%2F.*|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`,
+)
+
+// Reduce a request URI to a template such as /v1/files/{id}/info/attributes.
+func uriTemplate(uri string) string {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+
+	segments := strings.Split(uri, "/")
+	for i, segment := range segments {
+		if uriIdSegment.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func observeRestRequest(host string, verb string, uri string, statusCode int, start time.Time) {
+	template := uriTemplate(uri)
+
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+
+	restRequests.WithLabelValues(host, verb, template, code).Inc()
+	restRequestDuration.WithLabelValues(host, verb, template).Observe(time.Since(start).Seconds())
+}
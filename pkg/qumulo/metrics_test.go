@@ -0,0 +1,84 @@
+package qumulo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUriTemplate(t *testing.T) {
+	cases := []struct {
+		uri      string
+		expected string
+	}{
+		{"/v1/version", "/v1/version"},
+		{"/v1/files/%2Fa%2Fb/info/attributes", "/v1/files/{id}/info/attributes"},
+		{"/v1/files/55/entries/?limit=2", "/v1/files/{id}/entries/"},
+		{"/v1/files/quotas/55", "/v1/files/quotas/{id}"},
+		{"/v1/tree-delete/jobs/", "/v1/tree-delete/jobs/"},
+		{
+			"/v2/replication/source-relationships/0b9c2cb0-4d1e-4b8b-9c53-0a0e2a3c5e7f",
+			"/v2/replication/source-relationships/{id}",
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.uri, func(t *testing.T) {
+			assert.Equal(t, uriTemplate(test.uri), test.expected)
+		})
+	}
+}
+
+func TestMetricsGRPC(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	counter := csiOperations.WithLabelValues("CreateVolume", "NotFound")
+	before := testutil.ToFloat64(counter)
+
+	_, err := metricsGRPC(
+		context.TODO(),
+		nil,
+		info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			inFlight := csiOperationsInFlight.WithLabelValues("CreateVolume")
+			assert.Equal(t, testutil.ToFloat64(inFlight), float64(1))
+			return nil, status.Error(codes.NotFound, "nope")
+		},
+	)
+	assert.Error(t, err)
+
+	assert.Equal(t, testutil.ToFloat64(counter), before+1)
+	inFlight := csiOperationsInFlight.WithLabelValues("CreateVolume")
+	assert.Equal(t, testutil.ToFloat64(inFlight), float64(0))
+}
+
+func TestMetricsRestRequests(t *testing.T) {
+	messages := []Message{
+		{"/v1/files/%2Fa/info/attributes", 401, "", ""},
+		{"/v1/session/login", 200, "{\"username\":\"bob\",\"password\":\"yeruncle\"}", ""},
+		{"/v1/files/%2Fa/info/attributes", 404, "", ""},
+	}
+	client := newTestClient(t, "metrics.host", 44, &messages)
+
+	notFound := restRequests.WithLabelValues(
+		"metrics.host",
+		"GET",
+		"/v1/files/{id}/info/attributes",
+		"404",
+	)
+	logins := restLogins.WithLabelValues("metrics.host", "success")
+
+	connection := MakeConnection("metrics.host", 44, "bob", "yeruncle", client)
+	_, err := connection.LookUp(context.TODO(), "/a")
+	assertRestError(t, err, 404, "")
+
+	assert.Equal(t, testutil.ToFloat64(notFound), float64(1))
+	assert.Equal(t, testutil.ToFloat64(logins), float64(1))
+
+	assertMessagesConsumed(t, messages)
+}
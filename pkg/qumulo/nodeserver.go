@@ -25,7 +25,6 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume"
 	mount "k8s.io/mount-utils"
 )
@@ -77,11 +76,15 @@ func (ns *NodeServer) NodePublishVolume(
 	ep := req.GetVolumeContext()[paramShare]
 	source := fmt.Sprintf("%s:%s", s, ep)
 
-	klog.V(2).Infof(
-		"NodePublishVolume: volumeID(%v) source(%s) targetPath(%s) mountflags(%v)",
-		volumeID,
+	logInfo(
+		ctx,
+		2,
+		"Mounting volume",
+		"source",
 		source,
+		"targetPath",
 		targetPath,
+		"mountFlags",
 		mountOptions,
 	)
 	err = ns.mounter.Mount(source, targetPath, "nfs", mountOptions)
@@ -129,11 +132,7 @@ func (ns *NodeServer) NodeUnpublishVolume(
 		return nil, status.Error(codes.NotFound, "Volume not mounted")
 	}
 
-	klog.V(2).Infof(
-		"NodeUnpublishVolume: CleanupMountPoint %s on volumeID(%s)",
-		targetPath,
-		volumeID,
-	)
+	logInfo(ctx, 2, "Cleaning up mount point", "targetPath", targetPath)
 	err = mount.CleanupMountPoint(targetPath, ns.mounter, false)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
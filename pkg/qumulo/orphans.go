@@ -0,0 +1,443 @@
+package qumulo
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// StorageClass parameters naming the secret the provisioner passes to CreateVolume.
+const (
+	provisionerSecretNameKey      = "csi.storage.k8s.io/provisioner-secret-name"
+	provisionerSecretNamespaceKey = "csi.storage.k8s.io/provisioner-secret-namespace"
+)
+
+// Set by the external-provisioner on the PVs it creates, naming the driver.
+const provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+
+var (
+	orphanedVolumes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "orphaned_volume_directories",
+			Help:      "Volume directories no PersistentVolume references, by cluster.",
+		},
+		[]string{"host"},
+	)
+	orphanedVolumeBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "orphaned_volume_bytes",
+			Help:      "Bytes used by orphaned volume directories, from their quotas, by cluster.",
+		},
+		[]string{"host"},
+	)
+	orphanDeletes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "orphaned_volume_deletes_total",
+			Help:      "Tree deletes of orphaned volume directories by cluster and result.",
+		},
+		[]string{"host", "result"},
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(orphanedVolumes, orphanedVolumeBytes, orphanDeletes)
+}
+
+// A storeRealPath of one of this driver's StorageClasses, read with the class's provisioner
+// secret.
+type orphanScanRoot struct {
+	server               string
+	restPort             int
+	storeRealPath        string
+	namespaceDirectories bool
+	secretName           string
+	secretNamespace      string
+}
+
+type orphanedVolume struct {
+	Host string
+	Path string
+
+	// From the directory's quota, 0 if it has none.
+	Size uint64
+
+	// Zero if the cluster didn't report it.
+	Created time.Time
+
+	// When this controller first found the directory orphaned.
+	OrphanedSince time.Time
+
+	// Whether this controller saw a PV it provisioned for the directory, so may delete it.
+	Owned bool
+
+	root orphanScanRoot
+}
+
+type orphanCollector struct {
+	cs *ControllerServer
+
+	// Orphans are tree deleted once they've been orphaned this long, 0 to only report them.
+	deleteAfter time.Duration
+
+	// When each orphan, by cluster and path, was first seen. Lost on restart, which only
+	// delays deletion.
+	firstSeen map[string]time.Time
+
+	// The volumes, by cluster and path, of the PVs this driver provisioned which this
+	// controller has seen. Only these directories are deleted: a storeRealPath may be shared
+	// with another Kubernetes cluster, or another install of the driver, whose volumes are
+	// orphans as far as this controller can tell, and the same path on another cluster is
+	// another volume. Lost on restart, after which earlier orphans are only reported.
+	owned map[string]bool
+}
+
+func newOrphanCollector(cs *ControllerServer, deleteAfter time.Duration) *orphanCollector {
+	return &orphanCollector{
+		cs:          cs,
+		deleteAfter: deleteAfter,
+		firstSeen:   map[string]time.Time{},
+		owned:       map[string]bool{},
+	}
+}
+
+// Report volume directories under the storeRealPaths of this driver's StorageClasses which no
+// PV references, deleting them after the grace period if enabled.
+func (cs *ControllerServer) runOrphanCollector(interval time.Duration, deleteAfter time.Duration) {
+	collector := newOrphanCollector(cs, deleteAfter)
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		ctx = withRequestLog(ctx, newCorrelationID())
+		err := collector.collect(ctx, time.Now())
+		cancel()
+		if err != nil {
+			logError(ctx, err, "Failed to collect orphaned volume directories")
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func (c *orphanCollector) collect(ctx context.Context, now time.Time) error {
+	orphans, err := c.scan(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rebuilt on every scan so that a directory which is referenced again, or can't be read
+	// for a while, starts its grace period over.
+	firstSeen := map[string]time.Time{}
+	for i := range orphans {
+		key := volumeKey(orphans[i].Host, orphans[i].Path)
+		since, ok := c.firstSeen[key]
+		if !ok {
+			since = now
+		}
+		firstSeen[key] = since
+		orphans[i].OrphanedSince = since
+	}
+	c.firstSeen = firstSeen
+
+	orphanedVolumes.Reset()
+	orphanedVolumeBytes.Reset()
+
+	for _, orphan := range orphans {
+		orphanedVolumes.WithLabelValues(orphan.Host).Inc()
+		orphanedVolumeBytes.WithLabelValues(orphan.Host).Add(float64(orphan.Size))
+
+		logInfo(
+			ctx,
+			0,
+			"Orphaned volume directory",
+			"cluster",
+			orphan.Host,
+			"path",
+			orphan.Path,
+			"bytes",
+			orphan.Size,
+			"age",
+			orphan.age(now),
+			"orphanedFor",
+			now.Sub(orphan.OrphanedSince).Round(time.Second),
+			"owned",
+			orphan.Owned,
+		)
+
+		if c.deleteAfter == 0 || now.Sub(orphan.OrphanedSince) < c.deleteAfter {
+			continue
+		}
+
+		if !orphan.Owned {
+			logInfo(
+				ctx,
+				2,
+				"Not deleting orphaned volume directory this controller didn't see provisioned",
+				"path",
+				orphan.Path,
+			)
+			continue
+		}
+
+		err := c.delete(ctx, orphan)
+		if err != nil {
+			orphanDeletes.WithLabelValues(orphan.Host, "error").Inc()
+			logError(ctx, err, "Failed to delete orphaned volume directory", "path", orphan.Path)
+			continue
+		}
+		orphanDeletes.WithLabelValues(orphan.Host, "success").Inc()
+	}
+
+	return nil
+}
+
+// Identifies a volume directory by the host:port of its cluster and its path.
+func volumeKey(host string, path string) string {
+	return host + path
+}
+
+func (orphan *orphanedVolume) age(now time.Time) string {
+	if orphan.Created.IsZero() {
+		return "unknown"
+	}
+	return now.Sub(orphan.Created).Round(time.Second).String()
+}
+
+func (c *orphanCollector) delete(ctx context.Context, orphan orphanedVolume) error {
+	connection, err := c.cs.connectOrphanScanRoot(ctx, orphan.root)
+	if err != nil {
+		return err
+	}
+
+	logInfo(ctx, 0, "Removing orphaned volume directory with tree delete", "path", orphan.Path)
+
+	return transFormRestError(connection.TreeDeleteCreate(ctx, orphan.Path), map[int]error{})
+}
+
+// Directories are listed before PVs so that a volume being created has its PV by the time
+// it's looked for, unless CreateVolume is still running. The grace period covers that.
+func (c *orphanCollector) scan(ctx context.Context) ([]orphanedVolume, error) {
+	roots, err := c.cs.orphanScanRoots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := true
+	candidates := map[string]orphanedVolume{}
+	for _, root := range roots {
+		volumes, err := c.cs.listVolumeDirectories(ctx, root)
+		if err != nil {
+			listed = false
+			logError(
+				ctx,
+				err,
+				"Failed to list volume directories",
+				"cluster",
+				root.server,
+				"path",
+				root.storeRealPath,
+			)
+			continue
+		}
+		for _, volume := range volumes {
+			candidates[volumeKey(volume.Host, volume.Path)] = volume
+		}
+	}
+
+	referenced, provisioned, err := c.cs.referencedVolumePaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range provisioned {
+		c.owned[key] = true
+	}
+
+	orphans := []orphanedVolume{}
+	for key, volume := range candidates {
+		if !referenced[volume.Path] {
+			volume.Owned = c.owned[key]
+			orphans = append(orphans, volume)
+		}
+	}
+
+	// Forget volumes which are gone, unless they're only missing because a listing failed.
+	if listed {
+		for key := range c.owned {
+			if _, ok := candidates[key]; !ok && !provisioned[key] {
+				delete(c.owned, key)
+			}
+		}
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].Host != orphans[j].Host {
+			return orphans[i].Host < orphans[j].Host
+		}
+		return orphans[i].Path < orphans[j].Path
+	})
+
+	return orphans, nil
+}
+
+// The paths of the volumes this driver's PVs reference, and the volumeKeys of those it
+// provisioned rather than being given an existing directory. Referenced paths are compared
+// without the cluster: a PV and a StorageClass may name the same cluster differently, and a
+// directory any PV references is never an orphan. Provisioned volumes may be deleted, so they
+// must match on the cluster too.
+func (cs *ControllerServer) referencedVolumePaths(
+	ctx context.Context,
+) (referenced map[string]bool, provisioned map[string]bool, err error) {
+	pvs, err := cs.Driver.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	referenced = map[string]bool{}
+	provisioned = map[string]bool{}
+	for _, pv := range pvs.Items {
+		source := pv.Spec.CSI
+		if source == nil || source.Driver != cs.Driver.name {
+			continue
+		}
+
+		qVol, err := makeQumuloVolumeFromID(source.VolumeHandle)
+		if err != nil {
+			logInfo(ctx, 4, "Skipping PV with invalid volume ID", "pv", pv.Name, "err", err)
+			continue
+		}
+
+		referenced[qVol.getVolumeRealPath()] = true
+		if pv.Annotations[provisionedByAnnotation] == cs.Driver.name {
+			host := net.JoinHostPort(qVol.server, strconv.Itoa(qVol.restPort))
+			provisioned[volumeKey(host, qVol.getVolumeRealPath())] = true
+		}
+	}
+
+	return referenced, provisioned, nil
+}
+
+// The distinct storeRealPaths of this driver's StorageClasses. Classes whose secret is
+// templated per PVC can't be read outside of an RPC and are skipped.
+func (cs *ControllerServer) orphanScanRoots(ctx context.Context) ([]orphanScanRoot, error) {
+	classes, err := cs.Driver.kubeClient.StorageV1().StorageClasses().List(
+		ctx,
+		metav1.ListOptions{},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[orphanScanRoot]bool{}
+	roots := []orphanScanRoot{}
+
+	for _, class := range classes.Items {
+		if class.Provisioner != cs.Driver.name {
+			continue
+		}
+
+		root := orphanScanRoot{
+			restPort:        8000,
+			secretName:      class.Parameters[provisionerSecretNameKey],
+			secretNamespace: class.Parameters[provisionerSecretNamespaceKey],
+		}
+
+		for k, v := range class.Parameters {
+			switch strings.ToLower(k) {
+			case paramServer:
+				root.server = v
+			case paramStoreRealPath:
+				root.storeRealPath = filepath.Clean(v)
+			case paramRestPort:
+				root.restPort, err = strconv.Atoi(v)
+			case paramNamespaceDirectories:
+				root.namespaceDirectories, err = strconv.ParseBool(v)
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		if err != nil || root.server == "" || root.storeRealPath == "" {
+			logInfo(
+				ctx,
+				2,
+				"Not scanning StorageClass with invalid parameters",
+				"class",
+				class.Name,
+			)
+			err = nil
+			continue
+		}
+
+		if root.secretName == "" || strings.Contains(root.secretName, "${") ||
+			strings.Contains(root.secretNamespace, "${") {
+			logInfo(ctx, 2, "Not scanning StorageClass without a fixed secret", "class", class.Name)
+			continue
+		}
+
+		if !seen[root] {
+			seen[root] = true
+			roots = append(roots, root)
+		}
+	}
+
+	return roots, nil
+}
+
+func (cs *ControllerServer) connectOrphanScanRoot(
+	ctx context.Context,
+	root orphanScanRoot,
+) (*Connection, error) {
+	secrets, err := cs.getSecrets(ctx, root.secretNamespace, root.secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	return cs.createConnection(ctx, root.server, root.restPort, secrets)
+}
+
+// The volume directories under root, including those in namespace directories.
+func (cs *ControllerServer) listVolumeDirectories(
+	ctx context.Context,
+	root orphanScanRoot,
+) ([]orphanedVolume, error) {
+	connection, err := cs.connectOrphanScanRoot(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	directories, err := ListVolumeDirectories(
+		ctx,
+		connection,
+		root.storeRealPath,
+		root.namespaceDirectories,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	host := net.JoinHostPort(root.server, strconv.Itoa(root.restPort))
+
+	volumes := []orphanedVolume{}
+	for _, directory := range directories {
+		volumes = append(volumes, orphanedVolume{
+			Host:    host,
+			Path:    directory.Path,
+			Size:    directory.CapacityUsage,
+			Created: directory.Created,
+			root:    root,
+		})
+	}
+
+	return volumes, nil
+}
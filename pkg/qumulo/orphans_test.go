@@ -0,0 +1,326 @@
+package qumulo
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func makeOrphanStorageClass(name string, secretName string) *storagev1.StorageClass {
+	return &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: name},
+		Provisioner: DefaultDriverName,
+		Parameters: map[string]string{
+			"server":                      "1.2.3.4",
+			"restport":                    "44",
+			"storeRealPath":               "/a/",
+			"namespacedirectories":        "true",
+			provisionerSecretNameKey:      secretName,
+			provisionerSecretNamespaceKey: "kube-system",
+		},
+	}
+}
+
+// A PV provisioned by the driver.
+func makeOrphanPV(name string, volumeId string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{provisionedByAnnotation: DefaultDriverName},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: DefaultDriverName, VolumeHandle: volumeId},
+			},
+		},
+	}
+}
+
+func orphanScanMessages() []Message {
+	return []Message{
+		{
+			"/v1/files/%2Fa/entries/?limit=1000",
+			200,
+			"",
+			"{\"files\": [" +
+				"{\"id\": \"2\", \"name\": \"pvc-1\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", " +
+				"\"mode\": \"0777\"}, " +
+				"{\"id\": \"3\", \"name\": \"pvc-2\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", " +
+				"\"mode\": \"0777\", \"creation_time\": \"2021-06-01T12:00:00.123456789Z\"}, " +
+				"{\"id\": \"4\", \"name\": \"pvc-file\", \"type\": \"FS_FILE_TYPE_FILE\", " +
+				"\"mode\": \"0644\"}" +
+				"], \"paging\": {\"next\": \"/v1/files/%2Fa/entries/?after=4&limit=1000\"}}",
+		},
+		{
+			"/v1/files/%2Fa/entries/?after=4&limit=1000",
+			200,
+			"",
+			"{\"files\": [" +
+				"{\"id\": \"5\", \"name\": \"team-a\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", " +
+				"\"mode\": \"0777\"}" +
+				"], \"paging\": {\"next\": \"\"}}",
+		},
+		{
+			"/v1/files/%2Fa%2Fteam-a/entries/?limit=1000",
+			200,
+			"",
+			"{\"files\": [" +
+				"{\"id\": \"6\", \"name\": \"pvc-3\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", " +
+				"\"mode\": \"0777\"}, " +
+				"{\"id\": \"7\", \"name\": \"pvc-4\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", " +
+				"\"mode\": \"0777\"}" +
+				"], \"paging\": {\"next\": \"\"}}",
+		},
+		{
+			"/v1/files/quotas/status/?limit=1000",
+			200,
+			"",
+			"{\"quotas\": [" +
+				"{\"id\": \"3\", \"path\": \"/a/pvc-2/\", \"limit\": \"1000\", " +
+				"\"capacity_usage\": \"10\"}, " +
+				"{\"id\": \"7\", \"path\": \"/a/team-a/pvc-4/\", \"limit\": \"1000\", " +
+				"\"capacity_usage\": \"20\"}" +
+				"], \"paging\": {\"next\": \"\"}}",
+		},
+	}
+}
+
+func TestCollectOrphans(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+
+	templated := makeOrphanStorageClass("templated", "${pvc.name}")
+
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "qumulo-login", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"username": []byte("bob"),
+				"password": []byte("yeruncle"),
+			},
+		},
+		makeOrphanStorageClass("gold", "qumulo-login"),
+		makeOrphanStorageClass("silver", "qumulo-login"),
+		templated,
+		makeHealthStorageClass("other", "nfs.csi.k8s.io", "1.2.3.4"),
+		makeOrphanPV("pvc-1", "v1:1.2.3.4:44//a//a//pvc-1"),
+		makeOrphanPV("pvc-2", "v1:1.2.3.4:44//a//a//pvc-2"),
+		makeOrphanPV(
+			"pvc-3",
+			"v2:1.2.3.4:44//a/team-a//a/team-a//pvc-3//namespacedirectory=true",
+		),
+	))
+
+	messages := append(connectMessages("yeruncle"), orphanScanMessages()...)
+	cs.Driver.sessions.newClient = func(TLSOptions) (*http.Client, error) {
+		return newTestClient(t, "1.2.3.4", 44, &messages), nil
+	}
+
+	collector := newOrphanCollector(cs, time.Hour)
+	start := time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)
+
+	// pvc-2 is still referenced, pvc-4 is orphaned but this controller never saw its PV.
+	assert.NoError(t, collector.collect(context.TODO(), start))
+	assertMessagesConsumed(t, messages)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(orphanedVolumes.WithLabelValues("1.2.3.4:44")),
+		float64(1),
+	)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(orphanedVolumeBytes.WithLabelValues("1.2.3.4:44")),
+		float64(20),
+	)
+
+	// pvc-2's PV is deleted but its directory stays behind.
+	err := cs.Driver.kubeClient.CoreV1().PersistentVolumes().Delete(
+		context.TODO(),
+		"pvc-2",
+		metav1.DeleteOptions{},
+	)
+	assert.NoError(t, err)
+
+	messages = orphanScanMessages()
+	orphans, err := collector.scan(context.TODO())
+	assert.NoError(t, err)
+	assertMessagesConsumed(t, messages)
+	assert.Len(t, orphans, 2)
+	assert.Equal(t, orphans[0].Path, "/a/pvc-2")
+	assert.Equal(t, orphans[0].Host, "1.2.3.4:44")
+	assert.Equal(t, orphans[0].Size, uint64(10))
+	assert.Equal(t, orphans[0].age(start), "12h0m0s")
+	assert.True(t, orphans[0].Owned)
+	assert.Equal(t, orphans[1].Path, "/a/team-a/pvc-4")
+	assert.Equal(t, orphans[1].Size, uint64(20))
+	assert.Equal(t, orphans[1].age(start), "unknown")
+	assert.False(t, orphans[1].Owned)
+
+	// Found, but not yet orphaned for long enough to delete. pvc-4 has been, but isn't owned.
+	messages = orphanScanMessages()
+	assert.NoError(t, collector.collect(context.TODO(), start.Add(time.Hour)))
+	assertMessagesConsumed(t, messages)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(orphanedVolumes.WithLabelValues("1.2.3.4:44")),
+		float64(2),
+	)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(orphanedVolumeBytes.WithLabelValues("1.2.3.4:44")),
+		float64(30),
+	)
+
+	// pvc-4 is referenced again by a static PV so only pvc-2 is left, and has been orphaned for
+	// long enough.
+	static := makeOrphanPV("pvc-4", "v1:1.2.3.4:44//a/team-a//a/team-a//pvc-4")
+	static.Annotations = nil
+	_, err = cs.Driver.kubeClient.CoreV1().PersistentVolumes().Create(
+		context.TODO(),
+		static,
+		metav1.CreateOptions{},
+	)
+	assert.NoError(t, err)
+	messages = append(
+		orphanScanMessages(),
+		Message{
+			"/v1/files/%2Fa%2Fpvc-2/info/attributes",
+			200,
+			"",
+			"{\"id\": \"3\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", \"mode\": \"0777\"}",
+		},
+		Message{"/v1/tree-delete/jobs/3", 404, "", ""},
+		Message{"/v1/tree-delete/jobs/", 200, "{\"id\":\"3\"}", ""},
+	)
+	deletes := testutil.ToFloat64(orphanDeletes.WithLabelValues("1.2.3.4:44", "success"))
+	assert.NoError(t, collector.collect(context.TODO(), start.Add(2*time.Hour)))
+	assertMessagesConsumed(t, messages)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(orphanDeletes.WithLabelValues("1.2.3.4:44", "success")),
+		deletes+1,
+	)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(orphanedVolumes.WithLabelValues("1.2.3.4:44")),
+		float64(1),
+	)
+	assert.Equal(
+		t,
+		collector.firstSeen,
+		map[string]time.Time{"1.2.3.4:44/a/pvc-2": start.Add(time.Hour)},
+	)
+}
+
+// A directory in a storeRealPath shared with another Kubernetes cluster is never deleted.
+func TestCollectOrphansNotOwned(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "qumulo-login", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"username": []byte("bob"),
+				"password": []byte("yeruncle"),
+			},
+		},
+		makeOrphanStorageClass("gold", "qumulo-login"),
+	))
+
+	messages := append(connectMessages("yeruncle"), orphanScanMessages()...)
+	cs.Driver.sessions.newClient = func(TLSOptions) (*http.Client, error) {
+		return newTestClient(t, "1.2.3.4", 44, &messages), nil
+	}
+
+	collector := newOrphanCollector(cs, time.Hour)
+	assert.NoError(t, collector.collect(context.TODO(), time.Unix(0, 0)))
+	assertMessagesConsumed(t, messages)
+
+	messages = orphanScanMessages()
+	assert.NoError(t, collector.collect(context.TODO(), time.Unix(0, 0).Add(1000*time.Hour)))
+	assertMessagesConsumed(t, messages)
+	assert.Len(t, collector.firstSeen, 4)
+	assert.Len(t, collector.owned, 0)
+}
+
+// A PV provisioned on another cluster doesn't make the same path on this one owned.
+func TestCollectOrphansOwnedOnOtherCluster(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "qumulo-login", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"username": []byte("bob"),
+				"password": []byte("yeruncle"),
+			},
+		},
+		makeOrphanStorageClass("gold", "qumulo-login"),
+		makeOrphanPV("pvc-2", "v1:5.6.7.8:44//a//a//pvc-2"),
+	))
+
+	messages := append(connectMessages("yeruncle"), orphanScanMessages()...)
+	cs.Driver.sessions.newClient = func(TLSOptions) (*http.Client, error) {
+		return newTestClient(t, "1.2.3.4", 44, &messages), nil
+	}
+
+	collector := newOrphanCollector(cs, time.Hour)
+	_, err := collector.scan(context.TODO())
+	assert.NoError(t, err)
+	assertMessagesConsumed(t, messages)
+	assert.Equal(t, collector.owned, map[string]bool{"5.6.7.8:44/a/pvc-2": true})
+
+	err = cs.Driver.kubeClient.CoreV1().PersistentVolumes().Delete(
+		context.TODO(),
+		"pvc-2",
+		metav1.DeleteOptions{},
+	)
+	assert.NoError(t, err)
+
+	messages = orphanScanMessages()
+	orphans, err := collector.scan(context.TODO())
+	assert.NoError(t, err)
+	assertMessagesConsumed(t, messages)
+	assert.Len(t, orphans, 4)
+	assert.Equal(t, orphans[1].Host, "1.2.3.4:44")
+	assert.Equal(t, orphans[1].Path, "/a/pvc-2")
+	assert.False(t, orphans[1].Owned)
+}
+
+func TestCollectOrphansDryRun(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = DefaultDriverName
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "qumulo-login", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"username": []byte("bob"),
+				"password": []byte("yeruncle"),
+			},
+		},
+		makeOrphanStorageClass("gold", "qumulo-login"),
+	))
+
+	messages := append(connectMessages("yeruncle"), orphanScanMessages()...)
+	cs.Driver.sessions.newClient = func(TLSOptions) (*http.Client, error) {
+		return newTestClient(t, "1.2.3.4", 44, &messages), nil
+	}
+
+	// Nothing is deleted however long the directories stay orphaned.
+	collector := newOrphanCollector(cs, 0)
+	assert.NoError(t, collector.collect(context.TODO(), time.Unix(0, 0)))
+	assertMessagesConsumed(t, messages)
+
+	messages = orphanScanMessages()
+	assert.NoError(t, collector.collect(context.TODO(), time.Unix(0, 0).Add(1000*time.Hour)))
+	assertMessagesConsumed(t, messages)
+	assert.Len(t, collector.firstSeen, 4)
+}
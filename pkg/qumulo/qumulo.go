@@ -17,7 +17,11 @@ limitations under the License.
 package qumulo
 
 import (
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
 )
@@ -31,6 +35,29 @@ type Driver struct {
 
 	perm *uint32
 
+	// Used by the controller for features which read Kubernetes objects, may be nil.
+	kubeClient kubernetes.Interface
+
+	// Posts events to PVCs, nil without kubeClient.
+	eventBroadcaster record.EventBroadcaster
+	eventRecorder    record.EventRecorder
+
+	// REST sessions shared by controller RPCs.
+	sessions *SessionCache
+
+	// How often the controller exports volume quota usage, 0 to disable.
+	quotaUsageInterval time.Duration
+
+	// How often the controller looks for orphaned volume directories, 0 to disable, and how
+	// long they must stay orphaned before they're deleted, 0 to only report them.
+	orphanScanInterval time.Duration
+	orphanDeleteAfter  time.Duration
+
+	// Checked by Probe: mount helpers which must be installed, and whether the clusters of
+	// this driver's StorageClasses must be reachable.
+	mountHelpers  []string
+	probeClusters bool
+
 	//ids *identityServer
 	ns    *NodeServer
 	cap   map[csi.VolumeCapability_AccessMode_Mode]bool
@@ -55,6 +82,50 @@ const (
 
 	// Full share path to use on Node.
 	paramShare = "share"
+
+	// Id of an existing snapshot policy which volume directories are added to.
+	paramSnapshotPolicy = "snapshotpolicy"
+
+	// Address of a cluster volume directories are replicated to.
+	paramReplicationTarget = "replicationtarget"
+
+	// REST API port on the replication target cluster.
+	paramReplicationTargetRestPort = "replicationtargetrestport"
+
+	// Directory on the replication target cluster where volumes are replicated to.
+	paramReplicationTargetPath = "replicationtargetpath"
+
+	// Place each volume in a directory named after its PVC's namespace under storeRealPath.
+	paramNamespaceDirectories = "namespacedirectories"
+
+	// Quota on each namespace directory, may be overridden by namespaceQuotaAnnotation.
+	paramNamespaceQuota = "namespacequota"
+
+	// ACL applied to new volume directories, as JSON.
+	paramAclTemplate = "acltemplate"
+
+	// Directory on the cluster whose ACL is copied to new volume directories.
+	paramAclTemplatePath = "acltemplatepath"
+
+	// Secret with credentials for the replication target cluster.
+	paramReplicationSecretName      = "replicationsecretname"
+	paramReplicationSecretNamespace = "replicationsecretnamespace"
+
+	// Added by the provisioner with --extra-create-metadata.
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey       = "csi.storage.k8s.io/pv/name"
+
+	// Optional TLS settings in the login secrets.
+	secretCACert     = "cacert"
+	secretServerName = "servername"
+	secretInsecure   = "insecure"
+
+	// Volume directories are named after their PV, which the provisioner names pvc-<uid>.
+	volumeNamePrefix = "pvc-"
+
+	// Namespace annotation with the quota for the namespace directory, e.g. "500Gi".
+	namespaceQuotaAnnotation = "qumulo.csi.k8s.io/namespace-quota"
 )
 
 func NewDriver(nodeID, driverName, endpoint string, perm *uint32) *Driver {
@@ -67,6 +138,7 @@ func NewDriver(nodeID, driverName, endpoint string, perm *uint32) *Driver {
 		endpoint: endpoint,
 		cap:      map[csi.VolumeCapability_AccessMode_Mode]bool{},
 		perm:     perm,
+		sessions: NewSessionCache(DefaultSessionTTL),
 	}
 
 	vcam := []csi.VolumeCapability_AccessMode_Mode{
@@ -84,6 +156,8 @@ func NewDriver(nodeID, driverName, endpoint string, perm *uint32) *Driver {
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 	})
 
 	n.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
@@ -94,6 +168,44 @@ func NewDriver(nodeID, driverName, endpoint string, perm *uint32) *Driver {
 	return n
 }
 
+// Give the controller access to the Kubernetes API.
+func (n *Driver) SetKubeClient(client kubernetes.Interface) {
+	n.kubeClient = client
+	n.startEventRecorder()
+}
+
+// Set how controller REST requests are retried.
+func (n *Driver) SetRetryPolicy(policy RetryPolicy) {
+	n.sessions.RetryPolicy = policy
+}
+
+// Send the correlation ID of each CSI call with its REST requests in this header.
+func (n *Driver) SetCorrelationHeader(header string) {
+	n.sessions.CorrelationHeader = header
+}
+
+// Report not ready unless these mount helpers, e.g. mount.nfs, are installed.
+func (n *Driver) SetMountHelpers(helpers []string) {
+	n.mountHelpers = helpers
+}
+
+// Report not ready unless every cluster named by a StorageClass accepts connections.
+func (n *Driver) SetProbeClusters(probe bool) {
+	n.probeClusters = probe
+}
+
+// Periodically export the quota usage of every volume as metrics.
+func (n *Driver) SetQuotaUsageInterval(interval time.Duration) {
+	n.quotaUsageInterval = interval
+}
+
+// Periodically report volume directories no PV references, tree deleting those this driver
+// provisioned once they've been orphaned for deleteAfter if it isn't 0.
+func (n *Driver) SetOrphanCollection(interval time.Duration, deleteAfter time.Duration) {
+	n.orphanScanInterval = interval
+	n.orphanDeleteAfter = deleteAfter
+}
+
 func NewNodeServer(n *Driver, mounter mount.Interface) *NodeServer {
 	return &NodeServer{
 		Driver:  n,
@@ -109,8 +221,26 @@ func (n *Driver) Run(testMode bool) {
 	klog.Infof("\nDRIVER INFORMATION:\n-------------------\n%s\n\nStreaming logs below:", versionMeta)
 
 	n.ns = NewNodeServer(n, mount.New(""))
+	cs := NewControllerServer(n)
+
+	if n.quotaUsageInterval > 0 {
+		if n.kubeClient == nil {
+			klog.Warning("Volume quota usage needs Kubernetes API access, not exporting it")
+		} else {
+			go cs.runQuotaUsageExporter(n.quotaUsageInterval)
+		}
+	}
+
+	if n.orphanScanInterval > 0 {
+		if n.kubeClient == nil {
+			klog.Warning("Orphaned volume collection needs Kubernetes API access, disabling it")
+		} else {
+			go cs.runOrphanCollector(n.orphanScanInterval, n.orphanDeleteAfter)
+		}
+	}
+
 	s := NewNonBlockingGRPCServer()
-	s.Start(n.endpoint, NewDefaultIdentityServer(n), NewControllerServer(n), n.ns, testMode)
+	s.Start(n.endpoint, NewDefaultIdentityServer(n), cs, n.ns, testMode)
 	s.Wait()
 }
 
@@ -0,0 +1,219 @@
+package qumulo
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	volumeUsedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "volume_used_bytes",
+			Help:      "Bytes used in a volume's directory, from its Qumulo quota.",
+		},
+		[]string{"persistentvolume", "persistentvolumeclaim", "namespace"},
+	)
+	volumeLimitBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "volume_limit_bytes",
+			Help:      "Quota limit of a volume's directory.",
+		},
+		[]string{"persistentvolume", "persistentvolumeclaim", "namespace"},
+	)
+	quotaUsageFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "quota_usage_failures_total",
+			Help:      "Failures to read the quotas of a cluster's volumes, by cluster.",
+		},
+		[]string{"host"},
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(volumeUsedBytes, volumeLimitBytes, quotaUsageFailures)
+}
+
+// PVs whose quotas are read with one connection.
+type quotaUsageGroup struct {
+	server          string
+	restPort        int
+	secretName      string
+	secretNamespace string
+}
+
+type quotaUsageVolume struct {
+	pv   *v1.PersistentVolume
+	qVol *qumuloVolume
+}
+
+type quotaUsage struct {
+	labels prometheus.Labels
+	quota  QuotaStatus
+}
+
+type quotaUsageExporter struct {
+	cs *ControllerServer
+
+	// The labels of the series set by the last update, by PV name. A PV whose quota can't be
+	// read keeps its previous values rather than disappearing.
+	exported map[string]prometheus.Labels
+}
+
+func newQuotaUsageExporter(cs *ControllerServer) *quotaUsageExporter {
+	return &quotaUsageExporter{cs: cs, exported: map[string]prometheus.Labels{}}
+}
+
+// Export the quota usage of every PV provisioned by this driver, whether mounted or not.
+func (cs *ControllerServer) runQuotaUsageExporter(interval time.Duration) {
+	exporter := newQuotaUsageExporter(cs)
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		ctx = withRequestLog(ctx, newCorrelationID())
+		err := exporter.update(ctx)
+		cancel()
+		if err != nil {
+			logError(ctx, err, "Failed to update volume quota usage")
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Quotas are listed once per cluster and matched to PVs by path, using the PV's controller
+// expand secret to log in.
+func (e *quotaUsageExporter) update(ctx context.Context) error {
+	cs := e.cs
+
+	pvs, err := cs.Driver.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	groups := map[quotaUsageGroup][]quotaUsageVolume{}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+
+		source := pv.Spec.CSI
+		if source == nil || source.Driver != cs.Driver.name {
+			continue
+		}
+
+		qVol, err := makeQumuloVolumeFromID(source.VolumeHandle)
+		if err != nil {
+			logInfo(ctx, 4, "Skipping quota usage of PV", "pv", pv.Name, "err", err)
+			continue
+		}
+
+		if source.ControllerExpandSecretRef == nil {
+			logInfo(ctx, 4, "Skipping quota usage of PV without an expand secret", "pv", pv.Name)
+			continue
+		}
+
+		group := quotaUsageGroup{
+			server:          qVol.server,
+			restPort:        qVol.restPort,
+			secretName:      source.ControllerExpandSecretRef.Name,
+			secretNamespace: source.ControllerExpandSecretRef.Namespace,
+		}
+		groups[group] = append(groups[group], quotaUsageVolume{pv: pv, qVol: qVol})
+	}
+
+	exported := map[string]prometheus.Labels{}
+	var firstErr error
+
+	for group, volumes := range groups {
+		usages, err := cs.getQuotaUsage(ctx, group, volumes)
+		if err != nil {
+			logError(ctx, err, "Failed to read quotas", "cluster", group.server)
+			quotaUsageFailures.WithLabelValues(group.server).Inc()
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			for _, volume := range volumes {
+				if previous, ok := e.exported[volume.pv.Name]; ok {
+					exported[volume.pv.Name] = previous
+				}
+			}
+			continue
+		}
+
+		for _, usage := range usages {
+			volumeUsedBytes.With(usage.labels).Set(float64(usage.quota.CapacityUsage))
+			volumeLimitBytes.With(usage.labels).Set(float64(usage.quota.Limit))
+			exported[usage.labels["persistentvolume"]] = usage.labels
+		}
+	}
+
+	// Drop the series of deleted PVs, PVs whose quota is gone and PVs whose claim changed.
+	for name, previous := range e.exported {
+		current, ok := exported[name]
+		if ok && reflect.DeepEqual(current, previous) {
+			continue
+		}
+		volumeUsedBytes.Delete(previous)
+		volumeLimitBytes.Delete(previous)
+	}
+	e.exported = exported
+
+	return firstErr
+}
+
+func (cs *ControllerServer) getQuotaUsage(
+	ctx context.Context,
+	group quotaUsageGroup,
+	volumes []quotaUsageVolume,
+) ([]quotaUsage, error) {
+	secrets, err := cs.getSecrets(ctx, group.secretNamespace, group.secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	connection, err := cs.createConnection(ctx, group.server, group.restPort, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas, err := connection.QuotaStatusList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := map[string]QuotaStatus{}
+	for _, quota := range quotas {
+		byPath[filepath.Clean(quota.Path)] = quota
+	}
+
+	usages := []quotaUsage{}
+	for _, volume := range volumes {
+		quota, ok := byPath[volume.qVol.getVolumeRealPath()]
+		if !ok {
+			continue
+		}
+
+		labels := prometheus.Labels{
+			"persistentvolume":      volume.pv.Name,
+			"persistentvolumeclaim": "",
+			"namespace":             "",
+		}
+		if claim := volume.pv.Spec.ClaimRef; claim != nil {
+			labels["persistentvolumeclaim"] = claim.Name
+			labels["namespace"] = claim.Namespace
+		}
+
+		usages = append(usages, quotaUsage{labels: labels, quota: quota})
+	}
+
+	return usages, nil
+}
@@ -0,0 +1,173 @@
+package qumulo
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func makeQuotaUsagePV(
+	name string,
+	driver string,
+	volumeId string,
+	secret bool,
+) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeId},
+			},
+			ClaimRef: &v1.ObjectReference{Name: name + "-claim", Namespace: "team-a"},
+		},
+	}
+	if secret {
+		pv.Spec.CSI.ControllerExpandSecretRef = &v1.SecretReference{
+			Name:      "qumulo-login",
+			Namespace: "kube-system",
+		}
+	}
+	return pv
+}
+
+func TestUpdateQuotaUsage(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = "qumulo.csi.k8s.io"
+
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "qumulo-login", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"username": []byte("bob"),
+				"password": []byte("yeruncle"),
+			},
+		},
+		makeQuotaUsagePV("pv1", "qumulo.csi.k8s.io", "v1:1.2.3.4:44//a//a//vol1", true),
+		makeQuotaUsagePV("pv2", "qumulo.csi.k8s.io", "v1:1.2.3.4:44//a//a//vol2", false),
+		makeQuotaUsagePV("pv3", "nfs.csi.k8s.io", "v1:1.2.3.4:44//a//a//vol3", true),
+		makeQuotaUsagePV("pv4", "qumulo.csi.k8s.io", "junk", true),
+	))
+
+	messages := append(
+		connectMessages("yeruncle"),
+		Message{
+			"/v1/files/quotas/status/?limit=1000",
+			200,
+			"",
+			"{\"quotas\": [" +
+				"{\"id\": \"9\", \"path\": \"/a/vol1/\", \"limit\": \"1000\", " +
+				"\"capacity_usage\": \"10\"}, " +
+				"{\"id\": \"12\", \"path\": \"/a/vol2/\", \"limit\": \"2000\", " +
+				"\"capacity_usage\": \"20\"}" +
+				"], \"paging\": {\"next\": \"\"}}",
+		},
+	)
+	cs.Driver.sessions.newClient = func(TLSOptions) (*http.Client, error) {
+		return newTestClient(t, "1.2.3.4", 44, &messages), nil
+	}
+
+	volumeUsedBytes.Reset()
+	volumeLimitBytes.Reset()
+
+	exporter := newQuotaUsageExporter(cs)
+	stale := prometheus.Labels{
+		"persistentvolume":      "stale",
+		"persistentvolumeclaim": "stale-claim",
+		"namespace":             "team-a",
+	}
+	volumeUsedBytes.With(stale).Set(1)
+	exporter.exported["stale"] = stale
+
+	err := exporter.update(context.TODO())
+	assert.NoError(t, err)
+	assertMessagesConsumed(t, messages)
+
+	assert.Equal(t, testutil.CollectAndCount(volumeUsedBytes), 1)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(volumeUsedBytes.WithLabelValues("pv1", "pv1-claim", "team-a")),
+		float64(10),
+	)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(volumeLimitBytes.WithLabelValues("pv1", "pv1-claim", "team-a")),
+		float64(1000),
+	)
+}
+
+func TestUpdateQuotaUsageFailedGroup(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.name = "qumulo.csi.k8s.io"
+
+	unreadable := makeQuotaUsagePV("pv2", "qumulo.csi.k8s.io", "v1:1.2.3.4:44//a//a//vol2", true)
+	unreadable.Spec.CSI.ControllerExpandSecretRef.Name = "missing-login"
+
+	cs.Driver.SetKubeClient(fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "qumulo-login", Namespace: "kube-system"},
+			Data: map[string][]byte{
+				"username": []byte("bob"),
+				"password": []byte("yeruncle"),
+			},
+		},
+		makeQuotaUsagePV("pv1", "qumulo.csi.k8s.io", "v1:1.2.3.4:44//a//a//vol1", true),
+		unreadable,
+	))
+
+	messages := append(
+		connectMessages("yeruncle"),
+		Message{
+			"/v1/files/quotas/status/?limit=1000",
+			200,
+			"",
+			"{\"quotas\": [" +
+				"{\"id\": \"9\", \"path\": \"/a/vol1/\", \"limit\": \"1000\", " +
+				"\"capacity_usage\": \"10\"}" +
+				"], \"paging\": {\"next\": \"\"}}",
+		},
+	)
+	cs.Driver.sessions.newClient = func(TLSOptions) (*http.Client, error) {
+		return newTestClient(t, "1.2.3.4", 44, &messages), nil
+	}
+
+	volumeUsedBytes.Reset()
+	volumeLimitBytes.Reset()
+	failures := testutil.ToFloat64(quotaUsageFailures.WithLabelValues("1.2.3.4"))
+
+	// As exported by an earlier update, when pv2's secret could still be read.
+	exporter := newQuotaUsageExporter(cs)
+	previous := prometheus.Labels{
+		"persistentvolume":      "pv2",
+		"persistentvolumeclaim": "pv2-claim",
+		"namespace":             "team-a",
+	}
+	volumeUsedBytes.With(previous).Set(20)
+	volumeLimitBytes.With(previous).Set(2000)
+	exporter.exported["pv2"] = previous
+
+	err := exporter.update(context.TODO())
+	assert.Error(t, err)
+	assertMessagesConsumed(t, messages)
+
+	assert.Equal(t, testutil.CollectAndCount(volumeUsedBytes), 2)
+	assert.Equal(
+		t,
+		testutil.ToFloat64(volumeUsedBytes.WithLabelValues("pv1", "pv1-claim", "team-a")),
+		float64(10),
+	)
+	assert.Equal(t, testutil.ToFloat64(volumeUsedBytes.With(previous)), float64(20))
+	assert.Equal(t, testutil.ToFloat64(volumeLimitBytes.With(previous)), float64(2000))
+	assert.Equal(
+		t,
+		testutil.ToFloat64(quotaUsageFailures.WithLabelValues("1.2.3.4")),
+		failures+1,
+	)
+	assert.Equal(t, exporter.exported["pv2"], previous)
+}
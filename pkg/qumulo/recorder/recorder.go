@@ -0,0 +1,339 @@
+// Package recorder provides an http.RoundTripper which records the REST requests of a test to a
+// fixture file and replays them later, so tests written against a real cluster can run
+// without one.
+//
+// Fixtures are scrubbed of credentials as they're written: bearer tokens and passwords in
+// JSON bodies are replaced and no request headers are kept.
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Replaces the values of scrubbedKeys in fixtures.
+const Scrubbed = "SCRUBBED"
+
+// JSON object keys whose values are never written to fixtures, at any depth.
+var scrubbedKeys = map[string]bool{
+	"bearer_token": true,
+	"password":     true,
+}
+
+// Response headers kept in fixtures.
+var recordedHeaders = []string{"Content-Type", "ETag"}
+
+type Request struct {
+	Method string `json:"method"`
+	Uri    string `json:"uri"`
+
+	// JSON bodies are kept as JSON so fixtures are readable, anything else as text.
+	Body json.RawMessage `json:"body,omitempty"`
+	Text string          `json:"text,omitempty"`
+}
+
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+
+	Body json.RawMessage `json:"body,omitempty"`
+	Text string          `json:"text,omitempty"`
+}
+
+// A request and the response the cluster gave it.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type mode int
+
+const (
+	passThrough mode = iota
+	recording
+	replaying
+)
+
+// Passes requests to Transport until Record or Replay is called, and again after Stop.
+type Recorder struct {
+	Transport http.RoundTripper
+
+	mutex        sync.Mutex
+	mode         mode
+	path         string
+	interactions []Interaction
+
+	// When replaying, which interactions have been replayed.
+	replayed []bool
+}
+
+func New(transport http.RoundTripper) *Recorder {
+	return &Recorder{Transport: transport}
+}
+
+// Start recording interactions, to be written to path by Stop.
+func (r *Recorder) Record(path string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.mode = recording
+	r.path = path
+	r.interactions = []Interaction{}
+}
+
+// Start replaying the interactions recorded in path. Requests are answered by the first
+// interaction not yet replayed with the same method, URI and body, so concurrent requests can
+// be replayed in a different order than they were recorded.
+func (r *Recorder) Replay(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var interactions []Interaction
+	err = json.Unmarshal(data, &interactions)
+	if err != nil {
+		return fmt.Errorf("Invalid fixture %s: %v", path, err)
+	}
+
+	// Bodies are matched in the compact form makeRequest gives them.
+	for i := range interactions {
+		body := interactions[i].Request.Body
+		if body != nil {
+			var compact bytes.Buffer
+			err = json.Compact(&compact, body)
+			if err != nil {
+				return fmt.Errorf("Invalid fixture %s: %v", path, err)
+			}
+			interactions[i].Request.Body = compact.Bytes()
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.mode = replaying
+	r.path = path
+	r.interactions = interactions
+	r.replayed = make([]bool, len(interactions))
+
+	return nil
+}
+
+// Go back to passing requests through. When recording this writes the fixture, when replaying
+// it fails if some interactions weren't replayed.
+func (r *Recorder) Stop() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	mode := r.mode
+	r.mode = passThrough
+
+	switch mode {
+	case recording:
+		return r.save()
+	case replaying:
+		for i, replayed := range r.replayed {
+			if !replayed {
+				request := r.interactions[i].Request
+				return fmt.Errorf(
+					"%s %s was recorded in %s but not replayed, the fixture is out of date",
+					request.Method,
+					request.Uri,
+					r.path,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Recorder) save() error {
+	data, err := json.MarshalIndent(r.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(r.path, append(data, '\n'), 0644)
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mutex.Lock()
+	mode := r.mode
+	r.mutex.Unlock()
+
+	switch mode {
+	case recording:
+		return r.record(req)
+	case replaying:
+		return r.replay(req)
+	}
+
+	return r.Transport.RoundTrip(req)
+}
+
+func (r *Recorder) record(req *http.Request) (*http.Response, error) {
+	request, err := makeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := r.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	recorded := Response{StatusCode: response.StatusCode, Header: http.Header{}}
+	for _, key := range recordedHeaders {
+		if value := response.Header.Get(key); value != "" {
+			recorded.Header.Set(key, value)
+		}
+	}
+	recorded.Body, recorded.Text, err = scrubBody(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.interactions = append(r.interactions, Interaction{request, recorded})
+
+	return response, nil
+}
+
+func (r *Recorder) replay(req *http.Request) (*http.Response, error) {
+	request, err := makeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, interaction := range r.interactions {
+		if r.replayed[i] || !interaction.Request.matches(request) {
+			continue
+		}
+		r.replayed[i] = true
+
+		body := []byte(interaction.Response.Text)
+		if interaction.Response.Body != nil {
+			body = interaction.Response.Body
+		}
+
+		header := interaction.Response.Header
+		if header == nil {
+			header = http.Header{}
+		}
+
+		return &http.Response{
+			Status:        http.StatusText(interaction.Response.StatusCode),
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf(
+		"%s %s isn't recorded in %s, the fixture is out of date",
+		request.Method,
+		request.Uri,
+		r.path,
+	)
+}
+
+// The scrubbed form of req, leaving req's body readable.
+func makeRequest(req *http.Request) (Request, error) {
+	request := Request{Method: req.Method, Uri: req.URL.RequestURI()}
+	if req.Body == nil {
+		return request, nil
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return request, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	request.Body, request.Text, err = scrubBody(data)
+
+	return request, err
+}
+
+func (request Request) matches(other Request) bool {
+	return request.Method == other.Method &&
+		request.Uri == other.Uri &&
+		bytes.Equal(request.Body, other.Body) &&
+		request.Text == other.Text
+}
+
+// Compact a JSON body with scrubbedKeys replaced, or return a body which isn't JSON as text.
+func scrubBody(data []byte) (json.RawMessage, string, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, "", nil
+	}
+	if !json.Valid(data) {
+		return nil, string(data), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, "", err
+	}
+
+	scrubbed, err := json.Marshal(scrub(value))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return scrubbed, "", nil
+}
+
+func scrub(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			if scrubbedKeys[key] {
+				v[key] = Scrubbed
+			} else {
+				v[key] = scrub(element)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = scrub(element)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,113 @@
+package recorder
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/session/login":
+			w.Write([]byte(`{"bearer_token": "1:secret-token"}`))
+		case "/v1/files/2/info/attributes":
+			w.Header().Set("ETag", `"7"`)
+			w.Write([]byte(`{"id": "2", "size": "4096"}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte("not found"))
+		}
+	}))
+}
+
+func do(t *testing.T, client *http.Client, method string, uri string, body string) (int, string) {
+	req, err := http.NewRequest(method, uri, strings.NewReader(body))
+	assert.NoError(t, err)
+
+	response, err := client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+
+	return response.StatusCode, string(data)
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	server := newTestServer()
+	fixture := filepath.Join(t.TempDir(), "rest", "fixture.json")
+
+	recorder := New(http.DefaultTransport)
+	client := &http.Client{Transport: recorder}
+
+	recorder.Record(fixture)
+	login := `{"username": "admin", "password": "hunter2"}`
+	_, body := do(t, client, "POST", server.URL+"/v1/session/login", login)
+	assert.Equal(t, body, `{"bearer_token": "1:secret-token"}`)
+	do(t, client, "GET", server.URL+"/v1/files/2/info/attributes", "")
+	do(t, client, "GET", server.URL+"/v1/files/3/info/attributes", "")
+	assert.NoError(t, recorder.Stop())
+
+	server.Close()
+
+	data, err := ioutil.ReadFile(fixture)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+	assert.NotContains(t, string(data), "secret-token")
+	assert.Contains(t, string(data), Scrubbed)
+
+	assert.NoError(t, recorder.Replay(fixture))
+
+	status, body := do(t, client, "GET", server.URL+"/v1/files/3/info/attributes", "")
+	assert.Equal(t, status, 404)
+	assert.Equal(t, body, "not found")
+
+	req, err := http.NewRequest("GET", server.URL+"/v1/files/2/info/attributes", nil)
+	assert.NoError(t, err)
+	response, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, response.StatusCode, 200)
+	assert.Equal(t, response.Header.Get("ETag"), `"7"`)
+	response.Body.Close()
+
+	status, body = do(t, client, "POST", server.URL+"/v1/session/login", login)
+	assert.Equal(t, status, 200)
+	assert.JSONEq(t, body, `{"bearer_token": "SCRUBBED"}`)
+
+	assert.NoError(t, recorder.Stop())
+}
+
+func TestReplayOutOfDate(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	fixture := filepath.Join(t.TempDir(), "fixture.json")
+
+	recorder := New(http.DefaultTransport)
+	client := &http.Client{Transport: recorder}
+
+	recorder.Record(fixture)
+	do(t, client, "GET", server.URL+"/v1/files/2/info/attributes", "")
+	assert.NoError(t, recorder.Stop())
+
+	assert.NoError(t, recorder.Replay(fixture))
+
+	status, body := do(t, client, "DELETE", server.URL+"/v1/files/2", "")
+	assert.Equal(t, status, 0)
+	assert.Contains(t, body, "DELETE /v1/files/2 isn't recorded")
+
+	err := recorder.Stop()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "GET /v1/files/2/info/attributes was recorded")
+
+	status, _ = do(t, client, "DELETE", server.URL+"/v1/files/2", "")
+	assert.Equal(t, status, 404)
+}
@@ -2,22 +2,36 @@ package qumulo
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/blang/semver"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
+// Applied to each request whose context has no deadline.
+const DefaultRequestTimeout = time.Minute
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -28,19 +42,95 @@ type Connection struct {
 	Port     int
 	Username string
 	Password string
-	token    string
+	session  *restSession
 	client   *http.Client
+
+	RetryPolicy RetryPolicy
+
+	// If set, requests carry the correlation ID of the CSI call they were made for in this
+	// header, so that they can be found in the cluster's audit log.
+	CorrelationHeader string
+
+	// Replaceable by tests.
+	sleep func(ctx context.Context, delay time.Duration) error
 }
 
-func MakeConnection(host string, port int, username string, password string, c *http.Client) Connection {
-	// XXX scott: figure out how to make this an option, or install certs somehow
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+// The bearer token, shared by copies of a Connection so that it can be used concurrently.
+type restSession struct {
+	mutex sync.Mutex
+	token string
+}
+
+func (self *restSession) getToken() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.token
+}
+
+// The bearer token of the session, empty before the first login. Lets tools keep a session
+// between runs.
+func (self *Connection) BearerToken() string {
+	return self.session.getToken()
+}
+
+// Use a token from an earlier session. It's replaced by logging in again once it expires.
+func (self *Connection) SetBearerToken(token string) {
+	self.session.mutex.Lock()
+	defer self.session.mutex.Unlock()
+
+	self.session.token = token
+}
+
+// How the cluster's certificate is verified.
+type TLSOptions struct {
+	// PEM encoded CA certificates, the system roots are used when empty.
+	CACert []byte
+
+	// Name the certificate must be valid for, when it differs from the host connected to.
+	ServerName string
 
+	// Skip verification entirely. Only for test clusters with self-signed certificates.
+	Insecure bool
+}
+
+// Make a client with its own transport so TLS settings don't leak between clusters.
+func NewHTTPClient(options TLSOptions) (*http.Client, error) {
+	config := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.Insecure,
+	}
+
+	if len(options.CACert) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(options.CACert) {
+			return nil, fmt.Errorf("No PEM certificates found in CA bundle")
+		}
+		config.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	return &http.Client{Transport: transport}, nil
+}
+
+func MakeConnection(host string, port int, username string, password string, c *http.Client) Connection {
 	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		return http.ErrUseLastResponse
 	}
 
-	return Connection{Host: host, Port: port, Username: username, Password: password, client: c}
+	return Connection{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		session:  &restSession{},
+		client:   c,
+
+		RetryPolicy: DefaultRetryPolicy,
+		sleep:       sleepContext,
+	}
 }
 
 type RestError struct {
@@ -63,6 +153,34 @@ func (e RestError) Error() string {
 	)
 }
 
+// A read-modify-write which kept losing to other writers (412 Precondition Failed).
+type ConcurrentModificationError struct {
+	// E.g. "Snapshot policy".
+	Resource string
+	Id       string
+}
+
+func (e ConcurrentModificationError) Error() string {
+	return fmt.Sprintf("%s %s was modified concurrently too many times", e.Resource, e.Id)
+}
+
+// Number of times a read-modify-write is retried when another writer changed the resource in
+// between (412 Precondition Failed).
+const conditionalUpdateAttempts = 5
+
+// Repeat a read-modify-write of the resource id while its write fails with 412. attempt reads
+// the resource and writes it back with If-Match set to the ETag it read.
+func conditionalUpdate(resource string, id string, attempt func() error) error {
+	for i := 0; i < conditionalUpdateAttempts; i++ {
+		err := attempt()
+		if !errorIsRestErrorWithStatus(err, 412) {
+			return err
+		}
+	}
+
+	return ConcurrentModificationError{Resource: resource, Id: id}
+}
+
 func errorIsRestErrorWithStatus(err error, statusCode int) bool {
 	if err == nil {
 		return false
@@ -105,8 +223,102 @@ func panicOnError(err error) {
 	}
 }
 
-func (self *Connection) Login() error {
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+func (self *Connection) Login(ctx context.Context) error {
+	self.session.mutex.Lock()
+	defer self.session.mutex.Unlock()
+
+	return self.login(ctx)
+}
+
+// Log in again unless another request already replaced staleToken, so a burst of requests
+// which all got a 401 only logs in once.
+func (self *Connection) relogin(ctx context.Context, staleToken string) error {
+	self.session.mutex.Lock()
+	defer self.session.mutex.Unlock()
+
+	if self.session.token != staleToken {
+		return nil
+	}
+
+	return self.login(ctx)
+}
+
+// Bound a request when the caller didn't, so a hung node can't hold a goroutine forever.
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DefaultRequestTimeout)
+}
+
+// A request which never got a response from the cluster. It surfaces as codes.Unavailable,
+// keeping the cause so retryDelay can tell whether the request is safe to retry.
+type unreachableError struct {
+	host string
+	port int
+	err  error
+}
+
+func (z unreachableError) Error() string {
+	return fmt.Sprintf("Request to %s:%d failed: %v", z.host, z.port, z.err)
+}
+
+func (z unreachableError) Unwrap() error {
+	return z.err
+}
+
+func (z unreachableError) GRPCStatus() *status.Status {
+	return status.New(codes.Unavailable, z.Error())
+}
+
+// Map a cancelled or timed out request to the matching gRPC code. Certificate failures won't go
+// away on retry, so make them stand out from other transport errors.
+func (self *Connection) transportError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return status.Errorf(
+			codes.DeadlineExceeded,
+			"Request to %s:%d timed out: %v",
+			self.Host,
+			self.Port,
+			err,
+		)
+	case context.Canceled:
+		return status.Errorf(
+			codes.Canceled,
+			"Request to %s:%d cancelled: %v",
+			self.Host,
+			self.Port,
+			err,
+		)
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var systemRoots x509.SystemRootsError
+
+	if errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &systemRoots) {
+		return status.Errorf(
+			codes.Unavailable,
+			"Certificate of %s:%d failed to verify, check the CA bundle and server name: %v",
+			self.Host,
+			self.Port,
+			err,
+		)
+	}
+
+	return unreachableError{self.Host, self.Port, err}
+}
+
+// Must be called with the session mutex held.
+func (self *Connection) login(ctx context.Context) (err error) {
+	ctx, span := tracer().Start(ctx, "login", trace.WithAttributes(self.spanAttributes()...))
+	statusCode := 0
+	defer func() { endRestSpan(span, statusCode, err) }()
 
 	loginUrl := fmt.Sprintf("https://%s:%d/v1/session/login", self.Host, self.Port)
 
@@ -115,58 +327,238 @@ func (self *Connection) Login() error {
 	json_data, err := json.Marshal(body)
 	panicOnError(err)
 
-	response, err := self.client.Post(loginUrl, "application/json", bytes.NewBuffer(json_data))
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", loginUrl, bytes.NewBuffer(json_data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	self.addCorrelationHeader(ctx, req)
+
+	response, err := self.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("Login failed: %v", err)
+		restLogins.WithLabelValues(self.Host, "error").Inc()
+		return self.transportError(ctx, err)
 	}
 
+	statusCode = response.StatusCode
+
 	if response.StatusCode != 200 {
+		restLogins.WithLabelValues(self.Host, "failed").Inc()
 		return status.Errorf(codes.Unauthenticated, "Login failed: %d", response.StatusCode)
 	}
 
+	restLogins.WithLabelValues(self.Host, "success").Inc()
+
 	var res map[string]string
 
 	json.NewDecoder(response.Body).Decode(&res)
+	response.Body.Close()
 
-	self.token = res["bearer_token"]
+	self.session.token = res["bearer_token"]
 
 	return nil
 }
 
-func (self *Connection) do(verb string, uri string, body []byte) ([]byte, error) {
+func (self *Connection) addCorrelationHeader(ctx context.Context, req *http.Request) {
+	if self.CorrelationHeader == "" {
+		return
+	}
+
+	if id := correlationID(ctx); id != "" {
+		req.Header.Set(self.CorrelationHeader, id)
+	}
+}
+
+func (self *Connection) doWithHeaders(
+	ctx context.Context,
+	verb string,
+	uri string,
+	body []byte,
+	headers http.Header,
+	token string,
+	attempt int,
+) (result []byte, responseHeaders http.Header, err error) {
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+
+	// The request's span from DoWithHeaders has the host, verb and URI.
+	ctx, span := tracer().Start(
+		ctx,
+		"attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributeRestAttempt.Int(attempt)),
+	)
+	statusCode := 0
+	defer func() { endRestSpan(span, statusCode, err) }()
+
 	url := fmt.Sprintf("https://%s:%d%s", self.Host, self.Port, uri)
-	req, err := http.NewRequest(verb, url, nil)
-	req.Header.Add("Authorization", "Bearer "+self.token)
+	req, err := http.NewRequestWithContext(ctx, verb, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	self.addCorrelationHeader(ctx, req)
+
+	for key, values := range headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
 
 	if len(body) > 0 {
 		req.Body = io.NopCloser(bytes.NewBuffer(body))
 		req.Header.Add("Content-Type", "application/json")
 	}
 
+	start := time.Now()
+
 	response, err := self.client.Do(req)
 	if err != nil {
-		return nil, err
+		observeRestRequest(self.Host, verb, uri, 0, start)
+		return nil, nil, self.transportError(ctx, err)
 	}
 
-	statusCode := response.StatusCode
+	statusCode = response.StatusCode
+	observeRestRequest(self.Host, verb, uri, statusCode, start)
 
 	responseData, err := ioutil.ReadAll(response.Body)
 	response.Body.Close()
 	if err != nil {
-		return nil, err
+		return nil, nil, self.transportError(ctx, err)
 	}
 
 	if statusCode < 200 || statusCode >= 300 {
-		return nil, MakeRestError(statusCode, responseData)
+		return nil, response.Header, MakeRestError(statusCode, responseData)
 	}
 
-	return responseData, err
+	return responseData, response.Header, err
+}
+
+func (self *Connection) Do(
+	ctx context.Context,
+	verb string,
+	uri string,
+	body []byte,
+) (result []byte, err error) {
+	result, _, err = self.DoWithHeaders(ctx, verb, uri, body, nil)
+	return
+}
+
+// Like Do, but sends extra request headers and returns the response headers. This is needed
+// for conditional requests (If-Match / ETag).
+func (self *Connection) DoWithHeaders(
+	ctx context.Context,
+	verb string,
+	uri string,
+	body []byte,
+	headers http.Header,
+) (result []byte, responseHeaders http.Header, err error) {
+	start := time.Now()
+
+	ctx, span := tracer().Start(
+		ctx,
+		verb+" "+uriTemplate(uri),
+		trace.WithAttributes(self.spanAttributes()...),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(verb),
+			attributeRestUri.String(uriTemplate(uri)),
+		),
+	)
+	attempt := 1
+	defer func() {
+		span.SetAttributes(attributeRestAttempts.Int(attempt))
+		endRestSpan(span, 0, err)
+	}()
+
+	for ; ; attempt++ {
+		result, responseHeaders, err = self.doAuthenticated(ctx, verb, uri, body, headers, attempt)
+		if err == nil {
+			return
+		}
+
+		delay, retry := self.retryDelay(verb, headers, responseHeaders, err, attempt)
+		if !retry {
+			return
+		}
+
+		if attempt >= self.RetryPolicy.MaxAttempts ||
+			time.Since(start)+delay > self.RetryPolicy.Budget {
+			logInfo(
+				ctx,
+				2,
+				"Giving up on REST request",
+				"host",
+				self.Host,
+				"verb",
+				verb,
+				"uri",
+				uri,
+				"attempts",
+				attempt,
+				"err",
+				err,
+			)
+			return
+		}
+
+		logInfo(
+			ctx,
+			2,
+			"Retrying REST request",
+			"host",
+			self.Host,
+			"verb",
+			verb,
+			"uri",
+			uri,
+			"delay",
+			delay,
+			"err",
+			err,
+		)
+
+		_, retrySpan := tracer().Start(
+			ctx,
+			"retry",
+			trace.WithAttributes(
+				attributeRestAttempt.Int(attempt),
+				attributeRestDelay.String(delay.String()),
+			),
+		)
+		sleepErr := self.sleep(ctx, delay)
+		endRestSpan(retrySpan, 0, sleepErr)
+		if sleepErr != nil {
+			err = self.transportError(ctx, sleepErr)
+			return
+		}
+	}
 }
 
-func (self *Connection) Do(verb string, uri string, body []byte) (result []byte, err error) {
-	result, err = self.do(verb, uri, body)
+// A request with a single re-login on 401, which is resent as the same attempt.
+func (self *Connection) doAuthenticated(
+	ctx context.Context,
+	verb string,
+	uri string,
+	body []byte,
+	headers http.Header,
+	attempt int,
+) (result []byte, responseHeaders http.Header, err error) {
+	token := self.session.getToken()
+
+	result, responseHeaders, err = self.doWithHeaders(
+		ctx,
+		verb,
+		uri,
+		body,
+		headers,
+		token,
+		attempt,
+	)
 
-	klog.V(2).Infof("Request to %s URI %s %s", self.Host, verb, uri)
+	logInfo(ctx, 2, "REST request", "host", self.Host, "verb", verb, "uri", uri)
 
 	if err == nil {
 		return
@@ -184,16 +576,151 @@ func (self *Connection) Do(verb string, uri string, body []byte) (result []byte,
 
 	// (Re-)authenticate and try again
 
-	err = self.Login()
+	err = self.relogin(ctx, token)
 	if err != nil {
 		return
 	}
 
-	result, err = self.do(verb, uri, body)
+	result, responseHeaders, err = self.doWithHeaders(
+		ctx,
+		verb,
+		uri,
+		body,
+		headers,
+		self.session.getToken(),
+		attempt,
+	)
 
 	return
 }
 
+/*           _        _
+ *  _ __ ___| |_ _ __(_) ___  ___
+ * | '__/ _ \ __| '__| |/ _ \/ __|
+ * | | |  __/ |_| |  | |  __/\__ \
+ * |_|  \___|\__|_|  |_|\___||___/
+ *  FIGLET: retries
+ */
+
+type RetryPolicy struct {
+	// Total attempts, including the first.
+	MaxAttempts int
+
+	// The backoff doubles from InitialBackoff up to MaxBackoff, with jitter.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// No retry is started which would end after this long since the first attempt.
+	Budget time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	Budget:         30 * time.Second,
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Whether, and after how long, a failed request should be retried.
+//
+// Idempotent requests are retried on network errors and on responses from a cluster which is
+// upgrading or overloaded. Other requests are only retried when the cluster can't have acted
+// on them: the connection was never made, the cluster refused them with 429 or 503, or the
+// request was conditional on an ETag.
+func (self *Connection) retryDelay(
+	verb string,
+	headers http.Header,
+	responseHeaders http.Header,
+	err error,
+	attempt int,
+) (delay time.Duration, retry bool) {
+	idempotent := verb == "GET" || verb == "HEAD" || verb == "PUT" || verb == "DELETE" ||
+		headers.Get("If-Match") != ""
+
+	switch z := err.(type) {
+	case RestError:
+		switch z.StatusCode {
+		case 429, 503:
+			retry = true
+		case 502, 504:
+			retry = idempotent
+		}
+	case unreachableError:
+		var opErr *net.OpError
+		retry = idempotent || (errors.As(z.err, &opErr) && opErr.Op == "dial")
+	default:
+		if _, ok := status.FromError(err); ok {
+			// Already classified, e.g. cancelled or a certificate failure.
+			return
+		}
+
+		var opErr *net.OpError
+		retry = idempotent || (errors.As(err, &opErr) && opErr.Op == "dial")
+	}
+
+	if !retry {
+		return
+	}
+
+	if after, ok := parseRetryAfter(responseHeaders); ok {
+		return after, true
+	}
+
+	return self.RetryPolicy.backoff(attempt), true
+}
+
+// Exponential backoff with equal jitter: half the delay is fixed, half random.
+func (self RetryPolicy) backoff(attempt int) time.Duration {
+	delay := self.InitialBackoff
+	for i := 1; i < attempt && delay < self.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > self.MaxBackoff {
+		delay = self.MaxBackoff
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Retry-After is either a number of seconds or an HTTP date.
+func parseRetryAfter(headers http.Header) (time.Duration, bool) {
+	value := headers.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
 /*                 _
  * __   _____ _ __| |__  ___
  * \ \ / / _ \ '__| '_ \/ __|
@@ -202,24 +729,39 @@ func (self *Connection) Do(verb string, uri string, body []byte) (result []byte,
  *  FIGLET: verbs
  */
 
-func (self *Connection) Get(uri string) (result []byte, err error) {
-	return self.Do("GET", uri, []byte{})
+func (self *Connection) Get(ctx context.Context, uri string) (result []byte, err error) {
+	return self.Do(ctx, "GET", uri, []byte{})
 }
 
-func (self *Connection) Post(uri string, body []byte) (result []byte, err error) {
-	return self.Do("POST", uri, body)
+func (self *Connection) Post(
+	ctx context.Context,
+	uri string,
+	body []byte) (result []byte,
+	err error,
+) {
+	return self.Do(ctx, "POST", uri, body)
 }
 
-func (self *Connection) Put(uri string, body []byte) (result []byte, err error) {
-	return self.Do("PUT", uri, body)
+func (self *Connection) Put(
+	ctx context.Context,
+	uri string,
+	body []byte) (result []byte,
+	err error,
+) {
+	return self.Do(ctx, "PUT", uri, body)
 }
 
-func (self *Connection) Patch(uri string, body []byte) (result []byte, err error) {
-	return self.Do("PATCH", uri, body)
+func (self *Connection) Patch(
+	ctx context.Context,
+	uri string,
+	body []byte) (result []byte,
+	err error,
+) {
+	return self.Do(ctx, "PATCH", uri, body)
 }
 
-func (self *Connection) Delete(uri string) (result []byte, err error) {
-	return self.do("DELETE", uri, []byte{})
+func (self *Connection) Delete(ctx context.Context, uri string) (result []byte, err error) {
+	return self.Do(ctx, "DELETE", uri, []byte{})
 }
 
 /*        _   _        _ _           _
@@ -234,17 +776,111 @@ type FileAttributes struct {
 	Id   string
 	Type string
 	Mode string
+	Name string
+
+	// Directories' paths end in a '/'.
+	Path string
+
+	// The rest are zero when the response doesn't include them.
+	Size       uint64
+	Owner      string
+	Group      string
+	NumLinks   uint64
+	ChildCount uint64
+
+	CreationTime     time.Time
+	ModificationTime time.Time
+	ChangeTime       time.Time
+}
+
+// Attributes as the cluster sends them, with sizes and times as strings.
+type fileAttributesBody struct {
+	Id               string  `json:"id"`
+	Type             string  `json:"type"`
+	Mode             string  `json:"mode"`
+	Name             string  `json:"name"`
+	Path             string  `json:"path"`
+	Size             string  `json:"size"`
+	Owner            string  `json:"owner"`
+	Group            string  `json:"group"`
+	NumLinks         *uint64 `json:"num_links"`
+	ChildCount       *uint64 `json:"child_count"`
+	CreationTime     string  `json:"creation_time"`
+	ModificationTime string  `json:"modification_time"`
+	ChangeTime       string  `json:"change_time"`
+}
+
+func ParseFileAttributes(responseData []byte) (attributes FileAttributes, err error) {
+	var body fileAttributesBody
+	err = json.Unmarshal(responseData, &body)
+	if err != nil {
+		return attributes, fmt.Errorf("Invalid file attributes: %v", err)
+	}
+
+	return parseFileAttributesBody(body)
 }
 
-func ParseFileAttributes(responseData []byte) FileAttributes {
-	var result map[string]interface{}
-	json.Unmarshal(responseData, &result)
+func parseFileAttributesBody(body fileAttributesBody) (attributes FileAttributes, err error) {
+	// Everything that looks at a file relies on these.
+	for _, required := range []struct {
+		field string
+		value string
+	}{
+		{"id", body.Id},
+		{"type", body.Type},
+		{"mode", body.Mode},
+	} {
+		if required.value == "" {
+			return attributes, fmt.Errorf("Invalid file attributes: no %s", required.field)
+		}
+	}
+
+	attributes = FileAttributes{
+		Id:    body.Id,
+		Type:  body.Type,
+		Mode:  body.Mode,
+		Name:  body.Name,
+		Path:  body.Path,
+		Owner: body.Owner,
+		Group: body.Group,
+	}
+
+	if body.Size != "" {
+		attributes.Size, err = strconv.ParseUint(body.Size, 10, 64)
+		if err != nil {
+			return attributes, fmt.Errorf("Invalid file attributes: size %q", body.Size)
+		}
+	}
+	if body.NumLinks != nil {
+		attributes.NumLinks = *body.NumLinks
+	}
+	if body.ChildCount != nil {
+		attributes.ChildCount = *body.ChildCount
+	}
 
-	return FileAttributes{
-		Id:   result["id"].(string),
-		Type: result["type"].(string),
-		Mode: result["mode"].(string),
+	for _, timestamp := range []struct {
+		field string
+		value string
+		time  *time.Time
+	}{
+		{"creation_time", body.CreationTime, &attributes.CreationTime},
+		{"modification_time", body.ModificationTime, &attributes.ModificationTime},
+		{"change_time", body.ChangeTime, &attributes.ChangeTime},
+	} {
+		if timestamp.value == "" {
+			continue
+		}
+		*timestamp.time, err = time.Parse(time.RFC3339Nano, timestamp.value)
+		if err != nil {
+			return attributes, fmt.Errorf(
+				"Invalid file attributes: %s %q",
+				timestamp.field,
+				timestamp.value,
+			)
+		}
 	}
+
+	return attributes, nil
 }
 
 /*   ____                _
@@ -268,7 +904,12 @@ type CreateRequest struct {
  *  FIGLET: CreateDir
  */
 
-func (self *Connection) CreateDir(path string, name string) (attributes FileAttributes, err error) {
+func (self *Connection) CreateDir(
+	ctx context.Context,
+	path string,
+	name string) (attributes FileAttributes,
+	err error,
+) {
 	uri := fmt.Sprintf("/v1/files/%s/entries/", url.QueryEscape(path))
 
 	body := CreateRequest{Name: name, Action: "CREATE_DIRECTORY"}
@@ -276,20 +917,25 @@ func (self *Connection) CreateDir(path string, name string) (attributes FileAttr
 	json_data, err := json.Marshal(body)
 	panicOnError(err)
 
-	responseData, err := self.Post(uri, json_data)
+	responseData, err := self.Post(ctx, uri, json_data)
 	if err != nil {
 		return
 	}
 
-	attributes = ParseFileAttributes(responseData)
+	attributes, err = ParseFileAttributes(responseData)
 
 	return
 }
 
 // Create a directory, or, if it already exists, succeed
-func (self *Connection) EnsureDir(path string, name string) (attributes FileAttributes, err error) {
+func (self *Connection) EnsureDir(
+	ctx context.Context,
+	path string,
+	name string) (attributes FileAttributes,
+	err error,
+) {
 
-	attributes, err = self.CreateDir(path, name)
+	attributes, err = self.CreateDir(ctx, path, name)
 
 	if err == nil {
 		return
@@ -311,7 +957,7 @@ func (self *Connection) EnsureDir(path string, name string) (attributes FileAttr
 	conflictErr := err
 
 	fullPath := fmt.Sprintf("%s/%s", path, name)
-	attributes, err = self.LookUp(fullPath)
+	attributes, err = self.LookUp(ctx, fullPath)
 	if err != nil {
 		return
 	}
@@ -331,7 +977,12 @@ func (self *Connection) EnsureDir(path string, name string) (attributes FileAttr
  *  FIGLET: CreateFile
  */
 
-func (self *Connection) CreateFile(path string, name string) (attributes FileAttributes, err error) {
+func (self *Connection) CreateFile(
+	ctx context.Context,
+	path string,
+	name string) (attributes FileAttributes,
+	err error,
+) {
 	uri := fmt.Sprintf("/v1/files/%s/entries/", url.QueryEscape(path))
 
 	body := CreateRequest{Name: name, Action: "CREATE_FILE"}
@@ -339,12 +990,12 @@ func (self *Connection) CreateFile(path string, name string) (attributes FileAtt
 	json_data, err := json.Marshal(body)
 	panicOnError(err)
 
-	responseData, err := self.Post(uri, json_data)
+	responseData, err := self.Post(ctx, uri, json_data)
 	if err != nil {
 		return
 	}
 
-	attributes = ParseFileAttributes(responseData)
+	attributes, err = ParseFileAttributes(responseData)
 
 	return
 }
@@ -362,24 +1013,27 @@ type QuotaBody struct {
 	Limit string `json:"limit"`
 }
 
-func (self *Connection) GetQuota(id string) (limit uint64, err error) {
+func (self *Connection) GetQuota(ctx context.Context, id string) (limit uint64, err error) {
 	uri := fmt.Sprintf("/v1/files/quotas/%s", id)
 
-	response, err := self.Get(uri)
+	response, err := self.Get(ctx, uri)
 
 	if err != nil {
 		return
 	}
 
 	var obj QuotaBody
-	json.Unmarshal(response, &obj)
+	err = json.Unmarshal(response, &obj)
+	if err != nil {
+		return
+	}
 
 	limit, err = strconv.ParseUint(obj.Limit, 10, 64)
 
 	return
 }
 
-func (self *Connection) CreateQuota(id string, limit uint64) (err error) {
+func (self *Connection) CreateQuota(ctx context.Context, id string, limit uint64) (err error) {
 	uri := "/v1/files/quotas/"
 
 	body := QuotaBody{Id: id, Limit: strconv.FormatUint(limit, 10)}
@@ -387,12 +1041,12 @@ func (self *Connection) CreateQuota(id string, limit uint64) (err error) {
 	json_data, err := json.Marshal(body)
 	panicOnError(err)
 
-	_, err = self.Post(uri, json_data)
+	_, err = self.Post(ctx, uri, json_data)
 
 	return
 }
 
-func (self *Connection) UpdateQuota(id string, limit uint64) (err error) {
+func (self *Connection) UpdateQuota(ctx context.Context, id string, limit uint64) (err error) {
 	uri := fmt.Sprintf("/v1/files/quotas/%s", id)
 
 	body := QuotaBody{Id: id, Limit: strconv.FormatUint(limit, 10)}
@@ -400,14 +1054,14 @@ func (self *Connection) UpdateQuota(id string, limit uint64) (err error) {
 	json_data, err := json.Marshal(body)
 	panicOnError(err)
 
-	_, err = self.Put(uri, json_data)
+	_, err = self.Put(ctx, uri, json_data)
 
 	return
 }
 
-func (self *Connection) EnsureQuota(id string, limit uint64) (err error) {
+func (self *Connection) EnsureQuota(ctx context.Context, id string, limit uint64) (err error) {
 
-	err = self.CreateQuota(id, limit)
+	err = self.CreateQuota(ctx, id, limit)
 
 	switch err.(type) {
 	case RestError:
@@ -422,7 +1076,97 @@ func (self *Connection) EnsureQuota(id string, limit uint64) (err error) {
 		return
 	}
 
-	err = self.UpdateQuota(id, limit)
+	err = self.UpdateQuota(ctx, id, limit)
+
+	return
+}
+
+type QuotaStatus struct {
+	Id            string
+	Path          string
+	Limit         uint64
+	CapacityUsage uint64
+}
+
+type quotaStatusBody struct {
+	Id            string `json:"id"`
+	Path          string `json:"path"`
+	Limit         string `json:"limit"`
+	CapacityUsage string `json:"capacity_usage"`
+}
+
+type quotaStatusListResponse struct {
+	Quotas []quotaStatusBody `json:"quotas"`
+	Paging struct {
+		Next string `json:"next"`
+	} `json:"paging"`
+}
+
+// List every quota on the cluster with its usage. Paths end in a '/'.
+func (self *Connection) QuotaStatusList(ctx context.Context) (quotas []QuotaStatus, err error) {
+	uri := "/v1/files/quotas/status/?limit=1000"
+
+	quotas = []QuotaStatus{}
+
+	for uri != "" {
+		var responseData []byte
+		responseData, err = self.Get(ctx, uri)
+		if err != nil {
+			return
+		}
+
+		var response quotaStatusListResponse
+		err = json.Unmarshal(responseData, &response)
+		if err != nil {
+			return
+		}
+
+		for _, body := range response.Quotas {
+			var quota QuotaStatus
+			quota, err = parseQuotaStatus(body)
+			if err != nil {
+				return
+			}
+
+			quotas = append(quotas, quota)
+		}
+
+		uri = response.Paging.Next
+	}
+
+	return
+}
+
+// The quota of the directory with the given id, with its usage.
+func (self *Connection) QuotaStatusGet(
+	ctx context.Context,
+	id string) (quota QuotaStatus,
+	err error,
+) {
+	uri := fmt.Sprintf("/v1/files/quotas/status/%s", url.QueryEscape(id))
+
+	responseData, err := self.Get(ctx, uri)
+	if err != nil {
+		return
+	}
+
+	var body quotaStatusBody
+	err = json.Unmarshal(responseData, &body)
+	if err != nil {
+		return
+	}
+
+	return parseQuotaStatus(body)
+}
+
+func parseQuotaStatus(body quotaStatusBody) (quota QuotaStatus, err error) {
+	quota = QuotaStatus{Id: body.Id, Path: body.Path}
+
+	quota.Limit, err = strconv.ParseUint(body.Limit, 10, 64)
+	if err != nil {
+		return
+	}
+	quota.CapacityUsage, err = strconv.ParseUint(body.CapacityUsage, 10, 64)
 
 	return
 }
@@ -436,15 +1180,120 @@ func (self *Connection) EnsureQuota(id string, limit uint64) (err error) {
  *  FIGLET: LookUp
  */
 
-func (self *Connection) LookUp(path string) (attributes FileAttributes, err error) {
+func (self *Connection) LookUp(
+	ctx context.Context,
+	path string) (attributes FileAttributes,
+	err error,
+) {
 	uri := fmt.Sprintf("/v1/files/%s/info/attributes", url.QueryEscape(path))
 
-	responseData, err := self.Get(uri)
+	responseData, err := self.Get(ctx, uri)
+	if err != nil {
+		return
+	}
+
+	attributes, err = ParseFileAttributes(responseData)
+
+	return
+}
+
+/*  _     _     _   ____  _
+ * | |   (_)___| |_|  _ \(_)_ __
+ * | |   | / __| __| | | | | '__|
+ * | |___| \__ \ |_| |_| | | |
+ * |_____|_|___/\__|____/|_|_|
+ *  FIGLET: ListDir
+ */
+
+type listDirResponse struct {
+	Files  []fileAttributesBody `json:"files"`
+	Paging struct {
+		Next string `json:"next"`
+	} `json:"paging"`
+}
+
+// The entries of a page of a directory listing, and the URI of the next page if any.
+func parseListDirResponse(responseData []byte) (entries []FileAttributes, next string, err error) {
+	var response listDirResponse
+	err = json.Unmarshal(responseData, &response)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid directory listing: %v", err)
+	}
+
+	entries = []FileAttributes{}
+	for _, file := range response.Files {
+		var attributes FileAttributes
+		attributes, err = parseFileAttributesBody(file)
+		if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, attributes)
+	}
+
+	return entries, response.Paging.Next, nil
+}
+
+// List up to limit entries of a directory.
+func (self *Connection) ListDir(
+	ctx context.Context,
+	path string,
+	limit int) (entries []FileAttributes,
+	err error,
+) {
+	uri := fmt.Sprintf("/v1/files/%s/entries/?limit=%d", url.QueryEscape(path), limit)
+
+	responseData, err := self.Get(ctx, uri)
 	if err != nil {
 		return
 	}
 
-	attributes = ParseFileAttributes(responseData)
+	entries, _, err = parseListDirResponse(responseData)
+
+	return
+}
+
+// List every entry of a directory, following the paging links.
+func (self *Connection) ListDirAll(
+	ctx context.Context,
+	path string) (entries []FileAttributes,
+	err error,
+) {
+	uri := fmt.Sprintf("/v1/files/%s/entries/?limit=1000", url.QueryEscape(path))
+
+	entries = []FileAttributes{}
+
+	for uri != "" {
+		var responseData []byte
+		responseData, err = self.Get(ctx, uri)
+		if err != nil {
+			return
+		}
+
+		var page []FileAttributes
+		page, uri, err = parseListDirResponse(responseData)
+		if err != nil {
+			return
+		}
+
+		entries = append(entries, page...)
+	}
+
+	return
+}
+
+/*  ____       _      _
+ * |  _ \  ___| | ___| |_ ___
+ * | | | |/ _ \ |/ _ \ __/ _ \
+ * | |_| |  __/ |  __/ ||  __/
+ * |____/ \___|_|\___|\__\___|
+ *  FIGLET: Delete
+ */
+
+// Delete a file or an empty directory.
+func (self *Connection) FileDelete(ctx context.Context, ref string) (err error) {
+	uri := fmt.Sprintf("/v1/files/%s", url.QueryEscape(ref))
+
+	_, err = self.Delete(ctx, uri)
 
 	return
 }
@@ -461,23 +1310,147 @@ type SetattrRequest struct {
 	Mode string `json:"mode,omitempty"`
 }
 
-func (self *Connection) FileChmod(id string, mode string) (attributes FileAttributes, err error) {
+func (self *Connection) FileChmod(
+	ctx context.Context,
+	id string,
+	mode string) (attributes FileAttributes,
+	err error,
+) {
 	uri := fmt.Sprintf("/v1/files/%s/info/attributes", url.QueryEscape(id))
 
 	body := SetattrRequest{Mode: mode}
 	json_data, err := json.Marshal(body)
 	panicOnError(err)
 
-	responseData, err := self.Patch(uri, json_data)
+	responseData, err := self.Patch(ctx, uri, json_data)
 	if err != nil {
 		return
 	}
 
-	attributes = ParseFileAttributes(responseData)
+	attributes, err = ParseFileAttributes(responseData)
+
+	return
+}
+
+/*     _    ____ _
+ *    / \  / ___| |    ___
+ *   / _ \| |   | |   / __|
+ *  / ___ \ |___| |___\__ \
+ * /_/   \_\____|_____|___/
+ *  FIGLET: ACLs
+ */
+
+type FileAce struct {
+	Type  string   `json:"type"`
+	Flags []string `json:"flags"`
+	// Passed through as-is: a trustee has several optional identity fields and the cluster
+	// resolves whichever are given.
+	Trustee json.RawMessage `json:"trustee"`
+	Rights  []string        `json:"rights"`
+}
+
+type FileAcl struct {
+	Control                 []string  `json:"control"`
+	PosixSpecialPermissions []string  `json:"posix_special_permissions"`
+	Aces                    []FileAce `json:"aces"`
+}
+
+func ParseFileAcl(data []byte) (acl FileAcl, err error) {
+	err = json.Unmarshal(data, &acl)
+	return
+}
+
+func (self *Connection) AclGet(ctx context.Context, ref string) (acl FileAcl, err error) {
+	uri := fmt.Sprintf("/v2/files/%s/info/acl", url.QueryEscape(ref))
+
+	responseData, err := self.Get(ctx, uri)
+	if err != nil {
+		return
+	}
+
+	acl, err = ParseFileAcl(responseData)
+
+	return
+}
+
+func (self *Connection) AclSet(ctx context.Context, ref string, acl FileAcl) (err error) {
+	uri := fmt.Sprintf("/v2/files/%s/info/acl", url.QueryEscape(ref))
+
+	json_data, err := json.Marshal(acl)
+	panicOnError(err)
+
+	_, err = self.Put(ctx, uri, json_data)
 
 	return
 }
 
+// Set the ACL unless the directory already has it, so retries don't rewrite it.
+func (self *Connection) EnsureAcl(ctx context.Context, ref string, acl FileAcl) (err error) {
+	current, err := self.AclGet(ctx, ref)
+	if err != nil {
+		return
+	}
+
+	if aclMatches(current, acl) {
+		return
+	}
+
+	return self.AclSet(ctx, ref, acl)
+}
+
+// Whether current, as read from the cluster, is the ACL want sets. The cluster fills in the
+// trustee fields and control flags a request leaves out, so only those want gives are compared.
+func aclMatches(current FileAcl, want FileAcl) bool {
+	if want.Control != nil && !sameStrings(current.Control, want.Control) {
+		return false
+	}
+	if want.PosixSpecialPermissions != nil &&
+		!sameStrings(current.PosixSpecialPermissions, want.PosixSpecialPermissions) {
+		return false
+	}
+	if len(current.Aces) != len(want.Aces) {
+		return false
+	}
+
+	for i, ace := range want.Aces {
+		got := current.Aces[i]
+		if got.Type != ace.Type ||
+			!sameStrings(got.Flags, ace.Flags) ||
+			!sameStrings(got.Rights, ace.Rights) ||
+			!trusteeMatches(got.Trustee, ace.Trustee) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compare as sets, so order and a missing list versus an empty one don't matter.
+func sameStrings(a []string, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	return reflect.DeepEqual(a, b)
+}
+
+// Whether each field want sets, e.g. just the name, has the same value in got.
+func trusteeMatches(got json.RawMessage, want json.RawMessage) bool {
+	var gotFields, wantFields map[string]interface{}
+	if json.Unmarshal(got, &gotFields) != nil || json.Unmarshal(want, &wantFields) != nil {
+		return false
+	}
+
+	for key, value := range wantFields {
+		if value != nil && !reflect.DeepEqual(gotFields[key], value) {
+			return false
+		}
+	}
+
+	return true
+}
+
 /*  _____              ____       _      _        ____                _
  * |_   _| __ ___  ___|  _ \  ___| | ___| |_ ___ / ___|_ __ ___  __ _| |_ ___
  *   | || '__/ _ \/ _ \ | | |/ _ \ |/ _ \ __/ _ \ |   | '__/ _ \/ _` | __/ _ \
@@ -490,8 +1463,8 @@ type TreeDeleteCreateRequest struct {
 	Id string `json:"id"`
 }
 
-func (self *Connection) TreeDeleteCreate(path string) (err error) {
-	attributes, err := self.LookUp(path)
+func (self *Connection) TreeDeleteCreate(ctx context.Context, path string) (err error) {
+	attributes, err := self.LookUp(ctx, path)
 	if errorIsRestErrorWithStatus(err, 404) {
 		err = nil
 		return
@@ -500,6 +1473,16 @@ func (self *Connection) TreeDeleteCreate(path string) (err error) {
 		return
 	}
 
+	// A job may already be running on the id from an earlier attempt.
+	_, err = self.Get(ctx, fmt.Sprintf("/v1/tree-delete/jobs/%s", url.QueryEscape(attributes.Id)))
+	if err == nil {
+		treeDeleteJobs.WithLabelValues(self.Host, "running").Inc()
+		return
+	}
+	if !errorIsRestErrorWithStatus(err, 404) {
+		return
+	}
+
 	uri := "/v1/tree-delete/jobs/"
 
 	body := TreeDeleteCreateRequest{Id: attributes.Id}
@@ -507,16 +1490,305 @@ func (self *Connection) TreeDeleteCreate(path string) (err error) {
 	json_data, err := json.Marshal(body)
 	panicOnError(err)
 
-	_, err = self.Post(uri, json_data)
+	_, err = self.Post(ctx, uri, json_data)
 	if errorIsRestErrorWithStatus(err, 404) {
 		// something else deleted it.
 		err = nil
+	} else if err == nil {
+		treeDeleteJobs.WithLabelValues(self.Host, "created").Inc()
+	}
+
+	return err
+}
+
+/*                            _           _                 _ _      _
+ *  ___ _ __   __ _ _ __  ___| |__   ___ | |_   _ __   ___ | (_) ___(_) ___  ___
+ * / __| '_ \ / _` | '_ \/ __| '_ \ / _ \| __| | '_ \ / _ \| | |/ __| |/ _ \/ __|
+ * \__ \ | | | (_| | |_) \__ \ | | | (_) | |_  | |_) | (_) | | | (__| |  __/\__ \
+ * |___/_| |_|\__,_| .__/|___/_| |_|\___/ \__| | .__/ \___/|_|_|\___|_|\___||___/
+ *                 |_|                         |_|
+ *  FIGLET: snapshot policies
+ */
+
+type SnapshotPolicy struct {
+	Id            int      `json:"id"`
+	Name          string   `json:"name"`
+	SourceFileIds []string `json:"source_file_ids"`
+}
+
+type snapshotPolicySourcesRequest struct {
+	SourceFileIds []string `json:"source_file_ids"`
+}
+
+func (self *Connection) SnapshotPolicyGet(
+	ctx context.Context,
+	id string) (policy SnapshotPolicy,
+	etag string,
+	err error,
+) {
+	uri := fmt.Sprintf("/v1/snapshots/policies/%s", url.QueryEscape(id))
+
+	responseData, headers, err := self.DoWithHeaders(ctx, "GET", uri, []byte{}, nil)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(responseData, &policy)
+	etag = headers.Get("ETag")
+
+	return
+}
+
+func (self *Connection) SnapshotPolicyModifySources(
+	ctx context.Context,
+	id string,
+	sourceFileIds []string,
+	etag string,
+) (err error) {
+	uri := fmt.Sprintf("/v1/snapshots/policies/%s", url.QueryEscape(id))
+
+	body := snapshotPolicySourcesRequest{SourceFileIds: sourceFileIds}
+	json_data, err := json.Marshal(body)
+	panicOnError(err)
+
+	headers := http.Header{}
+	if etag != "" {
+		headers.Set("If-Match", etag)
+	}
+
+	_, _, err = self.DoWithHeaders(ctx, "PATCH", uri, json_data, headers)
+
+	return
+}
+
+// Read-modify-write the source directories of a policy, retrying if the policy was changed
+// concurrently. The modify func returns false if no change is required.
+func (self *Connection) snapshotPolicyUpdateSources(
+	ctx context.Context,
+	id string,
+	modify func(sourceFileIds []string) ([]string, bool),
+) (err error) {
+	return conditionalUpdate("Snapshot policy", id, func() error {
+		policy, etag, err := self.SnapshotPolicyGet(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		sourceFileIds, changed := modify(policy.SourceFileIds)
+		if !changed {
+			return nil
+		}
+
+		return self.SnapshotPolicyModifySources(ctx, id, sourceFileIds, etag)
+	})
+}
+
+// Add a directory to the policy, or, if it is already covered, succeed.
+func (self *Connection) SnapshotPolicyAddSource(
+	ctx context.Context,
+	id string,
+	fileId string,
+) error {
+	return self.snapshotPolicyUpdateSources(ctx, id, func(sourceFileIds []string) ([]string, bool) {
+		for _, sourceFileId := range sourceFileIds {
+			if sourceFileId == fileId {
+				return sourceFileIds, false
+			}
+		}
+		return append(sourceFileIds, fileId), true
+	})
+}
+
+// Remove a directory from the policy, or, if it isn't covered or the policy is gone, succeed.
+func (self *Connection) SnapshotPolicyRemoveSource(
+	ctx context.Context,
+	id string,
+	fileId string,
+) error {
+	err := self.snapshotPolicyUpdateSources(ctx, id, func(sourceFileIds []string) ([]string, bool) {
+		remaining := []string{}
+		for _, sourceFileId := range sourceFileIds {
+			if sourceFileId != fileId {
+				remaining = append(remaining, sourceFileId)
+			}
+		}
+		return remaining, len(remaining) != len(sourceFileIds)
+	})
+	if errorIsRestErrorWithStatus(err, 404) {
+		err = nil
 	}
-	// XXX: it's possible that another tree delete is running on the id, handle that error
 
 	return err
 }
 
+/*                 _ _           _   _
+ *  _ __ ___ _ __ | (_) ___ __ _| |_(_) ___  _ __
+ * | '__/ _ \ '_ \| | |/ __/ _` | __| |/ _ \| '_ \
+ * | | |  __/ |_) | | | (_| (_| | |_| | (_) | | | |
+ * |_|  \___| .__/|_|_|\___\__,_|\__|_|\___/|_| |_|
+ *          |_|
+ *  FIGLET: replication
+ */
+
+type ReplicationSourceRelationship struct {
+	Id             string `json:"id"`
+	TargetAddress  string `json:"target_address"`
+	TargetPort     int    `json:"target_port"`
+	SourceRootId   string `json:"source_root_id"`
+	TargetRootPath string `json:"target_root_path"`
+}
+
+type replicationSourceCreateRequest struct {
+	TargetAddress  string `json:"target_address"`
+	TargetPort     int    `json:"target_port"`
+	SourceRootId   string `json:"source_root_id"`
+	TargetRootPath string `json:"target_root_path"`
+}
+
+type ReplicationTargetStatus struct {
+	Id               string `json:"id"`
+	State            string `json:"state"`
+	EndReason        string `json:"end_reason"`
+	SourceAddress    string `json:"source_address"`
+	TargetRootPath   string `json:"target_root_path"`
+	ErrorFromLastJob string `json:"error_from_last_job"`
+}
+
+type replicationAuthorizeRequest struct {
+	AllowNonEmptyDirectory bool `json:"allow_non_empty_directory"`
+	AllowFsPathCreate      bool `json:"allow_fs_path_create"`
+}
+
+// Default port replication traffic is sent to on the target cluster.
+const ReplicationDefaultPort = 3712
+
+func (self *Connection) ReplicationSourceList(
+	ctx context.Context) (relationships []ReplicationSourceRelationship,
+	err error,
+) {
+	uri := "/v2/replication/source-relationships/"
+
+	responseData, err := self.Get(ctx, uri)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(responseData, &relationships)
+
+	return
+}
+
+func (self *Connection) ReplicationSourceCreate(
+	ctx context.Context,
+	targetAddress string,
+	sourceRootId string,
+	targetRootPath string,
+) (relationship ReplicationSourceRelationship, err error) {
+	uri := "/v2/replication/source-relationships/"
+
+	body := replicationSourceCreateRequest{
+		TargetAddress:  targetAddress,
+		TargetPort:     ReplicationDefaultPort,
+		SourceRootId:   sourceRootId,
+		TargetRootPath: targetRootPath,
+	}
+
+	json_data, err := json.Marshal(body)
+	panicOnError(err)
+
+	responseData, err := self.Post(ctx, uri, json_data)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(responseData, &relationship)
+
+	return
+}
+
+// Find the relationship replicating sourceRootId, or create it if there isn't one.
+func (self *Connection) ReplicationSourceEnsure(
+	ctx context.Context,
+	targetAddress string,
+	sourceRootId string,
+	targetRootPath string,
+) (relationship ReplicationSourceRelationship, err error) {
+	relationships, err := self.ReplicationSourceList(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, r := range relationships {
+		if r.SourceRootId == sourceRootId {
+			relationship = r
+			return
+		}
+	}
+
+	return self.ReplicationSourceCreate(ctx, targetAddress, sourceRootId, targetRootPath)
+}
+
+// Delete all relationships replicating sourceRootId. Replicated data on the target is untouched.
+func (self *Connection) ReplicationSourceDeleteForRoot(
+	ctx context.Context,
+	sourceRootId string) (err error,
+) {
+	relationships, err := self.ReplicationSourceList(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, r := range relationships {
+		if r.SourceRootId != sourceRootId {
+			continue
+		}
+
+		uri := fmt.Sprintf("/v2/replication/source-relationships/%s", url.QueryEscape(r.Id))
+		_, err = self.Delete(ctx, uri)
+		if errorIsRestErrorWithStatus(err, 404) {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (self *Connection) ReplicationTargetStatusList(
+	ctx context.Context) (statuses []ReplicationTargetStatus,
+	err error,
+) {
+	uri := "/v2/replication/target-relationships/status/"
+
+	responseData, err := self.Get(ctx, uri)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(responseData, &statuses)
+
+	return
+}
+
+// Authorize a relationship on the target cluster, creating the target directory as needed.
+func (self *Connection) ReplicationTargetAuthorize(ctx context.Context, id string) (err error) {
+	uri := fmt.Sprintf(
+		"/v2/replication/target-relationships/%s/authorize",
+		url.QueryEscape(id),
+	)
+
+	body := replicationAuthorizeRequest{AllowNonEmptyDirectory: false, AllowFsPathCreate: true}
+
+	json_data, err := json.Marshal(body)
+	panicOnError(err)
+
+	_, err = self.Post(ctx, uri, json_data)
+
+	return
+}
+
 /*                     _
  * __   _____ _ __ ___(_) ___  _ __
  * \ \ / / _ \ '__/ __| |/ _ \| '_ \
@@ -542,15 +1814,18 @@ func (v *QumuloVersionInfo) GetSemanticVersion() (version semver.Version, err er
 	return
 }
 
-func (self *Connection) GetVersionInfo() (versionInfo QumuloVersionInfo, err error) {
+func (self *Connection) GetVersionInfo(
+	ctx context.Context) (versionInfo QumuloVersionInfo,
+	err error,
+) {
 	uri := "/v1/version"
 
-	responseData, err := self.Get(uri)
+	responseData, err := self.Get(ctx, uri)
 	if err != nil {
 		return
 	}
 
-	json.Unmarshal(responseData, &versionInfo)
+	err = json.Unmarshal(responseData, &versionInfo)
 
 	return
 }
@@ -564,60 +1839,189 @@ func (self *Connection) GetVersionInfo() (versionInfo QumuloVersionInfo, err err
  *  FIGLET: exports
  */
 
-type ExportResponse struct {
-	Id         string `json:"id"`
-	ExportPath string `json:"export_path"`
-	FsPath     string `json:"fs_path"`
+type NfsExport struct {
+	Id          string `json:"id,omitempty"`
+	ExportPath  string `json:"export_path"`
+	FsPath      string `json:"fs_path"`
+	Description string `json:"description"`
+
+	// Zero when the cluster doesn't support tenants. Creating with zero uses the default tenant.
+	TenantId int `json:"tenant_id,omitempty"`
+
+	// Each client is given the first restriction whose hosts include it.
+	Restrictions []NfsExportRestriction `json:"restrictions"`
+
+	// Fields such as "FILE_IDS" or "FILE_SIZES" truncated to 32 bits for old clients.
+	FieldsToPresentAs32Bit []string `json:"fields_to_present_as_32_bit,omitempty"`
+}
+
+type NfsExportRestriction struct {
+	// Addresses, ranges or CIDR networks, or every host when empty.
+	HostRestrictions      []string `json:"host_restrictions"`
+	ReadOnly              bool     `json:"read_only"`
+	RequirePrivilegedPort bool     `json:"require_privileged_port"`
+
+	// NFS_MAP_NONE, or NFS_MAP_ROOT or NFS_MAP_ALL to squash root or every user to MapToUser.
+	UserMapping string          `json:"user_mapping"`
+	MapToUser   NfsExportUserId `json:"map_to_user"`
+
+	// The group squashed users get, or their user's primary group when nil.
+	MapToGroup *NfsExportUserId `json:"map_to_group,omitempty"`
+}
+
+// An identity such as {"LOCAL_USER", "guest"} or {"NFS_UID", "65534"}.
+type NfsExportUserId struct {
+	IdType  string `json:"id_type"`
+	IdValue string `json:"id_value"`
 }
 
-func (self *Connection) ExportGet(id string) (export ExportResponse, err error) {
+// Read-write for every host, without user mapping, which is what volumes need.
+func DefaultNfsExportRestrictions() []NfsExportRestriction {
+	return []NfsExportRestriction{
+		{
+			HostRestrictions: []string{},
+			UserMapping:      "NFS_MAP_NONE",
+			MapToUser:        NfsExportUserId{IdType: "LOCAL_USER", IdValue: "0"},
+		},
+	}
+}
+
+func parseExport(responseData []byte) (export NfsExport, err error) {
+	err = json.Unmarshal(responseData, &export)
+	if err != nil {
+		err = fmt.Errorf("Invalid NFS export: %v", err)
+	}
+
+	return
+}
+
+func (self *Connection) ExportList(ctx context.Context) (exports []NfsExport, err error) {
+	uri := "/v2/nfs/exports/"
+
+	responseData, err := self.Get(ctx, uri)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(responseData, &exports)
+	if err != nil {
+		err = fmt.Errorf("Invalid NFS export list: %v", err)
+	}
+
+	return
+}
+
+// Get an export by id or by export path, and the ETag of this version of it.
+func (self *Connection) ExportGet(
+	ctx context.Context,
+	id string) (export NfsExport,
+	etag string,
+	err error,
+) {
 	uri := fmt.Sprintf("/v2/nfs/exports/%s", url.QueryEscape(id))
 
-	responseData, err := self.Get(uri)
+	responseData, headers, err := self.DoWithHeaders(ctx, "GET", uri, []byte{}, nil)
 	if err != nil {
 		return
 	}
 
-	json.Unmarshal(responseData, &export)
+	export, err = parseExport(responseData)
+	etag = headers.Get("ETag")
 
 	return
 }
 
+// Create an export of an existing directory. An export without restrictions is given
+// DefaultNfsExportRestrictions.
 func (self *Connection) ExportCreate(
-	exportPath string,
-	fsPath string,
-) (export ExportResponse, err error) {
-	// N.B. this isn't full feature, just used for tests
-
+	ctx context.Context,
+	export NfsExport,
+) (created NfsExport, err error) {
 	uri := "/v2/nfs/exports/"
 
-	json_data := fmt.Sprintf(
-		"{\"export_path\": %q, \"fs_path\": %q, \"description\": \"\", "+
-			"\"restrictions\": [{"+
-			"\"read_only\": false, "+
-			"\"require_privileged_port\": false, "+
-			"\"host_restrictions\": [], "+
-			"\"user_mapping\": \"NFS_MAP_NONE\", "+
-			"\"map_to_user\": {\"id_type\": \"LOCAL_USER\", \"id_value\": \"0\"}}]"+
-			"}",
-		exportPath,
-		fsPath,
-	)
+	if len(export.Restrictions) == 0 {
+		export.Restrictions = DefaultNfsExportRestrictions()
+	}
+
+	json_data, err := json.Marshal(export)
+	panicOnError(err)
+
+	responseData, err := self.Post(ctx, uri, json_data)
+	if err != nil {
+		return
+	}
+
+	return parseExport(responseData)
+}
+
+// Replace an export by id or by export path. With an etag from ExportGet this fails with 412
+// if the export has changed since. Returns the export as modified and its new ETag.
+func (self *Connection) ExportModify(
+	ctx context.Context,
+	id string,
+	export NfsExport,
+	etag string,
+) (modified NfsExport, newEtag string, err error) {
+	uri := fmt.Sprintf("/v2/nfs/exports/%s", url.QueryEscape(id))
 
-	responseData, err := self.Post(uri, []byte(json_data))
+	json_data, err := json.Marshal(export)
+	panicOnError(err)
+
+	headers := http.Header{}
+	if etag != "" {
+		headers.Set("If-Match", etag)
+	}
+
+	responseData, responseHeaders, err := self.DoWithHeaders(ctx, "PUT", uri, json_data, headers)
 	if err != nil {
 		return
 	}
 
-	json.Unmarshal(responseData, &export)
+	modified, err = parseExport(responseData)
+	newEtag = responseHeaders.Get("ETag")
 
 	return
 }
 
-func (self *Connection) ExportDelete(id string) (err error) {
+// Read-modify-write an export, retrying if it was changed concurrently. The modify func
+// returns false if no change is required.
+func (self *Connection) ExportUpdate(
+	ctx context.Context,
+	id string,
+	modify func(export *NfsExport) bool,
+) (export NfsExport, err error) {
+	err = conditionalUpdate("NFS export", id, func() error {
+		current, etag, err := self.ExportGet(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if !modify(&current) {
+			export = current
+			return nil
+		}
+
+		export, _, err = self.ExportModify(ctx, id, current, etag)
+		return err
+	})
+	if err != nil {
+		return NfsExport{}, err
+	}
+
+	return export, nil
+}
+
+// Delete an export by id or by export path. With an etag from ExportGet this fails with 412 if
+// the export has changed since.
+func (self *Connection) ExportDelete(ctx context.Context, id string, etag string) (err error) {
 	uri := fmt.Sprintf("/v2/nfs/exports/%s", url.QueryEscape(id))
 
-	_, err = self.Delete(uri)
+	headers := http.Header{}
+	if etag != "" {
+		headers.Set("If-Match", etag)
+	}
+
+	_, _, err = self.DoWithHeaders(ctx, "DELETE", uri, []byte{}, headers)
 
 	return
 }
@@ -0,0 +1,96 @@
+//go:build go1.18
+// +build go1.18
+
+package qumulo
+
+import (
+	"testing"
+)
+
+// See docs/csi-dev.md for how to run these. Without -fuzz only the seeds run.
+
+func FuzzParseFileAttributes(f *testing.F) {
+	f.Add([]byte(`{"id": "9", "type": "FS_FILE_TYPE_DIRECTORY", "mode": "0777", "name": "vol1"}`))
+	f.Add([]byte(`{
+		"id": "9",
+		"type": "FS_FILE_TYPE_FILE",
+		"mode": "0644",
+		"path": "/a/vol1",
+		"size": "4096",
+		"owner": "500",
+		"group": "513",
+		"num_links": 1,
+		"child_count": 0,
+		"creation_time": "2021-06-01T12:00:00.123456789Z",
+		"modification_time": "2021-06-02T12:00:00Z",
+		"change_time": "2021-06-03T12:00:00Z"
+	}`))
+	f.Add([]byte(`{"id": 9}`))
+	f.Add([]byte(`<html>Bad Gateway</html>`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		attributes, err := ParseFileAttributes(data)
+		if err != nil {
+			return
+		}
+		if attributes.Id == "" || attributes.Type == "" || attributes.Mode == "" {
+			t.Fatalf("parsed attributes without id, type or mode: %+v", attributes)
+		}
+	})
+}
+
+func FuzzParseListDirResponse(f *testing.F) {
+	f.Add([]byte(`{"files": [{"id": "9", "type": "FS_FILE_TYPE_DIRECTORY", "mode": "0777"}], ` +
+		`"paging": {"next": ""}}`))
+	f.Add([]byte(`{"files": [], "paging": {"next": "/v1/files/2/entries/?after=x"}}`))
+	f.Add([]byte(`{"files": [{"id": "9"}]}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, _, err := parseListDirResponse(data)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if entry.Id == "" || entry.Type == "" || entry.Mode == "" {
+				t.Fatalf("parsed entry without id, type or mode: %+v", entry)
+			}
+		}
+	})
+}
+
+func FuzzParseFileAcl(f *testing.F) {
+	f.Add([]byte(`{
+		"control": ["PRESENT"],
+		"posix_special_permissions": [],
+		"aces": [{
+			"type": "ALLOWED",
+			"flags": ["OBJECT_INHERIT", "CONTAINER_INHERIT"],
+			"trustee": {"domain": "WORLD", "auth_id": "8589934592"},
+			"rights": ["READ", "MODIFY"]
+		}]
+	}`))
+	f.Add([]byte(`{"aces": {}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ParseFileAcl(data)
+	})
+}
+
+func FuzzMakeRestError(f *testing.F) {
+	f.Add(404, []byte(`{
+		"module": "qfsd",
+		"error_class": "fs_no_such_entry_error",
+		"description": "fs_no_such_entry_error",
+		"stack": ["one", "two"],
+		"user_visible": true
+	}`))
+	f.Add(502, []byte(`<html>Bad Gateway</html>`))
+
+	f.Fuzz(func(t *testing.T, statusCode int, data []byte) {
+		restError := MakeRestError(statusCode, data)
+		if restError.StatusCode != statusCode {
+			t.Fatalf("status %d became %d", statusCode, restError.StatusCode)
+		}
+		_ = restError.Error()
+	})
+}
@@ -1,6 +1,8 @@
 package qumulo
 
 import (
+	"context"
+	"path/filepath"
 	"testing"
 
 	"github.com/blang/semver"
@@ -16,10 +18,10 @@ import (
  */
 
 func TestRestCreateDir(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	attributes, err := testConnection.CreateDir(testDirPath, "bar")
+	attributes, err := testConnection.CreateDir(context.TODO(), testDirPath, "bar")
 	assert.NoError(t, err)
 	if attributes.Type != "FS_FILE_TYPE_DIRECTORY" {
 		t.Fatalf("unexpected attributes %v", attributes)
@@ -27,21 +29,21 @@ func TestRestCreateDir(t *testing.T) {
 }
 
 func TestRestCreateDirTwiceErrors(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	_, err := testConnection.CreateDir(testDirPath, "bar")
+	_, err := testConnection.CreateDir(context.TODO(), testDirPath, "bar")
 	assert.NoError(t, err)
 
-	_, err = testConnection.CreateDir(testDirPath, "bar")
+	_, err = testConnection.CreateDir(context.TODO(), testDirPath, "bar")
 	assertRestError(t, err, 409, "fs_entry_exists_error")
 }
 
 func TestRestEnsureDirNewDir(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	attributes, err := testConnection.EnsureDir(testDirPath, "somedir")
+	attributes, err := testConnection.EnsureDir(context.TODO(), testDirPath, "somedir")
 	assert.NoError(t, err)
 	if attributes.Type != "FS_FILE_TYPE_DIRECTORY" {
 		t.Fatalf("unexpected attributes %v", attributes)
@@ -49,13 +51,13 @@ func TestRestEnsureDirNewDir(t *testing.T) {
 }
 
 func TestRestEnsureDirAfterCreateDir(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	attributes1, err := testConnection.EnsureDir(testDirPath, "somedir")
+	attributes1, err := testConnection.EnsureDir(context.TODO(), testDirPath, "somedir")
 	assert.NoError(t, err)
 
-	attributes2, err := testConnection.EnsureDir(testDirPath, "blah")
+	attributes2, err := testConnection.EnsureDir(context.TODO(), testDirPath, "blah")
 	assert.NoError(t, err)
 
 	if attributes1 != attributes1 {
@@ -64,13 +66,13 @@ func TestRestEnsureDirAfterCreateDir(t *testing.T) {
 }
 
 func TestRestEnsureDirTwice(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	attributes1, err := testConnection.EnsureDir(testDirPath, "blah")
+	attributes1, err := testConnection.EnsureDir(context.TODO(), testDirPath, "blah")
 	assert.NoError(t, err)
 
-	attributes2, err := testConnection.EnsureDir(testDirPath, "blah")
+	attributes2, err := testConnection.EnsureDir(context.TODO(), testDirPath, "blah")
 	assert.NoError(t, err)
 
 	if attributes1 != attributes1 {
@@ -79,10 +81,10 @@ func TestRestEnsureDirTwice(t *testing.T) {
 }
 
 func TestRestCreateFile(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	attributes, err := testConnection.CreateFile(testDirPath, "notadir")
+	attributes, err := testConnection.CreateFile(context.TODO(), testDirPath, "notadir")
 	assert.NoError(t, err)
 	if attributes.Type != "FS_FILE_TYPE_FILE" {
 		t.Fatalf("unexpected attributes %v", attributes)
@@ -90,105 +92,105 @@ func TestRestCreateFile(t *testing.T) {
 }
 
 func TestRestEnsureDirWithFileConflict(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	_, err := testConnection.CreateFile(testDirPath, "x")
+	_, err := testConnection.CreateFile(context.TODO(), testDirPath, "x")
 	assert.NoError(t, err)
 
-	_, err = testConnection.EnsureDir(testDirPath, "x")
+	_, err = testConnection.EnsureDir(context.TODO(), testDirPath, "x")
 	assertRestError(t, err, 409, "fs_entry_exists_error")
 }
 
 func TestRestCreateQuota(t *testing.T) {
-	_, testDirId, cleanup := requireCluster(t)
+	_, testDirId, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
 	newLimit := uint64(1024 * 1024 * 1024)
-	err := testConnection.CreateQuota(testDirId, newLimit)
+	err := testConnection.CreateQuota(context.TODO(), testDirId, newLimit)
 	assert.NoError(t, err)
 
-	limit, err := testConnection.GetQuota(testDirId)
+	limit, err := testConnection.GetQuota(context.TODO(), testDirId)
 	assert.NoError(t, err)
 	assert.Equal(t, limit, newLimit)
 }
 
 func TestRestCreateQuotaTwiceErrors(t *testing.T) {
-	_, testDirId, cleanup := requireCluster(t)
+	_, testDirId, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	err := testConnection.CreateQuota(testDirId, 1024*1024*1024)
+	err := testConnection.CreateQuota(context.TODO(), testDirId, 1024*1024*1024)
 	assert.NoError(t, err)
 
-	err = testConnection.CreateQuota(testDirId, 1024*1024*1024)
+	err = testConnection.CreateQuota(context.TODO(), testDirId, 1024*1024*1024)
 	assertRestError(t, err, 409, "api_quotas_quota_limit_already_set_error")
 }
 
 func TestRestUpdateQuotaNoQuotaErrors(t *testing.T) {
-	_, testDirId, cleanup := requireCluster(t)
+	_, testDirId, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	err := testConnection.UpdateQuota(testDirId, 1024*1024*1024)
+	err := testConnection.UpdateQuota(context.TODO(), testDirId, 1024*1024*1024)
 	assertRestError(t, err, 404, "api_quotas_quota_limit_not_found_error")
 }
 
 func TestRestUpdateQuotaAfterCreateQuota(t *testing.T) {
-	_, testDirId, cleanup := requireCluster(t)
+	_, testDirId, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
 	newLimit := uint64(1024 * 1024 * 1024)
-	err := testConnection.CreateQuota(testDirId, newLimit)
+	err := testConnection.CreateQuota(context.TODO(), testDirId, newLimit)
 	assert.NoError(t, err)
 
-	err = testConnection.UpdateQuota(testDirId, newLimit)
+	err = testConnection.UpdateQuota(context.TODO(), testDirId, newLimit)
 	assert.NoError(t, err)
 
-	limit, err := testConnection.GetQuota(testDirId)
+	limit, err := testConnection.GetQuota(context.TODO(), testDirId)
 	assert.NoError(t, err)
 	assert.Equal(t, limit, newLimit)
 }
 
 func TestRestEnsureQuotaNewQuota(t *testing.T) {
-	_, testDirId, cleanup := requireCluster(t)
+	_, testDirId, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
 	newLimit := uint64(1024 * 1024 * 1024)
-	err := testConnection.EnsureQuota(testDirId, newLimit)
+	err := testConnection.EnsureQuota(context.TODO(), testDirId, newLimit)
 	assert.NoError(t, err)
 
-	limit, err := testConnection.GetQuota(testDirId)
+	limit, err := testConnection.GetQuota(context.TODO(), testDirId)
 	assert.NoError(t, err)
 	assert.Equal(t, limit, newLimit)
 }
 
 func TestRestEnsureQuotaAfterCreateQuota(t *testing.T) {
-	_, testDirId, cleanup := requireCluster(t)
+	_, testDirId, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	err := testConnection.CreateQuota(testDirId, 1024*1024*1024)
+	err := testConnection.CreateQuota(context.TODO(), testDirId, 1024*1024*1024)
 	assert.NoError(t, err)
 
 	newLimit := uint64(2 * 1024 * 1024 * 1024)
-	err = testConnection.EnsureQuota(testDirId, newLimit)
+	err = testConnection.EnsureQuota(context.TODO(), testDirId, newLimit)
 	assert.NoError(t, err)
 
-	limit, err := testConnection.GetQuota(testDirId)
+	limit, err := testConnection.GetQuota(context.TODO(), testDirId)
 	assert.NoError(t, err)
 	assert.Equal(t, limit, newLimit)
 }
 
 func TestRestEnsureQuotaTwice(t *testing.T) {
-	_, testDirId, cleanup := requireCluster(t)
+	_, testDirId, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
 	newLimit := uint64(2 * 1024 * 1024 * 1024)
-	err := testConnection.EnsureQuota(testDirId, newLimit)
+	err := testConnection.EnsureQuota(context.TODO(), testDirId, newLimit)
 	assert.NoError(t, err)
 
-	err = testConnection.EnsureQuota(testDirId, newLimit)
+	err = testConnection.EnsureQuota(context.TODO(), testDirId, newLimit)
 	assert.NoError(t, err)
 
-	limit, err := testConnection.GetQuota(testDirId)
+	limit, err := testConnection.GetQuota(context.TODO(), testDirId)
 	assert.NoError(t, err)
 	assert.Equal(t, limit, newLimit)
 }
@@ -196,18 +198,18 @@ func TestRestEnsureQuotaTwice(t *testing.T) {
 // XXX quota file conflicts? - probably not really possible
 
 func TestRestTreeDeleteNotFoundPath(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	err := testConnection.TreeDeleteCreate(testDirPath + "/blah")
+	err := testConnection.TreeDeleteCreate(context.TODO(), testDirPath+"/blah")
 	assert.NoError(t, err)
 }
 
 func TestRestVersion(t *testing.T) {
-	_, _, cleanup := requireCluster(t)
+	_, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	info, err := testConnection.GetVersionInfo()
+	info, err := testConnection.GetVersionInfo(context.TODO())
 	assert.NoError(t, err)
 
 	version, err := info.GetSemanticVersion()
@@ -219,89 +221,267 @@ func TestRestVersion(t *testing.T) {
 }
 
 func TestRestChmodNotFound(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
 	path := testDirPath + "/foo"
 
-	_, err := testConnection.FileChmod(path, "0555")
+	_, err := testConnection.FileChmod(context.TODO(), path, "0555")
 	assertRestError(t, err, 404, "fs_no_such_entry_error")
 }
 
 func TestRestChmodByPath(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	attributes, err := testConnection.FileChmod(testDirPath, "0555")
+	attributes, err := testConnection.FileChmod(context.TODO(), testDirPath, "0555")
 	assert.NoError(t, err)
 	assert.Equal(t, attributes.Mode, "0555")
 
-	attributes, err = testConnection.FileChmod(testDirPath, "0777")
+	attributes, err = testConnection.FileChmod(context.TODO(), testDirPath, "0777")
 	assert.NoError(t, err)
 	assert.Equal(t, attributes.Mode, "0777")
 }
 
 func TestRestChmodById(t *testing.T) {
-	_, testDirId, cleanup := requireCluster(t)
+	_, testDirId, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	attributes, err := testConnection.FileChmod(testDirId, "0555")
+	attributes, err := testConnection.FileChmod(context.TODO(), testDirId, "0555")
 	assert.NoError(t, err)
 	assert.Equal(t, attributes.Mode, "0555")
 
-	attributes, err = testConnection.FileChmod(testDirId, "0777")
+	attributes, err = testConnection.FileChmod(context.TODO(), testDirId, "0777")
 	assert.NoError(t, err)
 	assert.Equal(t, attributes.Mode, "0777")
 }
 
 func TestRestGetExportNotFoundPath(t *testing.T) {
-	_, _, cleanup := requireCluster(t)
+	_, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	_, err := testConnection.ExportGet("/blahhhhhhh")
+	_, _, err := testConnection.ExportGet(context.TODO(), "/blahhhhhhh")
 	assertRestError(t, err, 404, "nfs_export_doesnt_exist_error")
 }
 
 func TestRestGetExportNotFoundId(t *testing.T) {
-	_, _, cleanup := requireCluster(t)
+	_, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	_, err := testConnection.ExportGet("999999")
+	_, _, err := testConnection.ExportGet(context.TODO(), "999999")
 	assertRestError(t, err, 404, "nfs_export_doesnt_exist_error")
 }
 
 func TestRestGetExportDefaultPath(t *testing.T) {
-	_, _, cleanup := requireCluster(t)
+	_, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	export, err := testConnection.ExportGet("/")
+	export, etag, err := testConnection.ExportGet(context.TODO(), "/")
 	assert.NoError(t, err)
-	assert.Equal(t, export, ExportResponse{"1", "/", "/"})
+	assert.Equal(t, export.Id, "1")
+	assert.Equal(t, export.ExportPath, "/")
+	assert.Equal(t, export.FsPath, "/")
+	assert.NotEmpty(t, export.Restrictions)
+	assert.NotEmpty(t, etag)
 }
 
 func TestRestGetExportDefaultId(t *testing.T) {
-	_, _, cleanup := requireCluster(t)
+	_, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
-	export, err := testConnection.ExportGet("1")
+	export, etag, err := testConnection.ExportGet(context.TODO(), "1")
 	assert.NoError(t, err)
-	assert.Equal(t, export, ExportResponse{"1", "/", "/"})
+	assert.Equal(t, export.Id, "1")
+	assert.Equal(t, export.ExportPath, "/")
+	assert.Equal(t, export.FsPath, "/")
+	assert.NotEmpty(t, export.Restrictions)
+	assert.NotEmpty(t, etag)
 }
 
 func TestRestCreateDeleteExport(t *testing.T) {
-	testDirPath, _, cleanup := requireCluster(t)
+	testDirPath, _, cleanup := requireRecordedCluster(t)
 	defer cleanup(t)
 
 	exportPath := "/some/export"
 
-	export, err := testConnection.ExportCreate(exportPath, testDirPath)
+	export, err := testConnection.ExportCreate(
+		context.TODO(),
+		NfsExport{ExportPath: exportPath, FsPath: testDirPath},
+	)
 	assert.NoError(t, err)
 	assert.Equal(t, export.ExportPath, exportPath)
 	assert.Equal(t, export.FsPath, testDirPath)
 
-	err = testConnection.ExportDelete(export.ExportPath)
+	err = testConnection.ExportDelete(context.TODO(), export.ExportPath, "")
 	assert.NoError(t, err)
 
-	_, err = testConnection.ExportGet(export.ExportPath)
+	_, _, err = testConnection.ExportGet(context.TODO(), export.ExportPath)
 	assertRestError(t, err, 404, "nfs_export_doesnt_exist_error")
 }
+
+func TestRestListExports(t *testing.T) {
+	testDirPath, _, cleanup := requireRecordedCluster(t)
+	defer cleanup(t)
+
+	exportPath := "/some/export"
+
+	created, err := testConnection.ExportCreate(
+		context.TODO(),
+		NfsExport{ExportPath: exportPath, FsPath: testDirPath},
+	)
+	assert.NoError(t, err)
+	defer testConnection.ExportDelete(context.TODO(), created.Id, "")
+
+	exports, err := testConnection.ExportList(context.TODO())
+	assert.NoError(t, err)
+
+	found := map[string]NfsExport{}
+	for _, export := range exports {
+		found[export.ExportPath] = export
+	}
+	assert.Equal(t, found["/"].Id, "1")
+	assert.Equal(t, found[exportPath].Id, created.Id)
+	assert.Equal(t, found[exportPath].Restrictions, DefaultNfsExportRestrictions())
+}
+
+func TestRestModifyExport(t *testing.T) {
+	testDirPath, _, cleanup := requireRecordedCluster(t)
+	defer cleanup(t)
+
+	restrictions := []NfsExportRestriction{
+		{
+			HostRestrictions: []string{"10.0.0.0/8"},
+			ReadOnly:         true,
+			UserMapping:      "NFS_MAP_ALL",
+			MapToUser:        NfsExportUserId{IdType: "NFS_UID", IdValue: "65534"},
+			MapToGroup:       &NfsExportUserId{IdType: "NFS_GID", IdValue: "65534"},
+		},
+		{
+			HostRestrictions:      []string{},
+			RequirePrivilegedPort: true,
+			UserMapping:           "NFS_MAP_ROOT",
+			MapToUser:             NfsExportUserId{IdType: "NFS_UID", IdValue: "65534"},
+		},
+	}
+
+	created, err := testConnection.ExportCreate(
+		context.TODO(),
+		NfsExport{
+			ExportPath:   "/some/export",
+			FsPath:       testDirPath,
+			Description:  "modify test",
+			Restrictions: restrictions,
+		},
+	)
+	assert.NoError(t, err)
+	defer testConnection.ExportDelete(context.TODO(), created.Id, "")
+	assert.Equal(t, created.Description, "modify test")
+	assert.Equal(t, created.Restrictions, restrictions)
+
+	export, etag, err := testConnection.ExportGet(context.TODO(), created.Id)
+	assert.NoError(t, err)
+
+	export.ExportPath = "/some/other/export"
+	export.Restrictions[0].ReadOnly = false
+	modified, newEtag, err := testConnection.ExportModify(
+		context.TODO(),
+		created.Id,
+		export,
+		etag,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, modified.Id, created.Id)
+	assert.Equal(t, modified.ExportPath, "/some/other/export")
+	assert.False(t, modified.Restrictions[0].ReadOnly)
+	assert.NotEqual(t, newEtag, etag)
+
+	// The first ETag is out of date now.
+	_, _, err = testConnection.ExportModify(context.TODO(), created.Id, export, etag)
+	assertRestError(t, err, 412, "http_precondition_failed_error")
+
+	err = testConnection.ExportDelete(context.TODO(), created.Id, etag)
+	assertRestError(t, err, 412, "http_precondition_failed_error")
+
+	err = testConnection.ExportDelete(context.TODO(), created.Id, newEtag)
+	assert.NoError(t, err)
+}
+
+func TestRestUpdateExport(t *testing.T) {
+	testDirPath, _, cleanup := requireRecordedCluster(t)
+	defer cleanup(t)
+
+	created, err := testConnection.ExportCreate(
+		context.TODO(),
+		NfsExport{ExportPath: "/some/export", FsPath: testDirPath},
+	)
+	assert.NoError(t, err)
+	defer testConnection.ExportDelete(context.TODO(), created.Id, "")
+
+	updated, err := testConnection.ExportUpdate(
+		context.TODO(),
+		created.Id,
+		func(export *NfsExport) bool {
+			export.Description = "updated"
+			return true
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, updated.Description, "updated")
+
+	export, _, err := testConnection.ExportGet(context.TODO(), "/some/export")
+	assert.NoError(t, err)
+	assert.Equal(t, export.Description, "updated")
+}
+
+func TestRestListDirLimit(t *testing.T) {
+	testDirPath, _, cleanup := requireRecordedCluster(t)
+	defer cleanup(t)
+
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := testConnection.CreateDir(context.TODO(), testDirPath, name)
+		assert.NoError(t, err)
+	}
+
+	entries, err := testConnection.ListDir(context.TODO(), testDirPath, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), 2)
+
+	entries, err = testConnection.ListDirAll(context.TODO(), testDirPath)
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), 3)
+}
+
+func TestRestReloginAfterSessionExpiry(t *testing.T) {
+	if testCluster == nil {
+		t.Skip("Needs the in-memory cluster to expire sessions")
+	}
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	testCluster.ExpireSessions()
+
+	_, err := testConnection.CreateDir(context.TODO(), testDirPath, "bar")
+	assert.NoError(t, err)
+}
+
+func TestRestReplayFailsOnUnrecordedRequest(t *testing.T) {
+	fixture := filepath.Join(testFixturesDir, "TestRestCreateDir.json")
+	err := testRecorder.Replay(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testRecorder.Stop()
+
+	// The fixture's first request, which replays without reaching the cluster.
+	attributes, err := testConnection.CreateDir(context.TODO(), testFixtureDir, "TestRestCreateDir")
+	assert.NoError(t, err)
+	assert.Equal(t, attributes.Name, "TestRestCreateDir")
+
+	_, err = testConnection.CreateDir(context.TODO(), testFixtureDir, "unrecorded")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "isn't recorded in "+fixture)
+
+	err = testRecorder.Stop()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not replayed, the fixture is out of date")
+}
@@ -2,12 +2,23 @@ package qumulo
 
 import (
 	"bytes"
+	"context"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Message struct {
@@ -17,6 +28,12 @@ type Message struct {
 	BodyOut    string
 }
 
+// Message status codes for failures before a response.
+const (
+	fakeConnectionRefused = -1
+	fakeConnectionReset   = -2
+)
+
 func assertMessagesConsumed(t *testing.T, messages []Message) {
 	if len(messages) != 0 {
 		t.Fatalf("not all messages used by test: %v", messages)
@@ -50,6 +67,13 @@ func (self *FakeTransport) RoundTrip(req *http.Request) (*http.Response, error)
 		}
 	}
 
+	switch message.StatusCode {
+	case fakeConnectionRefused:
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	case fakeConnectionReset:
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+
 	return &http.Response{
 		StatusCode: message.StatusCode,
 		Body:       ioutil.NopCloser(bytes.NewBufferString(message.BodyOut)),
@@ -57,6 +81,23 @@ func (self *FakeTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	}, nil
 }
 
+// Adds headers to every response.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+func (self *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	response, err := self.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range self.header {
+		response.Header[key] = values
+	}
+	return response, nil
+}
+
 func newTestClient(t *testing.T, host string, port int, messages *[]Message) *http.Client {
 	return &http.Client{
 		Transport: &FakeTransport{t, host, port, messages},
@@ -81,9 +122,9 @@ func TestRestAutoLoginSucces(t *testing.T) {
 	client := newTestClient(t, "1.2.3.4", 44, &messages)
 
 	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
-	_, err := connection.Get("/hi")
+	_, err := connection.Get(context.TODO(), "/hi")
 	assert.NoError(t, err)
-	_, err = connection.Get("/bye")
+	_, err = connection.Get(context.TODO(), "/bye")
 	assert.NoError(t, err)
 
 	assertMessagesConsumed(t, messages)
@@ -97,13 +138,983 @@ func TestRestAutoLoginFail(t *testing.T) {
 	client := newTestClient(t, "1.2.3.4", 44, &messages)
 
 	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
-	_, err := connection.Get("/hi")
+	_, err := connection.Get(context.TODO(), "/hi")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "Login failed: ")
 
 	assertMessagesConsumed(t, messages)
 }
 
+// Accepts only the token from the latest login, counting logins.
+type tokenTransport struct {
+	mutex  sync.Mutex
+	token  string
+	logins int
+}
+
+func (self *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	statusCode := 200
+	body := ""
+	if req.URL.Path == "/v1/session/login" {
+		self.logins++
+		self.token = fmt.Sprintf("token%d", self.logins)
+		body = fmt.Sprintf("{\"bearer_token\": \"%s\"}", self.token)
+	} else if req.Header.Get("Authorization") != "Bearer "+self.token {
+		statusCode = 401
+	}
+
+	return &http.Response{
+		StatusCode: statusCode,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func TestRestConcurrentReloginOnce(t *testing.T) {
+	transport := &tokenTransport{token: "expired"}
+	client := &http.Client{Transport: transport}
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := connection.Get(context.TODO(), "/hi")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, transport.logins, 1)
+}
+
+func TestRestSavedBearerToken(t *testing.T) {
+	transport := &tokenTransport{token: "saved"}
+	client := &http.Client{Transport: transport}
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	assert.Equal(t, connection.BearerToken(), "")
+
+	connection.SetBearerToken("saved")
+	_, err := connection.Get(context.TODO(), "/hi")
+	assert.NoError(t, err)
+	assert.Equal(t, transport.logins, 0)
+
+	// An expired token is replaced by logging in.
+	transport.token = "expired"
+	_, err = connection.Get(context.TODO(), "/hi")
+	assert.NoError(t, err)
+	assert.Equal(t, transport.logins, 1)
+	assert.Equal(t, connection.BearerToken(), "token1")
+}
+
+// Never answers, like a hung node.
+type hungTransport struct{}
+
+func (self *hungTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestRestDeadlineExceeded(t *testing.T) {
+	client := &http.Client{Transport: &hungTransport{}}
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := connection.Get(ctx, "/hi")
+	assert.Equal(t, status.Code(err), codes.DeadlineExceeded)
+}
+
+func TestRestCanceled(t *testing.T) {
+	client := &http.Client{Transport: &hungTransport{}}
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := connection.Get(ctx, "/hi")
+	assert.Equal(t, status.Code(err), codes.Canceled)
+}
+
+func TestRestDefaultRequestTimeout(t *testing.T) {
+	ctx, cancel := withRequestTimeout(context.TODO())
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, deadline, time.Now().Add(DefaultRequestTimeout), time.Second)
+
+	parent, parentCancel := context.WithTimeout(context.TODO(), time.Hour)
+	defer parentCancel()
+	parentDeadline, _ := parent.Deadline()
+
+	ctx, cancel = withRequestTimeout(parent)
+	defer cancel()
+
+	deadline, _ = ctx.Deadline()
+	assert.Equal(t, deadline, parentDeadline)
+}
+
+func newTLSTestServer(t *testing.T) (server *httptest.Server, host string, port int) {
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+
+	serverUrl, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	host = serverUrl.Hostname()
+	port, err = strconv.Atoi(serverUrl.Port())
+	assert.NoError(t, err)
+
+	return
+}
+
+func TestRestTLSUnknownAuthority(t *testing.T) {
+	server, host, port := newTLSTestServer(t)
+	defer server.Close()
+
+	client, err := NewHTTPClient(TLSOptions{})
+	assert.NoError(t, err)
+
+	connection := MakeConnection(host, port, "bob", "yeruncle", client)
+	_, err = connection.Get(context.TODO(), "/hi")
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+	assert.Contains(t, err.Error(), "failed to verify")
+}
+
+func TestRestTLSCACert(t *testing.T) {
+	server, host, port := newTLSTestServer(t)
+	defer server.Close()
+
+	caCert := pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw},
+	)
+
+	client, err := NewHTTPClient(TLSOptions{CACert: caCert, ServerName: "example.com"})
+	assert.NoError(t, err)
+
+	connection := MakeConnection(host, port, "bob", "yeruncle", client)
+	_, err = connection.Get(context.TODO(), "/hi")
+	assert.NoError(t, err)
+
+	client, err = NewHTTPClient(TLSOptions{CACert: caCert, ServerName: "other.com"})
+	assert.NoError(t, err)
+
+	connection = MakeConnection(host, port, "bob", "yeruncle", client)
+	_, err = connection.Get(context.TODO(), "/hi")
+	assert.Equal(t, status.Code(err), codes.Unavailable)
+}
+
+func TestRestTLSInsecure(t *testing.T) {
+	server, host, port := newTLSTestServer(t)
+	defer server.Close()
+
+	client, err := NewHTTPClient(TLSOptions{Insecure: true})
+	assert.NoError(t, err)
+
+	connection := MakeConnection(host, port, "bob", "yeruncle", client)
+	_, err = connection.Get(context.TODO(), "/hi")
+	assert.NoError(t, err)
+}
+
+func TestRestTLSBadCACert(t *testing.T) {
+	_, err := NewHTTPClient(TLSOptions{CACert: []byte("junk")})
+	assert.EqualError(t, err, "No PEM certificates found in CA bundle")
+}
+
+// A logged in connection which records retry delays instead of sleeping.
+func newRetryTestConnection(client *http.Client, delays *[]time.Duration) Connection {
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	connection.session.token = "1:abc"
+	connection.sleep = func(ctx context.Context, delay time.Duration) error {
+		*delays = append(*delays, delay)
+		return nil
+	}
+	return connection
+}
+
+func TestRestRetryOnUnavailable(t *testing.T) {
+	messages := []Message{
+		{"/hi", 503, "", ""},
+		{"/hi", fakeConnectionReset, "", ""},
+		{"/hi", 200, "", "yo"},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	delays := []time.Duration{}
+	connection := newRetryTestConnection(client, &delays)
+	result, err := connection.Get(context.TODO(), "/hi")
+	assert.NoError(t, err)
+	assert.Equal(t, string(result), "yo")
+	assert.Len(t, delays, 2)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestRetryDelete(t *testing.T) {
+	messages := []Message{
+		{"/v1/files/9", 503, "", ""},
+		{"/v1/files/9", 200, "", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	delays := []time.Duration{}
+	connection := newRetryTestConnection(client, &delays)
+	_, err := connection.Delete(context.TODO(), "/v1/files/9")
+	assert.NoError(t, err)
+	assert.Len(t, delays, 1)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestRetryHonorsRetryAfter(t *testing.T) {
+	messages := []Message{
+		{"/hi", 429, "", ""},
+		{"/hi", 200, "", ""},
+	}
+	client := &http.Client{
+		Transport: &headerTransport{
+			&FakeTransport{t, "1.2.3.4", 44, &messages},
+			http.Header{"Retry-After": []string{"7"}},
+		},
+	}
+
+	delays := []time.Duration{}
+	connection := newRetryTestConnection(client, &delays)
+	_, err := connection.Get(context.TODO(), "/hi")
+	assert.NoError(t, err)
+	assert.Equal(t, delays, []time.Duration{7 * time.Second})
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestRetryAfterBeyondBudget(t *testing.T) {
+	messages := []Message{
+		{"/hi", 503, "", ""},
+	}
+	client := &http.Client{
+		Transport: &headerTransport{
+			&FakeTransport{t, "1.2.3.4", 44, &messages},
+			http.Header{"Retry-After": []string{"3600"}},
+		},
+	}
+
+	delays := []time.Duration{}
+	connection := newRetryTestConnection(client, &delays)
+	_, err := connection.Get(context.TODO(), "/hi")
+	assertRestError(t, err, 503, "")
+	assert.Len(t, delays, 0)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestRetryMaxAttempts(t *testing.T) {
+	messages := []Message{
+		{"/hi", 502, "", ""},
+		{"/hi", 502, "", ""},
+		{"/hi", 502, "", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	delays := []time.Duration{}
+	connection := newRetryTestConnection(client, &delays)
+	connection.RetryPolicy.MaxAttempts = 3
+	_, err := connection.Get(context.TODO(), "/hi")
+	assertRestError(t, err, 502, "")
+	assert.Len(t, delays, 2)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestRetryPost(t *testing.T) {
+	cases := []struct {
+		name     string
+		messages []Message
+		retried  bool
+	}{
+		{
+			name:     "bad gateway may have been applied",
+			messages: []Message{{"/v1/files/5/entries/", 502, "{\"a\":1}", ""}},
+		},
+		{
+			name:     "connection reset may have been applied",
+			messages: []Message{{"/v1/files/5/entries/", fakeConnectionReset, "{\"a\":1}", ""}},
+		},
+		{
+			name: "connection refused was never sent",
+			messages: []Message{
+				{"/v1/files/5/entries/", fakeConnectionRefused, "{\"a\":1}", ""},
+				{"/v1/files/5/entries/", 200, "{\"a\":1}", ""},
+			},
+			retried: true,
+		},
+		{
+			name: "throttled was not applied",
+			messages: []Message{
+				{"/v1/files/5/entries/", 429, "{\"a\":1}", ""},
+				{"/v1/files/5/entries/", 200, "{\"a\":1}", ""},
+			},
+			retried: true,
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			messages := test.messages
+			client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+			delays := []time.Duration{}
+			connection := newRetryTestConnection(client, &delays)
+			_, err := connection.Post(context.TODO(), "/v1/files/5/entries/", []byte("{\"a\":1}"))
+			if test.retried {
+				assert.NoError(t, err)
+				assert.Len(t, delays, 1)
+			} else {
+				assert.Error(t, err)
+				assert.Len(t, delays, 0)
+			}
+
+			assertMessagesConsumed(t, messages)
+		})
+	}
+}
+
+func TestRestRetryConditionalPatch(t *testing.T) {
+	messages := []Message{
+		{"/v1/snapshots/policies/3", 504, "{}", ""},
+		{"/v1/snapshots/policies/3", 200, "{}", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	delays := []time.Duration{}
+	connection := newRetryTestConnection(client, &delays)
+	_, _, err := connection.DoWithHeaders(
+		context.TODO(),
+		"PATCH",
+		"/v1/snapshots/policies/3",
+		[]byte("{}"),
+		http.Header{"If-Match": []string{"\"etag\""}},
+	)
+	assert.NoError(t, err)
+	assert.Len(t, delays, 1)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	for attempt, max := range []time.Duration{1, 2, 4, 5, 5} {
+		max *= time.Second
+		delay := policy.backoff(attempt + 1)
+		assert.GreaterOrEqual(t, int64(delay), int64(max/2))
+		assert.LessOrEqual(t, int64(delay), int64(max))
+	}
+}
+
+func TestRestParseRetryAfter(t *testing.T) {
+	_, ok := parseRetryAfter(http.Header{})
+	assert.False(t, ok)
+
+	delay, ok := parseRetryAfter(http.Header{"Retry-After": []string{"12"}})
+	assert.True(t, ok)
+	assert.Equal(t, delay, 12*time.Second)
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	delay, ok = parseRetryAfter(http.Header{"Retry-After": []string{date}})
+	assert.True(t, ok)
+	assert.InDelta(t, float64(delay), float64(time.Minute), float64(2*time.Second))
+
+	_, ok = parseRetryAfter(http.Header{"Retry-After": []string{"soon"}})
+	assert.False(t, ok)
+}
+
+func TestRestSnapshotPolicyAddSource(t *testing.T) {
+	messages := []Message{
+		{"/v1/snapshots/policies/3", 200, "", "{\"id\": 3, \"source_file_ids\": [\"2\"]}"},
+		{"/v1/snapshots/policies/3", 200, "{\"source_file_ids\":[\"2\",\"55\"]}", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.SnapshotPolicyAddSource(context.TODO(), "3", "55")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestSnapshotPolicyAddSourceAlreadyPresent(t *testing.T) {
+	messages := []Message{
+		{"/v1/snapshots/policies/3", 200, "", "{\"id\": 3, \"source_file_ids\": [\"55\"]}"},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.SnapshotPolicyAddSource(context.TODO(), "3", "55")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestSnapshotPolicyAddSourceConcurrentModify(t *testing.T) {
+	messages := []Message{
+		{"/v1/snapshots/policies/3", 200, "", "{\"id\": 3, \"source_file_ids\": []}"},
+		{"/v1/snapshots/policies/3", 412, "{\"source_file_ids\":[\"55\"]}", ""},
+		{"/v1/snapshots/policies/3", 200, "", "{\"id\": 3, \"source_file_ids\": [\"9\"]}"},
+		{"/v1/snapshots/policies/3", 200, "{\"source_file_ids\":[\"9\",\"55\"]}", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.SnapshotPolicyAddSource(context.TODO(), "3", "55")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestSnapshotPolicyAddSourceConcurrentModifyTooOften(t *testing.T) {
+	messages := []Message{}
+	for i := 0; i < conditionalUpdateAttempts; i++ {
+		messages = append(
+			messages,
+			Message{"/v1/snapshots/policies/3", 200, "", "{\"id\": 3, \"source_file_ids\": []}"},
+			Message{"/v1/snapshots/policies/3", 412, "{\"source_file_ids\":[\"55\"]}", ""},
+		)
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.SnapshotPolicyAddSource(context.TODO(), "3", "55")
+	assert.Equal(t, err, ConcurrentModificationError{Resource: "Snapshot policy", Id: "3"})
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestSnapshotPolicyRemoveSource(t *testing.T) {
+	messages := []Message{
+		{"/v1/snapshots/policies/3", 200, "", "{\"id\": 3, \"source_file_ids\": [\"9\", \"55\"]}"},
+		{"/v1/snapshots/policies/3", 200, "{\"source_file_ids\":[\"9\"]}", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.SnapshotPolicyRemoveSource(context.TODO(), "3", "55")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestSnapshotPolicyRemoveSourcePolicyGone(t *testing.T) {
+	messages := []Message{
+		{"/v1/snapshots/policies/3", 404, "", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.SnapshotPolicyRemoveSource(context.TODO(), "3", "55")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestReplicationSourceEnsureExisting(t *testing.T) {
+	messages := []Message{
+		{
+			"/v2/replication/source-relationships/",
+			200,
+			"",
+			"[{\"id\": \"abc\", \"source_root_id\": \"9\"}, " +
+				"{\"id\": \"def\", \"source_root_id\": \"55\"}]",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	relationship, err := connection.ReplicationSourceEnsure(
+		context.TODO(),
+		"dr",
+		"55",
+		"/replicas/vol",
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, relationship.Id, "def")
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestReplicationSourceEnsureCreates(t *testing.T) {
+	messages := []Message{
+		{"/v2/replication/source-relationships/", 200, "", "[]"},
+		{
+			"/v2/replication/source-relationships/",
+			200,
+			"{\"target_address\":\"dr\",\"target_port\":3712," +
+				"\"source_root_id\":\"55\",\"target_root_path\":\"/replicas/vol\"}",
+			"{\"id\": \"xyz\", \"source_root_id\": \"55\"}",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	relationship, err := connection.ReplicationSourceEnsure(
+		context.TODO(),
+		"dr",
+		"55",
+		"/replicas/vol",
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, relationship.Id, "xyz")
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestReplicationSourceDeleteForRoot(t *testing.T) {
+	messages := []Message{
+		{
+			"/v2/replication/source-relationships/",
+			200,
+			"",
+			"[{\"id\": \"abc\", \"source_root_id\": \"9\"}, " +
+				"{\"id\": \"def\", \"source_root_id\": \"55\"}]",
+		},
+		{"/v2/replication/source-relationships/def", 200, "", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.ReplicationSourceDeleteForRoot(context.TODO(), "55")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestEnsureAclAlreadySet(t *testing.T) {
+	messages := []Message{
+		{
+			"/v2/files/55/info/acl",
+			200,
+			"",
+			"{\"control\": [], \"posix_special_permissions\": [], \"aces\": [" +
+				"{\"type\": \"ALLOWED\", \"flags\": [], " +
+				"\"trustee\": {\"name\": \"x\", \"domain\": \"LOCAL\"}, \"rights\": [\"READ\"]}]}",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	acl, err := ParseFileAcl([]byte(
+		"{\"aces\": [{\"type\": \"ALLOWED\", " +
+			"\"trustee\": {\"domain\": \"LOCAL\", \"name\": \"x\"}, \"rights\": [\"READ\"]}]}",
+	))
+	assert.NoError(t, err)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err = connection.EnsureAcl(context.TODO(), "55", acl)
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestEnsureAclNameTrustee(t *testing.T) {
+	// The cluster fills in the rest of a trustee given by name, and the control flags.
+	messages := []Message{
+		{
+			"/v2/files/55/info/acl",
+			200,
+			"",
+			"{\"control\": [\"PRESENT\"], \"posix_special_permissions\": [], \"aces\": [" +
+				"{\"type\": \"ALLOWED\", \"flags\": [\"OBJECT_INHERIT\"], \"trustee\": " +
+				"{\"domain\": \"LOCAL\", \"auth_id\": \"500\", \"uid\": 500, \"gid\": null, " +
+				"\"sid\": \"S-1-5-21-1-2-3-1000\", \"name\": \"x\"}, " +
+				"\"rights\": [\"READ\", \"EXECUTE\"]}]}",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	acl, err := ParseFileAcl([]byte(
+		"{\"aces\": [{\"type\": \"ALLOWED\", \"flags\": [\"OBJECT_INHERIT\"], " +
+			"\"trustee\": {\"name\": \"x\"}, \"rights\": [\"EXECUTE\", \"READ\"]}]}",
+	))
+	assert.NoError(t, err)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err = connection.EnsureAcl(context.TODO(), "55", acl)
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestAclMatches(t *testing.T) {
+	current := `{"control": ["PRESENT"], "posix_special_permissions": [], "aces": [` +
+		`{"type": "ALLOWED", "flags": [], ` +
+		`"trustee": {"domain": "LOCAL", "uid": 500, "name": "x"}, "rights": ["READ"]}]}`
+
+	cases := []struct {
+		name    string
+		control string
+		trustee string
+		rights  string
+		matches bool
+	}{
+		{name: "name only", trustee: `{"name": "x"}`, rights: `["READ"]`, matches: true},
+		{name: "uid", trustee: `{"uid": 500}`, rights: `["READ"]`, matches: true},
+		{name: "other name", trustee: `{"name": "y"}`, rights: `["READ"]`, matches: false},
+		{name: "other uid", trustee: `{"uid": 501}`, rights: `["READ"]`, matches: false},
+		{name: "other rights", trustee: `{"name": "x"}`, rights: `["EXECUTE"]`, matches: false},
+		{
+			name:    "other control",
+			control: `"control": [], `,
+			trustee: `{"name": "x"}`,
+			rights:  `["READ"]`,
+			matches: false,
+		},
+	}
+
+	for _, test := range cases {
+		test := test //pin
+		t.Run(test.name, func(t *testing.T) {
+			currentAcl, err := ParseFileAcl([]byte(current))
+			assert.NoError(t, err)
+			wantAcl, err := ParseFileAcl([]byte(fmt.Sprintf(
+				`{%s"aces": [{"type": "ALLOWED", "trustee": %s, "rights": %s}]}`,
+				test.control,
+				test.trustee,
+				test.rights,
+			)))
+			assert.NoError(t, err)
+
+			assert.Equal(t, aclMatches(currentAcl, wantAcl), test.matches)
+		})
+	}
+}
+
+func TestRestEnsureAclDiffers(t *testing.T) {
+	messages := []Message{
+		{
+			"/v2/files/55/info/acl",
+			200,
+			"",
+			"{\"control\": [], \"posix_special_permissions\": [], \"aces\": []}",
+		},
+		{
+			"/v2/files/55/info/acl",
+			200,
+			"{\"control\":null,\"posix_special_permissions\":null,\"aces\":[" +
+				"{\"type\":\"ALLOWED\",\"flags\":null,\"trustee\":{\"name\":\"x\"}," +
+				"\"rights\":[\"READ\"]}]}",
+			"",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	acl, err := ParseFileAcl([]byte(
+		"{\"aces\": [{\"type\": \"ALLOWED\", \"trustee\": {\"name\": \"x\"}, \"rights\": [\"READ\"]}]}",
+	))
+	assert.NoError(t, err)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err = connection.EnsureAcl(context.TODO(), "55", acl)
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestListDir(t *testing.T) {
+	messages := []Message{
+		{
+			"/v1/files/%2Fa%2Fns1/entries/?limit=2",
+			200,
+			"",
+			"{\"files\": [{\"id\": \"9\", \"name\": \"vol1\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", " +
+				"\"mode\": \"0777\"}], \"paging\": {\"next\": \"\"}}",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	entries, err := connection.ListDir(context.TODO(), "/a/ns1", 2)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		entries,
+		[]FileAttributes{{Id: "9", Type: "FS_FILE_TYPE_DIRECTORY", Mode: "0777", Name: "vol1"}},
+	)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestParseFileAttributes(t *testing.T) {
+	full := `{
+		"id": "9",
+		"type": "FS_FILE_TYPE_DIRECTORY",
+		"mode": "0777",
+		"name": "vol1",
+		"path": "/a/ns1/vol1/",
+		"size": "4096",
+		"owner": "500",
+		"group": "513",
+		"num_links": 2,
+		"child_count": 3,
+		"creation_time": "2021-06-01T12:00:00.123456789Z",
+		"modification_time": "2021-06-02T12:00:00Z",
+		"change_time": "2021-06-03T12:00:00Z"
+	}`
+
+	attributes, err := ParseFileAttributes([]byte(full))
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		attributes,
+		FileAttributes{
+			Id:               "9",
+			Type:             "FS_FILE_TYPE_DIRECTORY",
+			Mode:             "0777",
+			Name:             "vol1",
+			Path:             "/a/ns1/vol1/",
+			Size:             4096,
+			Owner:            "500",
+			Group:            "513",
+			NumLinks:         2,
+			ChildCount:       3,
+			CreationTime:     time.Date(2021, 6, 1, 12, 0, 0, 123456789, time.UTC),
+			ModificationTime: time.Date(2021, 6, 2, 12, 0, 0, 0, time.UTC),
+			ChangeTime:       time.Date(2021, 6, 3, 12, 0, 0, 0, time.UTC),
+		},
+	)
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{`{"type": "FS_FILE_TYPE_FILE", "mode": "0644"}`, "no id"},
+		{`{"id": "9", "mode": "0644"}`, "no type"},
+		{`{"id": "9", "type": "FS_FILE_TYPE_FILE"}`, "no mode"},
+		{`{"id": "9", "type": "FS_FILE_TYPE_FILE", "mode": "0644", "size": "-1"}`, `size "-1"`},
+		{
+			`{"id": "9", "type": "FS_FILE_TYPE_FILE", "mode": "0644", "change_time": "today"}`,
+			`change_time "today"`,
+		},
+		{`{"id": 9, "type": "FS_FILE_TYPE_FILE", "mode": "0644"}`, "cannot unmarshal number"},
+		{`<html>Bad Gateway</html>`, "invalid character"},
+		{``, "unexpected end of JSON input"},
+	}
+
+	for _, test := range tests {
+		test := test //pin
+		t.Run(test.body, func(t *testing.T) {
+			_, err := ParseFileAttributes([]byte(test.body))
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "Invalid file attributes: ")
+			assert.Contains(t, err.Error(), test.expected)
+		})
+	}
+}
+
+func TestRestParseListDirResponse(t *testing.T) {
+	entries, next, err := parseListDirResponse([]byte(
+		`{"files": [], "paging": {"next": "/v1/files/2/entries/?after=x"}}`,
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, entries, []FileAttributes{})
+	assert.Equal(t, next, "/v1/files/2/entries/?after=x")
+
+	_, _, err = parseListDirResponse([]byte(`{"files": [{"id": "9"}]}`))
+	assert.EqualError(t, err, "Invalid file attributes: no type")
+
+	_, _, err = parseListDirResponse([]byte(`{"files": {}}`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid directory listing: ")
+}
+
+func TestRestLookUpInvalidAttributes(t *testing.T) {
+	messages := []Message{
+		{"/v1/files/%2Fa%2Fvol1/info/attributes", 200, "", "{\"id\": \"9\"}"},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	_, err := connection.LookUp(context.TODO(), "/a/vol1")
+	assert.EqualError(t, err, "Invalid file attributes: no type")
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestExportCreateDefaultRestrictions(t *testing.T) {
+	messages := []Message{
+		{
+			"/v2/nfs/exports/",
+			200,
+			"{\"export_path\":\"/e\",\"fs_path\":\"/a/e\",\"description\":\"\"," +
+				"\"restrictions\":[{\"host_restrictions\":[],\"read_only\":false," +
+				"\"require_privileged_port\":false,\"user_mapping\":\"NFS_MAP_NONE\"," +
+				"\"map_to_user\":{\"id_type\":\"LOCAL_USER\",\"id_value\":\"0\"}}]}",
+			"{\"id\": \"5\", \"export_path\": \"/e\", \"fs_path\": \"/a/e\", \"tenant_id\": 1}",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	export, err := connection.ExportCreate(
+		context.TODO(),
+		NfsExport{ExportPath: "/e", FsPath: "/a/e"},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, export, NfsExport{Id: "5", ExportPath: "/e", FsPath: "/a/e", TenantId: 1})
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestExportUpdateConcurrentModify(t *testing.T) {
+	messages := []Message{
+		{"/v2/nfs/exports/5", 200, "", "{\"id\": \"5\", \"description\": \"\"}"},
+		{"/v2/nfs/exports/5", 412, "{\"id\":\"5\",\"export_path\":\"\",\"fs_path\":\"\"," +
+			"\"description\":\"x\",\"restrictions\":null}", ""},
+		{"/v2/nfs/exports/5", 200, "", "{\"id\": \"5\", \"description\": \"x\"}"},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	export, err := connection.ExportUpdate(
+		context.TODO(),
+		"5",
+		func(export *NfsExport) bool {
+			if export.Description == "x" {
+				return false
+			}
+			export.Description = "x"
+			return true
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, export, NfsExport{Id: "5", Description: "x"})
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestExportUpdateConcurrentModifyTooOften(t *testing.T) {
+	messages := []Message{}
+	for i := 0; i < conditionalUpdateAttempts; i++ {
+		messages = append(
+			messages,
+			Message{"/v2/nfs/exports/5", 200, "", "{\"id\": \"5\", \"description\": \"\"}"},
+			Message{"/v2/nfs/exports/5", 412, "{\"id\":\"5\",\"export_path\":\"\"," +
+				"\"fs_path\":\"\",\"description\":\"x\",\"restrictions\":null}", ""},
+		)
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	_, err := connection.ExportUpdate(
+		context.TODO(),
+		"5",
+		func(export *NfsExport) bool {
+			export.Description = "x"
+			return true
+		},
+	)
+	assert.Equal(t, err, ConcurrentModificationError{Resource: "NFS export", Id: "5"})
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestExportListInvalid(t *testing.T) {
+	messages := []Message{
+		{"/v2/nfs/exports/", 200, "", "{\"entries\": []}"},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	_, err := connection.ExportList(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid NFS export list: ")
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestTreeDeleteCreateAlreadyRunning(t *testing.T) {
+	messages := []Message{
+		{
+			"/v1/files/%2Fa%2Fvol1/info/attributes",
+			200,
+			"",
+			"{\"id\": \"9\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", \"mode\": \"0777\"}",
+		},
+		{"/v1/tree-delete/jobs/9", 200, "", "{\"id\": \"9\"}"},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.TreeDeleteCreate(context.TODO(), "/a/vol1")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestTreeDeleteCreateNewJob(t *testing.T) {
+	messages := []Message{
+		{
+			"/v1/files/%2Fa%2Fvol1/info/attributes",
+			200,
+			"",
+			"{\"id\": \"9\", \"type\": \"FS_FILE_TYPE_DIRECTORY\", \"mode\": \"0777\"}",
+		},
+		{"/v1/tree-delete/jobs/9", 404, "", ""},
+		{"/v1/tree-delete/jobs/", 200, "{\"id\":\"9\"}", ""},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	err := connection.TreeDeleteCreate(context.TODO(), "/a/vol1")
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestRestQuotaStatusListPaging(t *testing.T) {
+	messages := []Message{
+		{
+			"/v1/files/quotas/status/?limit=1000",
+			200,
+			"",
+			"{\"quotas\": [{\"id\": \"9\", \"path\": \"/a/vol1/\", \"limit\": \"1000\", " +
+				"\"capacity_usage\": \"10\"}], " +
+				"\"paging\": {\"next\": \"/v1/files/quotas/status/?after=9&limit=1000\"}}",
+		},
+		{
+			"/v1/files/quotas/status/?after=9&limit=1000",
+			200,
+			"",
+			"{\"quotas\": [{\"id\": \"12\", \"path\": \"/a/vol2/\", \"limit\": \"2000\", " +
+				"\"capacity_usage\": \"20\"}], \"paging\": {\"next\": \"\"}}",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	connection := MakeConnection("1.2.3.4", 44, "bob", "yeruncle", client)
+	quotas, err := connection.QuotaStatusList(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		quotas,
+		[]QuotaStatus{
+			{Id: "9", Path: "/a/vol1/", Limit: 1000, CapacityUsage: 10},
+			{Id: "12", Path: "/a/vol2/", Limit: 2000, CapacityUsage: 20},
+		},
+	)
+
+	assertMessagesConsumed(t, messages)
+}
+
 func TestRestSemanticVersionBadRevsion1(t *testing.T) {
 	info := QumuloVersionInfo{Revision: "blah"}
 	_, err := info.GetSemanticVersion()
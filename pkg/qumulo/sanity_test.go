@@ -0,0 +1,119 @@
+package qumulo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kubernetes-csi/csi-test/v4/pkg/sanity"
+	"github.com/onsi/ginkgo/config"
+	mount "k8s.io/mount-utils"
+)
+
+// Sanity cases the driver knowingly fails, matched as regular expressions against the full
+// case names. Cases for capabilities the driver doesn't advertise are skipped by the suite
+// itself.
+var sanitySkips = []struct {
+	pattern string
+	reason  string
+}{
+	{
+		"should fail when requesting to create a volume with already existing name and " +
+			"different capacity",
+		"CreateVolume with an existing name sets the quota to the new capacity",
+	},
+	{
+		"ValidateVolumeCapabilities should fail when the requested volume does not exist",
+		"ValidateVolumeCapabilities gets no secrets so can't look the volume up on the cluster",
+	},
+	{
+		"should not fail when creating volume with maximum-length name",
+		"The volume ID holds the name and its directory, so can't fit in 128 bytes with it",
+	},
+}
+
+// The RPCs whose requests carry the credentials of the test cluster.
+var sanitySecretRPCs = []string{
+	"CreateVolumeSecret",
+	"DeleteVolumeSecret",
+	"ControllerExpandVolumeSecret",
+}
+
+func writeSanitySecrets(t *testing.T, dir string) string {
+	secrets := ""
+	for _, rpc := range sanitySecretRPCs {
+		secrets += fmt.Sprintf(
+			"%s:\n  username: %q\n  password: %q\n  insecure: %q\n",
+			rpc,
+			testUsername,
+			testPassword,
+			testInsecure,
+		)
+	}
+
+	path := filepath.Join(dir, "secrets.yaml")
+	err := ioutil.WriteFile(path, []byte(secrets), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+/*                  _ _
+ *  ___  __ _ _ __ (_) |_ _   _
+ * / __|/ _` | '_ \| | __| | | |
+ * \__ \ (_| | | | | | |_| |_| |
+ * |___/\__,_|_| |_|_|\__|\__, |
+ *                        |___/
+ *  FIGLET: sanity
+ */
+
+// Run the csi-test sanity suite against the driver's gRPC server on a unix socket. Volumes are
+// created on the test cluster, which is the in-memory one unless QUMULO_TEST_HOST is set, and
+// mounts only go as far as a fake mounter.
+func TestSanity(t *testing.T) {
+	testDirPath, _, cleanup := requireCluster(t)
+	defer cleanup(t)
+
+	tempDir := t.TempDir()
+	endpoint := "unix://" + filepath.Join(tempDir, "csi.sock")
+
+	driver := NewDriver("sanity-node", DefaultDriverName, endpoint, nil)
+	driver.ns = NewNodeServer(driver, &mount.FakeMounter{MountPoints: []mount.MountPoint{}})
+
+	server := NewNonBlockingGRPCServer()
+	server.Start(
+		endpoint,
+		NewDefaultIdentityServer(driver),
+		NewControllerServer(driver),
+		driver.ns,
+		false,
+	)
+	defer server.ForceStop()
+
+	sanityConfig := sanity.NewTestConfig()
+	sanityConfig.Address = endpoint
+	sanityConfig.TargetPath = filepath.Join(tempDir, "target")
+	sanityConfig.StagingPath = filepath.Join(tempDir, "staging")
+	sanityConfig.SecretsFile = writeSanitySecrets(t, tempDir)
+	sanityConfig.TestVolumeParameters = map[string]string{
+		paramServer:          testHost,
+		paramRestPort:        strconv.Itoa(testPort),
+		paramStoreRealPath:   testDirPath,
+		paramStoreExportPath: "/",
+	}
+	sanityConfig.IdempotentCount = 2
+
+	skips := []string{}
+	for _, skip := range sanitySkips {
+		t.Logf("Skipping sanity case %q: %s", skip.pattern, skip.reason)
+		skips = append(skips, skip.pattern)
+	}
+	config.GinkgoConfig.SkipString = strings.Join(skips, "|")
+
+	sanity.Test(t, sanityConfig)
+}
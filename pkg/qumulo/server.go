@@ -88,7 +88,7 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(traceGRPC, logGRPC, metricsGRPC),
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
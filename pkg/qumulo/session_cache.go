@@ -0,0 +1,174 @@
+package qumulo
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long a cached connection, and the version check done when it was made, is reused.
+const DefaultSessionTTL = 10 * time.Minute
+
+// Connections to clusters shared by controller RPCs, so that each RPC doesn't pay for a
+// version check and a login. Entries are keyed on a hash of the password and TLS options so
+// changing the credentials in a secret starts a new session.
+type SessionCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[sessionKey]*sessionEntry
+
+	// Given to new connections.
+	RetryPolicy       RetryPolicy
+	CorrelationHeader string
+
+	// Replaceable by tests.
+	now       func() time.Time
+	newClient func(TLSOptions) (*http.Client, error)
+}
+
+type sessionKey struct {
+	server       string
+	port         int
+	username     string
+	passwordHash [sha256.Size]byte
+	tlsHash      [sha256.Size]byte
+}
+
+type sessionEntry struct {
+	created    time.Time
+	ready      chan struct{}
+	connection *Connection
+	err        error
+
+	// The caller making the connection gave up, so its error isn't one for the callers waiting
+	// on it to return.
+	abandoned bool
+}
+
+func NewSessionCache(ttl time.Duration) *SessionCache {
+	return &SessionCache{
+		ttl:         ttl,
+		entries:     map[sessionKey]*sessionEntry{},
+		RetryPolicy: DefaultRetryPolicy,
+		now:         time.Now,
+		newClient:   NewHTTPClient,
+	}
+}
+
+// Return a cached connection, or make one and check it with validate. Concurrent callers
+// for the same key wait for a single validate, or until their own ctx ends. Failures are not
+// cached, and when the caller validating gives up the callers waiting on it try again.
+func (self *SessionCache) Get(
+	ctx context.Context,
+	server string,
+	port int,
+	username string,
+	password string,
+	tlsOptions TLSOptions,
+	validate func(context.Context, *Connection) error,
+) (*Connection, error) {
+	key := sessionKey{
+		server:       server,
+		port:         port,
+		username:     username,
+		passwordHash: sha256.Sum256([]byte(password)),
+		tlsHash: sha256.Sum256([]byte(fmt.Sprintf(
+			"%q %q %t",
+			tlsOptions.CACert,
+			tlsOptions.ServerName,
+			tlsOptions.Insecure,
+		))),
+	}
+
+	for {
+		self.mutex.Lock()
+
+		entry, ok := self.entries[key]
+		if ok && self.now().Sub(entry.created) >= self.ttl {
+			logInfo(ctx, 4, "Session expired", "host", server, "port", port, "username", username)
+			delete(self.entries, key)
+			ok = false
+		}
+
+		if !ok {
+			return self.connect(ctx, key, password, tlsOptions, validate)
+		}
+
+		self.mutex.Unlock()
+		sessionCacheLookups.WithLabelValues("hit").Inc()
+
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if !entry.abandoned {
+			return entry.connection, entry.err
+		}
+	}
+}
+
+// Make a connection for key and cache it if validate succeeds. Called with the mutex held,
+// which it releases.
+func (self *SessionCache) connect(
+	ctx context.Context,
+	key sessionKey,
+	password string,
+	tlsOptions TLSOptions,
+	validate func(context.Context, *Connection) error,
+) (*Connection, error) {
+	server, port, username := key.server, key.port, key.username
+
+	// The password or TLS options changed, the old session must not be used any more.
+	for other := range self.entries {
+		if other.server == server && other.port == port && other.username == username {
+			logInfo(
+				ctx,
+				2,
+				"Credentials changed",
+				"host",
+				server,
+				"port",
+				port,
+				"username",
+				username,
+			)
+			delete(self.entries, other)
+		}
+	}
+
+	sessionCacheLookups.WithLabelValues("miss").Inc()
+
+	entry := &sessionEntry{created: self.now(), ready: make(chan struct{})}
+	self.entries[key] = entry
+
+	self.mutex.Unlock()
+
+	client, err := self.newClient(tlsOptions)
+	if err == nil {
+		connection := MakeConnection(server, port, username, password, client)
+		connection.RetryPolicy = self.RetryPolicy
+		connection.CorrelationHeader = self.CorrelationHeader
+		err = validate(ctx, &connection)
+		if err == nil {
+			entry.connection = &connection
+		}
+	}
+
+	entry.err = err
+	entry.abandoned = err != nil && ctx.Err() != nil
+	if entry.err != nil {
+		self.mutex.Lock()
+		if self.entries[key] == entry {
+			delete(self.entries, key)
+		}
+		self.mutex.Unlock()
+	}
+	close(entry.ready)
+
+	return entry.connection, entry.err
+}
@@ -0,0 +1,268 @@
+package qumulo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestSessionCache(t *testing.T, messages *[]Message) *SessionCache {
+	cache := NewSessionCache(time.Minute)
+	cache.newClient = func(TLSOptions) (*http.Client, error) {
+		return newTestClient(t, "1.2.3.4", 44, messages), nil
+	}
+	return cache
+}
+
+func connectMessages(password string) []Message {
+	return []Message{
+		{"/v1/version", 401, "", ""},
+		{
+			"/v1/session/login",
+			200,
+			fmt.Sprintf("{\"username\":\"bob\",\"password\":\"%s\"}", password),
+			"{\"bearer_token\": \"1:abc\"}",
+		},
+		{"/v1/version", 200, "", "{\"revision_id\": \"Qumulo Core 4.3.0\"}"},
+	}
+}
+
+func TestSessionCacheReuse(t *testing.T) {
+	ctx := context.TODO()
+	messages := connectMessages("yeruncle")
+	cache := newTestSessionCache(t, &messages)
+
+	c1, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+	assertMessagesConsumed(t, messages)
+
+	c2, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+	assert.Same(t, c1, c2)
+}
+
+func TestSessionCacheCredentialsChanged(t *testing.T) {
+	ctx := context.TODO()
+	messages := append(connectMessages("yeruncle"), connectMessages("newpass")...)
+	cache := newTestSessionCache(t, &messages)
+
+	c1, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+
+	c2, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "newpass", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+	assert.NotSame(t, c1, c2)
+	assert.Equal(t, c2.Password, "newpass")
+	assert.Len(t, cache.entries, 1)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestSessionCacheTLSOptionsChanged(t *testing.T) {
+	ctx := context.TODO()
+	messages := append(connectMessages("yeruncle"), connectMessages("yeruncle")...)
+	cache := newTestSessionCache(t, &messages)
+
+	c1, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+
+	tlsOptions := TLSOptions{ServerName: "cluster.example.com"}
+	c2, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", tlsOptions, checkClusterVersion)
+	assert.NoError(t, err)
+	assert.NotSame(t, c1, c2)
+	assert.Len(t, cache.entries, 1)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestSessionCacheExpiry(t *testing.T) {
+	ctx := context.TODO()
+	messages := append(connectMessages("yeruncle"), connectMessages("yeruncle")...)
+	cache := newTestSessionCache(t, &messages)
+
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+
+	c1, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+
+	now = now.Add(59 * time.Second)
+	c2, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+	assert.Same(t, c1, c2)
+
+	now = now.Add(time.Second)
+	c3, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+	assert.NotSame(t, c1, c3)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestSessionCacheVersionUndecodable(t *testing.T) {
+	ctx := context.TODO()
+	messages := connectMessages("yeruncle")
+	messages[2].BodyOut = "{\"revision_id\": \"blah\"}"
+	cache := newTestSessionCache(t, &messages)
+
+	_, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.Equal(t, status.Code(err), codes.Internal)
+	assert.Equal(
+		t,
+		status.Convert(err).Message(),
+		"Failed to get version of 1.2.3.4: Could not decode version &{\"blah\"}",
+	)
+	assert.Len(t, cache.entries, 0)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestSessionCacheFailureNotCached(t *testing.T) {
+	ctx := context.TODO()
+	messages := []Message{
+		{"/v1/version", 401, "", ""},
+		{"/v1/session/login", 401, "{\"username\":\"bob\",\"password\":\"nope\"}", ""},
+	}
+	messages = append(messages, connectMessages("yeruncle")...)
+	cache := newTestSessionCache(t, &messages)
+
+	_, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "nope", TLSOptions{}, checkClusterVersion)
+	assert.EqualError(t, err, "rpc error: code = Unauthenticated desc = Login failed: 401")
+	assert.Len(t, cache.entries, 0)
+
+	_, err = cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+
+	assertMessagesConsumed(t, messages)
+}
+
+func TestSessionCacheConcurrentGetValidatesOnce(t *testing.T) {
+	ctx := context.TODO()
+	cache := NewSessionCache(time.Minute)
+
+	var validations int32
+	release := make(chan struct{})
+	validate := func(context.Context, *Connection) error {
+		atomic.AddInt32(&validations, 1)
+		<-release
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	connections := make([]*Connection, 10)
+	for i := range connections {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, validate)
+			assert.NoError(t, err)
+			connections[i] = c
+		}(i)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, atomic.LoadInt32(&validations), int32(1))
+	for _, c := range connections {
+		assert.Same(t, c, connections[0])
+	}
+}
+
+func TestSessionCacheWaiterDeadline(t *testing.T) {
+	cache := NewSessionCache(time.Minute)
+
+	release := make(chan struct{})
+	defer close(release)
+	validate := func(context.Context, *Connection) error {
+		<-release
+		return nil
+	}
+
+	go cache.Get(context.TODO(), "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, validate)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	_, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, validate)
+	assert.Equal(t, err, context.DeadlineExceeded)
+}
+
+func TestSessionCacheValidatorCanceled(t *testing.T) {
+	cache := NewSessionCache(time.Minute)
+
+	var validations int32
+	started := make(chan struct{})
+	validate := func(ctx context.Context, _ *Connection) error {
+		if atomic.AddInt32(&validations, 1) == 1 {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	first := make(chan error)
+	go func() {
+		_, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, validate)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan error)
+	go func() {
+		_, err := cache.Get(
+			context.TODO(),
+			"1.2.3.4",
+			44,
+			"bob",
+			"yeruncle",
+			TLSOptions{},
+			validate,
+		)
+		second <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	assert.Equal(t, <-first, context.Canceled)
+	assert.NoError(t, <-second)
+	assert.Equal(t, atomic.LoadInt32(&validations), int32(2))
+	assert.Len(t, cache.entries, 1)
+}
+
+func TestSessionCacheDeleteRelogin(t *testing.T) {
+	ctx := context.TODO()
+	messages := append(
+		connectMessages("yeruncle"),
+		Message{"/v1/files/%2Fa%2Fvol1", 401, "", ""},
+		Message{
+			"/v1/session/login",
+			200,
+			"{\"username\":\"bob\",\"password\":\"yeruncle\"}",
+			"{\"bearer_token\": \"1:def\"}",
+		},
+		Message{"/v1/files/%2Fa%2Fvol1", 200, "", ""},
+	)
+	cache := newTestSessionCache(t, &messages)
+
+	c, err := cache.Get(ctx, "1.2.3.4", 44, "bob", "yeruncle", TLSOptions{}, checkClusterVersion)
+	assert.NoError(t, err)
+
+	// The cached session's token expired on the cluster.
+	err = c.FileDelete(ctx, "/a/vol1")
+	assert.NoError(t, err)
+	assert.Equal(t, c.BearerToken(), "1:def")
+
+	assertMessagesConsumed(t, messages)
+}
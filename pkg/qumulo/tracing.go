@@ -0,0 +1,133 @@
+package qumulo
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const tracerName = "github.com/kubernetes-csi/csi-driver-qumulo/pkg/qumulo"
+
+// Span attributes, beyond the semantic conventions.
+const (
+	attributeRestUri        = attribute.Key("qumulo.uri")
+	attributeRestErrorClass = attribute.Key("qumulo.error_class")
+	attributeRestAttempt    = attribute.Key("qumulo.attempt")
+	attributeRestAttempts   = attribute.Key("qumulo.attempts")
+	attributeRestDelay      = attribute.Key("qumulo.retry_delay")
+	attributeGRPCCode       = attribute.Key("rpc.grpc.status_code")
+	attributeCorrelationID  = attribute.Key("qumulo.correlation_id")
+)
+
+// Until SetupTracing is called this is the global no-op provider, so spans cost next to
+// nothing.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Export spans over OTLP/gRPC to endpoint (host:port). The returned function flushes
+// pending spans.
+func SetupTracing(
+	ctx context.Context,
+	endpoint string,
+	insecure bool,
+	driverName string,
+) (func(context.Context) error, error) {
+	options := []otlpgrpc.Option{otlpgrpc.WithEndpoint(endpoint)}
+	if insecure {
+		options = append(options, otlpgrpc.WithInsecure())
+	}
+
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(options...))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.ServiceNameKey.String(driverName),
+			semconv.ServiceVersionKey.String(driverVersion),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	klog.Infof("Exporting traces to %s", endpoint)
+
+	return provider.Shutdown, nil
+}
+
+func traceGRPC(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	service := strings.TrimPrefix(info.FullMethod, "/")
+	method := ""
+	if i := strings.LastIndex(service, "/"); i >= 0 {
+		service, method = service[:i], service[i+1:]
+	}
+
+	ctx, span := tracer().Start(
+		ctx,
+		info.FullMethod,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.RPCSystemGRPC,
+			semconv.RPCServiceKey.String(service),
+			semconv.RPCMethodKey.String(method),
+		),
+	)
+	defer span.End()
+
+	resp, err := handler(ctx, req)
+
+	code := status.Code(err)
+	span.SetAttributes(attributeGRPCCode.Int64(int64(code)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, code.String())
+	}
+
+	return resp, err
+}
+
+func (self *Connection) spanAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.NetPeerNameKey.String(self.Host),
+		semconv.NetPeerPortKey.Int(self.Port),
+	}
+}
+
+// Record the outcome of a REST request on its span.
+func endRestSpan(span trace.Span, statusCode int, err error) {
+	if statusCode != 0 {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(statusCode))
+	}
+
+	if err != nil {
+		if z, ok := err.(RestError); ok && z.ErrorClass != "" {
+			span.SetAttributes(attributeRestErrorClass.String(z.ErrorClass))
+		}
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,122 @@
+package qumulo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func useTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return exporter
+}
+
+func spanAttribute(span *sdktrace.SpanSnapshot, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceGRPCRestSpans(t *testing.T) {
+	exporter := useTestTracer(t)
+
+	messages := []Message{
+		{"/v1/files/%2Fa/info/attributes", 401, "", ""},
+		{"/v1/session/login", 200, "{\"username\":\"bob\",\"password\":\"yeruncle\"}", "{}"},
+		{"/v1/files/%2Fa/info/attributes", 503, "", ""},
+		{
+			"/v1/files/%2Fa/info/attributes",
+			404,
+			"",
+			"{\"error_class\": \"fs_no_such_entry_error\"}",
+		},
+	}
+	client := newTestClient(t, "1.2.3.4", 44, &messages)
+
+	delays := []time.Duration{}
+	connection := newRetryTestConnection(client, &delays)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	_, err := traceGRPC(
+		context.TODO(),
+		nil,
+		info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			_, err := connection.Get(ctx, "/v1/files/%2Fa/info/attributes")
+			return nil, transFormRestError(err, nil)
+		},
+	)
+	assert.Equal(t, status.Code(err), codes.NotFound)
+	assertMessagesConsumed(t, messages)
+
+	// Spans are exported as they end, children first.
+	spans := exporter.GetSpans()
+	names := []string{}
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	assert.Equal(
+		t,
+		names,
+		[]string{
+			"attempt",
+			"login",
+			"attempt",
+			"retry",
+			"attempt",
+			"GET /v1/files/{id}/info/attributes",
+			"/csi.v1.Controller/CreateVolume",
+		},
+	)
+
+	grpcSpan := spans[6]
+	restSpan := spans[5]
+	assert.Equal(t, grpcSpan.StatusCode, otelcodes.Error)
+	assert.Equal(t, spanAttribute(grpcSpan, attributeGRPCCode).AsInt64(), int64(codes.NotFound))
+	assert.Equal(t, restSpan.Parent.SpanID(), grpcSpan.SpanContext.SpanID())
+	assert.Equal(t, spanAttribute(restSpan, attributeRestAttempts).AsInt64(), int64(2))
+	assert.Equal(
+		t,
+		spanAttribute(restSpan, attributeRestUri).AsString(),
+		"/v1/files/{id}/info/attributes",
+	)
+
+	for _, span := range spans[:5] {
+		assert.Equal(t, span.Parent.SpanID(), restSpan.SpanContext.SpanID(), span.Name)
+	}
+
+	assert.Equal(t, spanAttribute(spans[0], "http.status_code").AsInt64(), int64(401))
+	assert.Equal(t, spanAttribute(spans[1], "http.status_code").AsInt64(), int64(200))
+	assert.Equal(t, spans[1].StatusCode, otelcodes.Unset)
+	assert.Equal(t, spanAttribute(spans[3], attributeRestAttempt).AsInt64(), int64(1))
+
+	// The request resent after logging in is still the first attempt.
+	assert.Equal(t, spanAttribute(spans[0], attributeRestAttempt).AsInt64(), int64(1))
+	assert.Equal(t, spanAttribute(spans[2], attributeRestAttempt).AsInt64(), int64(1))
+	assert.Equal(t, spanAttribute(spans[2], "http.status_code").AsInt64(), int64(503))
+
+	lastRequest := spans[4]
+	assert.Equal(t, spanAttribute(lastRequest, attributeRestAttempt).AsInt64(), int64(2))
+	assert.Equal(t, spanAttribute(lastRequest, "http.status_code").AsInt64(), int64(404))
+	assert.Equal(
+		t,
+		spanAttribute(lastRequest, attributeRestErrorClass).AsString(),
+		"fs_no_such_entry_error",
+	)
+}
@@ -23,8 +23,12 @@ import (
 	"context"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 )
 
@@ -87,15 +91,52 @@ func logGRPC(
 	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler,
 ) (interface{}, error) {
+	ctx = withRequestLog(ctx, newCorrelationID(), requestLogValues(req)...)
+	trace.SpanFromContext(ctx).SetAttributes(attributeCorrelationID.String(correlationID(ctx)))
+
 	level := klog.Level(getLogLevel(info.FullMethod))
-	klog.V(level).Infof("GRPC call: %s", info.FullMethod)
-	klog.V(level).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	logInfo(
+		ctx,
+		level,
+		"GRPC call",
+		"method",
+		info.FullMethod,
+		"request",
+		protosanitizer.StripSecrets(req),
+	)
 
 	resp, err := handler(ctx, req)
 	if err != nil {
-		klog.Errorf("GRPC error: %v", err)
+		logError(ctx, err, "GRPC error", "method", info.FullMethod)
 	} else {
-		klog.V(level).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+		logInfo(
+			ctx,
+			level,
+			"GRPC response",
+			"method",
+			info.FullMethod,
+			"response",
+			protosanitizer.StripSecrets(resp),
+		)
 	}
 	return resp, err
 }
+
+// Create a Kubernetes client from a kubeconfig file, or from the in-cluster config if empty.
+func GetKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+
+	if kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}